@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/fiatjaf/namechain/common"
+	"github.com/mitchellh/go-homedir"
+)
+
+var config *common.Config
+
+func main() {
+	var err error
+	config = &common.Config{}
+
+	var params struct {
+		numtransactions int
+		blockinterval   int
+		genesisfee      int64
+		format          string
+		sign            string
+		publish         string
+	}
+
+	flag.StringVar(&config.DataDir, "datadir", "~/.namechain", "the base directory we will use to read your config file from and store data into.")
+	flag.IntVar(&params.numtransactions, "numtransactions", 1,
+		"total amount of transactions the new chain will have")
+	flag.IntVar(&params.blockinterval, "blockinterval", 0,
+		"relative locktime between bmm transactions, defaults to the current chain's")
+	flag.Int64Var(&params.genesisfee, "genesisfee", 5000,
+		"how much we will pay, in total satoshis, for the new genesis transaction")
+	flag.StringVar(&params.format, "format", "",
+		"'p2wpkh' or 'p2tr' for the new chain, defaults to the current chain's")
+	flag.StringVar(&params.sign, "sign", "wallet",
+		"how to sign the funding input: 'paste' a finalized PSBT or let bitcoind's 'wallet' do it")
+	flag.StringVar(&params.publish, "publish", "ask",
+		"whether to broadcast the new genesis: 'ask', 'yes' or 'no'")
+	flag.Parse()
+
+	// find datadir
+	config.DataDir, _ = homedir.Expand(config.DataDir)
+
+	// read config file
+	config.ReadConfig()
+
+	if params.numtransactions < 1 || params.numtransactions > 1000000 {
+		log.Fatal("numtransactions must be between 1 and 1000000")
+	}
+	if params.blockinterval < 0 || params.blockinterval > 0xffff {
+		log.Fatal("blockinterval must be between 1 and 65535")
+	}
+	if params.sign != "wallet" && params.sign != "paste" {
+		log.Fatal("sign must be 'paste' or 'wallet'")
+	}
+
+	// load the chain we're extending
+	chainFile := filepath.Join(config.DataDir, common.BMMCHAIN_FILE)
+	chain, err := common.LoadBMMChain(chainFile)
+	if err != nil {
+		log.Fatal("failed to read bmm chain: " + err.Error())
+	}
+	if err := common.VerifyBMMChain(chain); err != nil {
+		log.Fatal("bmm chain isn't the canonical one: " + err.Error())
+	}
+	nextParams := common.BMMParams{
+		Network:       chain.Params.Network,
+		Format:        params.format,
+		BlockInterval: params.blockinterval,
+	}
+	if nextParams.BlockInterval == 0 {
+		nextParams.BlockInterval = chain.Params.BlockInterval
+	}
+	if nextParams.Format == "" {
+		nextParams.Format = chain.Params.Format
+	}
+
+	bitcoin := common.OpenBitcoinRPC(config.BitcoinRPC)
+	line := bufio.NewReader(os.Stdin)
+
+	final := chain.Final().TxHash()
+	if out, err := bitcoin.GetTxOut(&final, 0, true); err != nil {
+		log.Fatal(err)
+	} else if out == nil {
+		fmt.Printf("the final link %s isn't published yet, "+
+			"the new genesis will only be accepted after it.\n", final)
+	}
+
+	// fund it from the bitcoind wallet
+	changeScript, err := common.WalletChangeScript(bitcoin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fundingAmount := common.BMMFundingAmount(params.numtransactions, nextParams.Format)
+	funding, err := common.PickWalletUTXO(bitcoin,
+		fundingAmount+params.genesisfee+common.DustLimit(changeScript))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	genesis, err := common.BuildBMMExtension(chain, nextParams,
+		params.numtransactions, funding, changeScript, params.genesisfee)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("spending a total of %d sat to extend the BMM chain.\n",
+		fundingAmount+params.genesisfee)
+
+	// sign the funding input, the first one is already signed
+	packet, _ := psbt.NewFromUnsignedTx(genesis)
+	packet.Inputs[1].WitnessUtxo = wire.NewTxOut(funding.Value, funding.PkScript)
+	psbtBase64, _ := packet.B64Encode()
+
+	var signed string
+	switch params.sign {
+	case "wallet":
+		signed, _, err = common.WalletProcessPSBT(bitcoin, psbtBase64)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "paste":
+		fmt.Printf("funding transaction to sign (PSBT): %s\n", psbtBase64)
+		fmt.Print("paste signed PSBT: ")
+		signed, _ = line.ReadString('\n')
+	}
+
+	p, err := psbt.NewFromRawBytes(strings.NewReader(strings.TrimSpace(signed)), true)
+	if err != nil {
+		log.Fatal("error parsing psbt: " + err.Error())
+	}
+	if p.UnsignedTx.TxHash() != genesis.TxHash() {
+		log.Fatal("psbt is for a different transaction")
+	}
+	witness, err := common.ParseWitness(p.Inputs[1].FinalScriptWitness)
+	if err != nil || len(witness) == 0 {
+		log.Fatal("funding input wasn't signed")
+	}
+	genesis.TxIn[1].Witness = witness
+
+	next, err := common.ExtendBMMChain(chain, genesis)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, tx := range next.Links {
+		fmt.Printf("BMM %d: %s \n", i+1, common.EncodeTx(tx))
+	}
+	fmt.Printf("\ngenesis: %s \n", common.EncodeTx(genesis))
+
+	shouldPublish := params.publish
+	if shouldPublish == "ask" {
+		fmt.Printf("publish? [yes/no]: ")
+		shouldPublish, _ = line.ReadString('\n')
+		shouldPublish = strings.TrimSpace(shouldPublish)
+	}
+	if shouldPublish != "yes" {
+		// named will find and save the new chain by itself once this is published
+		fmt.Println("not published, you can broadcast the genesis with sendrawtransaction later.")
+		return
+	}
+
+	txid, err := bitcoin.SendRawTransaction(genesis, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("published new genesis %s\n", txid)
+
+	if err := common.ReplaceBMMChain(chainFile, chain, next); err != nil {
+		log.Fatal("failed to save the new bmm chain: " + err.Error())
+	}
+	fmt.Printf("saved the new bmm chain to %s\n", chainFile)
+}
@@ -2,17 +2,19 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
-	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
@@ -23,98 +25,143 @@ import (
 	"github.com/mitchellh/go-homedir"
 )
 
-const MIN_OUTPUT_VALUE int64 = 294
-
 var config *common.Config
 
+// everything can also be given in a JSON file passed to -spec, flags given
+// explicitly take precedence over it.
+type Spec struct {
+	Input           string `json:"input"`
+	NumTransactions int64  `json:"numtransactions"`
+	BlockInterval   int    `json:"blockinterval"`
+	GenesisFee      int64  `json:"genesisfee"`
+	Change          string `json:"change"`
+	Format          string `json:"format"`  // "p2wpkh" or "p2tr"
+	Sign            string `json:"sign"`    // "paste" or "wallet"
+	Publish         string `json:"publish"` // "ask", "yes" or "no"
+}
+
 func main() {
 	var err error
 	config = &common.Config{}
 
-	var params struct {
-		input           string
-		numtransactions int64
-		blockinterval   int
-		genesisfee      int64
-		change          string
-		disposablekey   string
+	var specFile string
+	params := Spec{
+		NumTransactions: 1,
+		BlockInterval:   1,
+		GenesisFee:      5000,
+		Format:          common.BMM_FORMAT_P2WPKH,
+		Sign:            "paste",
+		Publish:         "ask",
 	}
 
 	flag.StringVar(&config.DataDir, "datadir", "~/.namechain", "the base directory we will use to read your config file from and store data into.")
-	flag.StringVar(&params.input, "input", "", "the input vout, in <txid>:<outputnum>")
-	flag.Int64Var(&params.numtransactions, "numtransactions", 1,
+	flag.StringVar(&specFile, "spec", "", "JSON file with the parameters below, for non-interactive runs")
+	flag.StringVar(&params.Input, "input", "", "the input vout, in <txid>:<outputnum>")
+	flag.Int64Var(&params.NumTransactions, "numtransactions", params.NumTransactions,
 		"total amount of transactions we will generate")
-	flag.IntVar(&params.blockinterval, "blockinterval", 1,
+	flag.IntVar(&params.BlockInterval, "blockinterval", params.BlockInterval,
 		"relative locktime between bmm transactions")
-	flag.Int64Var(&params.genesisfee, "genesisfee", 5000,
+	flag.Int64Var(&params.GenesisFee, "genesisfee", params.GenesisFee,
 		"how much we will pay, in total "+
 			"satoshis, for the genesis transaction (on bitcoin)")
-	flag.StringVar(&params.change, "change", "", "the change address")
-	flag.StringVar(&params.disposablekey, "disposablekey",
-		"0000000000000000000000000000000000000000000000000000000000000000",
-		"the key we will use to generate the sequence of transactions and discard")
+	flag.StringVar(&params.Change, "change", "", "the change address")
+	flag.StringVar(&params.Format, "format", params.Format,
+		"how the chain holds its funds and anchors: 'p2wpkh' (with a bare OP_TRUE) or 'p2tr' (with a pay-to-anchor)")
+	flag.StringVar(&params.Sign, "sign", params.Sign,
+		"how to sign the funding input: 'paste' a finalized PSBT or let bitcoind's 'wallet' do it")
+	flag.StringVar(&params.Publish, "publish", params.Publish,
+		"whether to broadcast the genesis: 'ask', 'yes' or 'no'")
 	flag.Parse()
 
+	if specFile != "" {
+		if err := readSpec(specFile, &params); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// find datadir
 	config.DataDir, _ = homedir.Expand(config.DataDir)
 
 	// read config file
 	config.ReadConfig()
 
-	// use a fixed key if not given
-	key, err := hex.DecodeString(params.disposablekey)
-	if err != nil {
+	if err := params.validate(); err != nil {
 		log.Fatal(err)
 	}
-	sk, pk := btcec.PrivKeyFromBytes(btcec.S256(), key)
+
+	bitcoin := common.OpenBitcoinRPC(config.BitcoinRPC)
+	line := bufio.NewReader(os.Stdin)
 
 	// base chain
 	var chainParams *chaincfg.Params
 	switch {
-	case strings.HasPrefix(params.change, "3"), strings.HasPrefix(params.change, "1"),
-		strings.HasPrefix(strings.ToLower(params.change), "bc1"):
+	case strings.HasPrefix(params.Change, "3"), strings.HasPrefix(params.Change, "1"),
+		strings.HasPrefix(strings.ToLower(params.Change), "bc1"):
 		chainParams = &chaincfg.MainNetParams
-	case strings.HasPrefix(params.change, "2"),
-		strings.HasPrefix(params.change, "m"), strings.HasPrefix(params.change, "n"),
-		strings.HasPrefix(strings.ToLower(params.change), "tb1"):
+	case strings.HasPrefix(strings.ToLower(params.Change), "bcrt"):
+		chainParams = &chaincfg.RegressionNetParams
+	case strings.HasPrefix(params.Change, "2"),
+		strings.HasPrefix(params.Change, "m"), strings.HasPrefix(params.Change, "n"),
+		strings.HasPrefix(strings.ToLower(params.Change), "tb1"):
 		chainParams = &chaincfg.TestNet3Params
-	case strings.HasPrefix(strings.ToLower(params.change), "bcrt"):
-		chainParams = &chaincfg.SimNetParams
-		// case simnnet?
-		// chainParams = &chaincfg.RegressionNetParams
 	default:
 		log.Fatal("invalid chain")
 		return
 	}
 
 	// genesis transaction input
-	spl := strings.Split(params.input, ":")
+	spl := strings.Split(params.Input, ":")
 	inputTxid, _ := chainhash.NewHashFromStr(spl[0])
 	outputNum, _ := strconv.Atoi(spl[1])
 
 	// get input amount
-	inputTx, err := common.OpenBitcoinRPC(config.BitcoinRPC).
-		GetRawTransactionVerbose(inputTxid)
+	inputTxOut, err := bitcoin.GetTxOut(inputTxid, uint32(outputNum), true)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
-	inputAmount := int64(math.Round(inputTx.Vout[outputNum].Value * 100000000))
+	if inputTxOut == nil {
+		log.Fatal("input " + params.Input + " doesn't exist or was already spent")
+		return
+	}
+	inputAmount := int64(math.Round(inputTxOut.Value * 100000000))
+	inputPkScript, _ := hex.DecodeString(inputTxOut.ScriptPubKey.Hex)
 
 	// change address
-	changeAddress, _ := btcutil.DecodeAddress(params.change, chainParams)
+	changeAddress, err := btcutil.DecodeAddress(params.Change, chainParams)
+	if err != nil {
+		log.Fatal("invalid change address: " + err.Error())
+		return
+	}
 	changePkScript, _ := txscript.PayToAddrScript(changeAddress)
 
-	// bmm address and pkscript
-	bmmPubKeyHash := btcutil.Hash160(pk.SerializeCompressed())
-	bmmAddr, _ := btcutil.NewAddressWitnessPubKeyHash(bmmPubKeyHash, chainParams)
-	bmmPkScript, _ := txscript.PayToAddrScript(bmmAddr)
-
-	// the output that will be used by the miner to hook his transaction into
-	opTrueScript, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_TRUE).Script()
+	// the bmm key is derived publicly from the input and the parameters so
+	// anyone can check the chain later with bmm_verify
+	bmmParams := common.BMMParams{
+		Network:       chainParams.Name,
+		Format:        params.Format,
+		BlockInterval: params.BlockInterval,
+	}
+	_, pk := common.BMMKey(*wire.NewOutPoint(inputTxid, uint32(outputNum)),
+		bmmParams, int(params.NumTransactions))
+	bmmPkScript := common.BMMScript(pk, params.Format)
 
 	// the total amount we will deposit to create the chain of transactions
-	fundingAmount := MIN_OUTPUT_VALUE*params.numtransactions + MIN_OUTPUT_VALUE
+	fundingAmount := common.BMMFundingAmount(int(params.NumTransactions), params.Format)
+
+	// check amounts before doing anything
+	changeAmount := inputAmount - fundingAmount - params.GenesisFee
+	if changeAmount < 0 {
+		log.Fatalf("input has %d sat, but we need %d for the chain and %d for fees",
+			inputAmount, fundingAmount, params.GenesisFee)
+		return
+	}
+	if dust := common.DustLimit(changePkScript); changeAmount > 0 && changeAmount < dust {
+		log.Fatalf("change would be %d sat, below the dust limit of %d, "+
+			"raise -genesisfee to %d to drop it", changeAmount,
+			dust, params.GenesisFee+changeAmount)
+		return
+	}
 
 	// create genesis tx
 	genesisTx := wire.NewMsgTx(wire.TxVersion)
@@ -134,27 +181,40 @@ func main() {
 	)
 
 	// add change output
-	genesisTx.AddTxOut(
-		wire.NewTxOut(inputAmount-fundingAmount-params.genesisfee,
-			changePkScript),
-	)
+	if changeAmount > 0 {
+		genesisTx.AddTxOut(
+			wire.NewTxOut(changeAmount, changePkScript),
+		)
+	}
 
 	fmt.Printf("spending a total of %d sat to generate this BMM chain.\n",
-		fundingAmount+params.genesisfee)
-
-	// print unsigned funding tx
-	var serializedGenesis bytes.Buffer
-	genesisTx.Serialize(&serializedGenesis)
+		fundingAmount+params.GenesisFee)
 
+	// sign the funding tx
 	psbtPacket, _ := psbt.NewFromUnsignedTx(genesisTx)
+	psbtPacket.Inputs[0].WitnessUtxo = wire.NewTxOut(inputAmount, inputPkScript)
 	psbtBase64, _ := psbtPacket.B64Encode()
-	fmt.Printf("funding transaction to sign (PSBT): %s\n", psbtBase64)
 
-	// get signature for funding tx
-	line := bufio.NewReader(os.Stdin)
-	fmt.Print("paste finalized PSBT: ")
-	finalized, _ := line.ReadString('\n')
-	p, err := psbt.NewFromRawBytes(strings.NewReader(finalized), true)
+	var finalized string
+	switch params.Sign {
+	case "wallet":
+		var complete bool
+		finalized, complete, err = common.WalletProcessPSBT(bitcoin, psbtBase64)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		if !complete {
+			log.Fatal("bitcoind wallet couldn't sign the funding input")
+			return
+		}
+	case "paste":
+		fmt.Printf("funding transaction to sign (PSBT): %s\n", psbtBase64)
+		fmt.Print("paste finalized PSBT: ")
+		finalized, _ = line.ReadString('\n')
+	}
+
+	p, err := psbt.NewFromRawBytes(strings.NewReader(strings.TrimSpace(finalized)), true)
 	if err != nil {
 		log.Fatal("error parsing psbt: " + err.Error())
 		return
@@ -166,58 +226,130 @@ func main() {
 	}
 
 	// generate a string of x transactions
-	prev := genesisTx
-	var i int64
-	for i = 0; i < params.numtransactions; i++ {
-		tx := wire.NewMsgTx(2)
-
-		prevTxId := prev.TxHash()
-		tx.AddTxIn(
-			&wire.TxIn{
-				PreviousOutPoint: wire.OutPoint{prevTxId, uint32(0)},
-				SignatureScript:  nil,
-				Witness:          nil,
-				Sequence:         uint32(params.blockinterval),
-			},
-		)
-		tx.AddTxOut(
-			wire.NewTxOut(fundingAmount-MIN_OUTPUT_VALUE*i, bmmPkScript),
-		)
-		tx.AddTxOut(
-			wire.NewTxOut(MIN_OUTPUT_VALUE, opTrueScript),
-		)
+	chain, err := common.DeriveBMMChain(genesisTx, bmmParams, int(params.NumTransactions))
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	for i, tx := range chain.Links {
+		fmt.Printf("BMM %d: %s \n", i+1, common.EncodeTx(tx))
+	}
 
-		// sign
-		sigScript, err := txscript.SignatureScript(tx, 0, bmmPkScript,
-			txscript.SigHashAll,
-			sk, true)
+	// save everything so it isn't lost with the terminal scrollback
+	chainFile := filepath.Join(config.DataDir, common.BMMCHAIN_FILE)
+	if err := common.SaveBMMChain(chainFile, chain); err != nil {
+		log.Fatal("failed to save bmm chain: " + err.Error())
+		return
+	}
+	fmt.Printf("\nsaved bmm chain to %s\n", chainFile)
+
+	// print serialized genesis
+	fmt.Printf("\ngenesis: %s \n", common.EncodeTx(genesisTx))
+
+	shouldPublish := params.Publish
+	if shouldPublish == "ask" {
+		fmt.Printf("publish? [yes/no]: ")
+		shouldPublish, _ = line.ReadString('\n')
+		shouldPublish = strings.TrimSpace(shouldPublish)
+	}
+	if shouldPublish == "yes" {
+		txid, err := bitcoin.SendRawTransaction(genesisTx, false)
 		if err != nil {
 			log.Fatal(err)
 			return
 		}
-		tx.TxIn[0].SignatureScript = sigScript
+		fmt.Printf("published genesis %s\n", txid)
+	}
+}
 
-		// serialize and print
-		var serializedTx bytes.Buffer
-		tx.Serialize(&serializedTx)
+func readSpec(path string, params *Spec) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
 
-		fmt.Printf("BMM %d: %x \n", i+1, serializedTx.Bytes())
+	// flags given explicitly win over the spec
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	fromFlags := *params
 
-		prev = tx
+	if err := json.Unmarshal(data, params); err != nil {
+		return fmt.Errorf("failed to parse spec: %w", err)
 	}
 
-	// print serialized genesis
-	var serializedTx bytes.Buffer
-	genesisTx.Serialize(&serializedTx)
-	fmt.Printf("\ngenesis: %x \n", serializedTx.Bytes())
-	fmt.Printf("publish? [yes/no]: ")
-	shouldPublish, _ := line.ReadString('\n')
-	if shouldPublish == "yes" {
-		_, err := common.OpenBitcoinRPC(config.BitcoinRPC).
-			SendRawTransaction(genesisTx, false)
-		if err != nil {
-			log.Fatal(err)
-			return
-		}
+	if given["input"] {
+		params.Input = fromFlags.Input
+	}
+	if given["numtransactions"] {
+		params.NumTransactions = fromFlags.NumTransactions
+	}
+	if given["blockinterval"] {
+		params.BlockInterval = fromFlags.BlockInterval
+	}
+	if given["genesisfee"] {
+		params.GenesisFee = fromFlags.GenesisFee
+	}
+	if given["change"] {
+		params.Change = fromFlags.Change
+	}
+	if given["format"] {
+		params.Format = fromFlags.Format
 	}
+	if given["sign"] {
+		params.Sign = fromFlags.Sign
+	}
+	if given["publish"] {
+		params.Publish = fromFlags.Publish
+	}
+
+	return nil
+}
+
+func (params Spec) validate() error {
+	spl := strings.Split(params.Input, ":")
+	if len(spl) != 2 {
+		return errors.New("input must be in the format <txid>:<outputnum>")
+	}
+	if _, err := chainhash.NewHashFromStr(spl[0]); err != nil || len(spl[0]) != 64 {
+		return errors.New("input txid is invalid")
+	}
+	if n, err := strconv.Atoi(spl[1]); err != nil || n < 0 {
+		return errors.New("input output number is invalid")
+	}
+
+	if params.NumTransactions < 1 {
+		return errors.New("numtransactions must be at least 1")
+	}
+	// so the funding amount can't overflow
+	if params.NumTransactions > 1000000 {
+		return errors.New("numtransactions is too large")
+	}
+	// relative locktimes in blocks only have 16 bits
+	if params.BlockInterval < 1 || params.BlockInterval > 0xffff {
+		return errors.New("blockinterval must be between 1 and 65535")
+	}
+	if params.GenesisFee < 0 {
+		return errors.New("genesisfee can't be negative")
+	}
+	if params.Change == "" {
+		return errors.New("change address is required")
+	}
+
+	switch params.Format {
+	case common.BMM_FORMAT_P2WPKH, common.BMM_FORMAT_P2TR:
+	default:
+		return errors.New("format must be 'p2wpkh' or 'p2tr'")
+	}
+	switch params.Sign {
+	case "paste", "wallet":
+	default:
+		return errors.New("sign must be 'paste' or 'wallet'")
+	}
+	switch params.Publish {
+	case "ask", "yes", "no":
+	default:
+		return errors.New("publish must be 'ask', 'yes' or 'no'")
+	}
+
+	return nil
 }
@@ -2,27 +2,20 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/hex"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"math"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
 
-	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
-	"github.com/btcsuite/btcutil"
 	"github.com/btcsuite/btcutil/psbt"
 	"github.com/fiatjaf/namechain/common"
 	"github.com/mitchellh/go-homedir"
 )
 
-const MIN_OUTPUT_VALUE int64 = 294
-
 var config *common.Config
 
 func main() {
@@ -30,13 +23,19 @@ func main() {
 	config = &common.Config{}
 
 	var params struct {
+		chain           string
 		bmmindex        int
 		spacechainblock string
+		sign            string
+		dryrun          bool
 	}
 
 	flag.StringVar(&config.DataDir, "datadir", "~/.namechain", "the base directory we will use to read your config file from and store data into.")
-	flag.IntVar(&params.bmmindex, "bmmindex", 0, "index of the next bmm transaction string")
+	flag.StringVar(&params.chain, "chain", "", "file with the bmm chain saved by bmm_generate, defaults to the one in datadir")
+	flag.IntVar(&params.bmmindex, "bmmindex", 0, "index of the next bmm transaction string, 0 to find it automatically")
 	flag.StringVar(&params.spacechainblock, "spacechainblock", "", "block id of the spacechain block we're trying to mine")
+	flag.StringVar(&params.sign, "sign", "wallet", "how to sign the bmm child: 'wallet' (bitcoind) or 'psbt' (paste it back signed)")
+	flag.BoolVar(&params.dryrun, "dryrun", false, "print the transactions instead of broadcasting them")
 	flag.Parse()
 
 	// find datadir
@@ -45,143 +44,108 @@ func main() {
 	// read config file
 	config.ReadConfig()
 
-	blockId, err := hex.DecodeString(params.spacechainblock)
-	if err != nil {
-		log.Fatal(err)
+	var blockId [20]byte
+	if b, err := hex.DecodeString(params.spacechainblock); err != nil || len(b) != 20 {
+		log.Fatal("-spacechainblock must be a 20-byte hex block id")
+	} else {
+		copy(blockId[:], b)
 	}
-	bmmIndex, err := strconv.Atoi(params.bmmindex)
-	if err != nil {
-		log.Fatal(err)
+	if params.sign != "wallet" && params.sign != "psbt" {
+		log.Fatal("-sign must be 'wallet' or 'psbt'")
 	}
 
-	pregeneratedTxs, err := ioutil.ReadAll("pregenerated")
-
-	// get input amount
-	inputTx, err := common.OpenBitcoinRPC(config.BitcoinRPC).
-		GetRawTransactionVerbose(inputTxid)
+	// load pregenerated bmm transactions
+	if params.chain == "" {
+		params.chain = filepath.Join(config.DataDir, common.BMMCHAIN_FILE)
+	}
+	chain, err := common.LoadBMMChain(params.chain)
 	if err != nil {
-		log.Fatal(err)
-		return
+		log.Fatal("failed to read bmm chain: " + err.Error())
 	}
-	inputAmount := int64(math.Round(inputTx.Vout[outputNum].Value * 100000000))
-
-	// change address
-	changeAddress, _ := btcutil.DecodeAddress(params.change, chainParams)
-	changePkScript, _ := txscript.PayToAddrScript(changeAddress)
-
-	// bmm address and pkscript
-	bmmPubKeyHash := btcutil.Hash160(pk.SerializeCompressed())
-	bmmAddr, _ := btcutil.NewAddressWitnessPubKeyHash(bmmPubKeyHash, chainParams)
-	bmmPkScript, _ := txscript.PayToAddrScript(bmmAddr)
-
-	// the output that will be used by the miner to hook his transaction into
-	opTrueScript, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_TRUE).Script()
 
-	// the total amount we will deposit to create the chain of transactions
-	fundingAmount := MIN_OUTPUT_VALUE*params.numtransactions + MIN_OUTPUT_VALUE
+	bitcoin := common.OpenBitcoinRPC(config.BitcoinRPC)
 
-	// create genesis tx
-	genesisTx := wire.NewMsgTx(wire.TxVersion)
-
-	// add input
-	genesisTx.AddTxIn(
-		wire.NewTxIn(
-			wire.NewOutPoint(inputTxid, uint32(outputNum)),
-			nil,
-			nil,
-		),
-	)
-
-	// add bmm output
-	genesisTx.AddTxOut(
-		wire.NewTxOut(fundingAmount, bmmPkScript),
-	)
-
-	// add change output
-	genesisTx.AddTxOut(
-		wire.NewTxOut(inputAmount-fundingAmount-params.genesisfee,
-			changePkScript),
-	)
-
-	fmt.Printf("spending a total of %d sat to generate this BMM chain.\n",
-		fundingAmount+params.genesisfee)
-
-	// print unsigned funding tx
-	var serializedGenesis bytes.Buffer
-	genesisTx.Serialize(&serializedGenesis)
-
-	psbtPacket, _ := psbt.NewFromUnsignedTx(genesisTx)
-	psbtBase64, _ := psbtPacket.B64Encode()
-	fmt.Printf("funding transaction to sign (PSBT): %s\n", psbtBase64)
+	// find which link we must use
+	n := params.bmmindex
+	if n == 0 {
+		n, err = common.FindNextBMMLink(bitcoin, chain)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if n < 0 || n > len(chain.Links) {
+		log.Fatalf("-bmmindex must be between 1 and %d", len(chain.Links))
+	}
+	link := chain.Links[n-1]
+	fmt.Printf("using BMM %d: %s\n", n, link.TxHash())
 
-	// get signature for funding tx
-	line := bufio.NewReader(os.Stdin)
-	fmt.Print("paste finalized PSBT: ")
-	finalized, _ := line.ReadString('\n')
-	p, err := psbt.NewFromRawBytes(strings.NewReader(finalized), true)
+	// build the child that pays for it
+	child, prevouts, fee, err := common.BuildBMMChild(bitcoin, chain, n, blockId)
 	if err != nil {
-		log.Fatal("error parsing psbt: " + err.Error())
-		return
+		log.Fatal(err)
+	}
+	fmt.Printf("paying %d sat in fees for the package.\n", fee)
+
+	switch params.sign {
+	case "wallet":
+		child, err = common.SignBMMChildWithWallet(bitcoin, child, prevouts)
+	case "psbt":
+		child, err = signWithPSBT(child, prevouts)
 	}
-	genesisTx, err = psbt.Extract(p)
 	if err != nil {
 		log.Fatal(err)
-		return
 	}
 
-	// generate a string of x transactions
-	prev := genesisTx
-	var i int64
-	for i = 0; i < params.numtransactions; i++ {
-		tx := wire.NewMsgTx(2)
-
-		prevTxId := prev.TxHash()
-		tx.AddTxIn(
-			&wire.TxIn{
-				PreviousOutPoint: wire.OutPoint{prevTxId, uint32(0)},
-				SignatureScript:  nil,
-				Witness:          nil,
-				Sequence:         uint32(params.blockinterval),
-			},
-		)
-		tx.AddTxOut(
-			wire.NewTxOut(fundingAmount-MIN_OUTPUT_VALUE*i, bmmPkScript),
-		)
-		tx.AddTxOut(
-			wire.NewTxOut(MIN_OUTPUT_VALUE, opTrueScript),
-		)
-
-		// sign
-		sigScript, err := txscript.SignatureScript(tx, 0, bmmPkScript,
-			txscript.SigHashAll,
-			sk, true)
-		if err != nil {
-			log.Fatal(err)
-			return
-		}
-		tx.TxIn[0].SignatureScript = sigScript
+	if params.dryrun {
+		fmt.Printf("BMM %d: %s\n", n, common.EncodeTx(link))
+		fmt.Printf("child: %s\n", common.EncodeTx(child))
+		return
+	}
 
-		// serialize and print
-		var serializedTx bytes.Buffer
-		tx.Serialize(&serializedTx)
+	res, err := common.SubmitBMMPackage(bitcoin, link, child)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("submitted package: %s\n", res)
+}
 
-		fmt.Printf("BMM %d: %x \n", i+1, serializedTx.Bytes())
+func signWithPSBT(child *wire.MsgTx, prevouts []common.PrevOut) (*wire.MsgTx, error) {
+	packet, err := psbt.NewFromUnsignedTx(child)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range prevouts {
+		packet.Inputs[i].WitnessUtxo = wire.NewTxOut(p.Value, p.PkScript)
+	}
+	psbtBase64, _ := packet.B64Encode()
+	fmt.Printf("bmm child to sign (PSBT): %s\n", psbtBase64)
 
-		prev = tx
+	line := bufio.NewReader(os.Stdin)
+	fmt.Print("paste signed PSBT: ")
+	signed, _ := line.ReadString('\n')
+	p, err := psbt.NewFromRawBytes(strings.NewReader(strings.TrimSpace(signed)), true)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing psbt: %w", err)
+	}
+	if p.UnsignedTx.TxHash() != child.TxHash() {
+		return nil, fmt.Errorf("psbt is for a different transaction")
 	}
 
-	// print serialized genesis
-	var serializedTx bytes.Buffer
-	genesisTx.Serialize(&serializedTx)
-	fmt.Printf("\ngenesis: %x \n", serializedTx.Bytes())
-	fmt.Printf("publish? [yes/no]: ")
-	shouldPublish, _ := line.ReadString('\n')
-	if shouldPublish == "yes" {
-		_, err := common.OpenBitcoinRPC(config.BitcoinRPC).
-			SendRawTransaction(genesisTx, false)
-		if err != nil {
-			log.Fatal(err)
-			return
+	// the anchor input doesn't need anything, so we don't require the psbt to
+	// be finalized there, we just take whatever the signer produced for the other.
+	tx := p.UnsignedTx.Copy()
+	for i, in := range p.Inputs {
+		tx.TxIn[i].SignatureScript = in.FinalScriptSig
+		if len(in.FinalScriptWitness) > 0 {
+			witness, err := common.ParseWitness(in.FinalScriptWitness)
+			if err != nil {
+				return nil, err
+			}
+			tx.TxIn[i].Witness = witness
 		}
 	}
+	if len(tx.TxIn[1].Witness) == 0 && len(tx.TxIn[1].SignatureScript) == 0 {
+		return nil, fmt.Errorf("psbt is not finalized")
+	}
+
+	return tx, nil
 }
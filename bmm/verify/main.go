@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/fiatjaf/namechain/common"
+	"github.com/mitchellh/go-homedir"
+)
+
+var config *common.Config
+
+func main() {
+	var err error
+	config = &common.Config{}
+
+	var params struct {
+		chain           string
+		genesis         string
+		numtransactions int
+		blockinterval   int
+		format          string
+	}
+
+	flag.StringVar(&config.DataDir, "datadir", "~/.namechain", "the base directory we will use to read your config file from and store data into.")
+	flag.StringVar(&params.chain, "chain", "", "file with the bmm chain saved by bmm_generate, defaults to the one in datadir")
+	flag.StringVar(&params.genesis, "genesis", "", "txid of the genesis transaction, to verify without a chain file")
+	flag.IntVar(&params.numtransactions, "numtransactions", 0, "number of bmm transactions, used with -genesis")
+	flag.IntVar(&params.blockinterval, "blockinterval", 1, "relative locktime between bmm transactions, used with -genesis")
+	flag.StringVar(&params.format, "format", common.BMM_FORMAT_P2WPKH, "'p2wpkh' or 'p2tr', used with -genesis")
+	flag.Parse()
+
+	// find datadir
+	config.DataDir, _ = homedir.Expand(config.DataDir)
+
+	// read config file
+	config.ReadConfig()
+
+	bitcoin := common.OpenBitcoinRPC(config.BitcoinRPC)
+
+	// what we'll check: either the chain file named uses or a genesis from bitcoind
+	var chain *common.BMMChain
+	if params.genesis != "" {
+		txid, err := chainhash.NewHashFromStr(params.genesis)
+		if err != nil {
+			log.Fatal("invalid -genesis: " + err.Error())
+		}
+		genesis, err := bitcoin.GetRawTransaction(txid)
+		if err != nil {
+			log.Fatal("failed to get genesis: " + err.Error())
+		}
+		chain, err = common.DeriveBMMChain(genesis.MsgTx(), common.BMMParams{
+			Format:        params.format,
+			BlockInterval: params.blockinterval,
+		}, params.numtransactions)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if params.chain == "" {
+			params.chain = filepath.Join(config.DataDir, common.BMMCHAIN_FILE)
+		}
+		chain, err = common.LoadBMMChain(params.chain)
+		if err != nil {
+			log.Fatal("failed to read bmm chain: " + err.Error())
+		}
+		if err := common.VerifyBMMChain(chain); err != nil {
+			fmt.Printf("%s is NOT the canonical chain: %s\n", params.chain, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s matches the chain derived from its genesis.\n", params.chain)
+	}
+
+	fmt.Printf("genesis: %s\n", chain.Genesis.TxHash())
+	fmt.Printf("pubkey: %s\n", chain.Params.PubKey)
+	fmt.Printf("format: %s\n", chain.Params.Format)
+
+	// now check that what was spent on bitcoin follows the canonical order
+	for n := 1; n <= len(chain.Links); n++ {
+		parent := chain.Parent(n).TxHash()
+		out, err := bitcoin.GetTxOut(&parent, 0, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if out != nil {
+			fmt.Printf("BMM %d is the next one, %d left.\n", n, len(chain.Links)-n+1)
+			return
+		}
+
+		// the parent was spent, it must have been by the canonical link
+		txid := chain.Links[n-1].TxHash()
+		tx, err := bitcoin.GetRawTransactionVerbose(&txid)
+		if err != nil || tx.Confirmations == 0 {
+			fmt.Printf("BMM %d: %s was spent by something else! "+
+				"(or bitcoind is running without -txindex)\n", n, parent)
+			os.Exit(1)
+		}
+		fmt.Printf("BMM %d: %s ok\n", n, txid)
+	}
+
+	fmt.Println("all bmm transactions were used.")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fiatjaf/namechain/keystore"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// the passphrase can be given in this environment variable instead of typed.
+const PASSPHRASE_ENV = "NAMECLI_PASSPHRASE"
+
+// openKeystore loads the keystore from the datadir, it's ErrNotInitialized if
+// there isn't one.
+func openKeystore() (*keystore.Keystore, error) {
+	return keystore.Open(filepath.Join(config.DataDir, keystore.FILENAME))
+}
+
+// createKeystore is openKeystore but creates it if needed, only for when we're
+// going to add keys to it. one it just created is returned already unlocked.
+func createKeystore() (*keystore.Keystore, error) {
+	path := filepath.Join(config.DataDir, keystore.FILENAME)
+	ks, err := keystore.Open(path)
+	if err != keystore.ErrNotInitialized {
+		return ks, err
+	}
+
+	fmt.Fprintln(os.Stderr, "creating a new keystore at "+path)
+	passphrase, err := readPassphrase("choose a passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if os.Getenv(PASSPHRASE_ENV) == "" {
+		confirmation, err := readPassphrase("repeat the passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if confirmation != passphrase {
+			return nil, errors.New("passphrases don't match")
+		}
+	}
+
+	ks, err = keystore.Create(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return ks, ks.Unlock(passphrase, 0)
+}
+
+// unlockedKeystore is for when we're going to create keys or sign, only the
+// former creates the keystore.
+func unlockedKeystore(create bool) (*keystore.Keystore, error) {
+	open := openKeystore
+	if create {
+		open = createKeystore
+	}
+	ks, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if !ks.IsLocked() {
+		return ks, nil
+	}
+
+	passphrase, err := readPassphrase("keystore passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	return ks, ks.Unlock(passphrase, 0)
+}
+
+func readPassphrase(prompt string) (string, error) {
+	if passphrase := os.Getenv(PASSPHRASE_ENV); passphrase != "" {
+		return passphrase, nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(passphrase), err
+}
+
+func decodeKey(hexKey string) (key [32]byte, err error) {
+	b, err := hex.DecodeString(hexKey)
+	if err != nil || len(b) != 32 {
+		return key, errors.New("key must be 32 bytes in hex")
+	}
+	copy(key[:], b)
+	return key, nil
+}
@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
+	"strings"
 
 	"github.com/docopt/docopt-go"
 	"github.com/fiatjaf/namechain/common"
@@ -18,55 +15,137 @@ import (
 var log = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stderr})
 var config common.Config
 
+var rpcConnect string
+var format string
+
 const USAGE = `namecli
 
 Usage:
-  namecli <method> <params>...
+  namecli [options] keys new [<label>]
+  namecli [options] keys list
+  namecli [options] keys import <secret> [<label>]
+  namecli [options] keys sign <tx>
+  namecli [options] acquire <name>
+  namecli [options] transfer <name> <pubkey> [--offline]
+  namecli [options] renew <name> [--offline]
+  namecli [options] publish <name> <infohash_or_file> [--offline]
+  namecli [options] sign <envelope>
+  namecli [options] submit <envelope>
+  namecli [options] help [<method>]
+  namecli [options] <method> [<params>...]
+
+Options (must come before the method):
+  -datadir <dir>          where to read the config file and the rpc cookie from.
+  -rpcconnect <address>   the named rpc server, overrides 'rpc-addr' from the config.
+  -format <json|table>    how to print the results [default: json].
+
+Params can be given positionally or as key=value, but not both. Values are
+parsed as JSON numbers, booleans, arrays or objects when possible, wrap them
+in double quotes to force them to be strings. Names, hashes, keys and other
+params that can only be strings are never parsed.
+
+The wallet commands (keys, acquire, transfer, renew, publish) keep owner keys
+in an encrypted keystore in the datadir, build and sign the transactions locally
+and submit them to named. The keystore passphrase is asked for when needed or
+read from the NAMECLI_PASSPHRASE environment variable.
+
+With --offline, transfer, renew and publish print an unsigned envelope instead
+of sending the transaction. Take it to the machine that has the keystore, run
+'namecli sign' there and bring the result back to 'namecli submit'.
+
+Run 'namecli help' to see all methods named supports.
 `
 
 func main() {
 	// find datadir
 	flag.StringVar(&config.DataDir, "datadir", "~/.namechain", "the base directory we will use to read your config file from and store data into.")
+	flag.StringVar(&rpcConnect, "rpcconnect", "", "the address of the named rpc server.")
+	flag.StringVar(&format, "format", "json", "output format, 'json' or 'table'.")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, USAGE) }
 	flag.Parse()
 	config.DataDir, _ = homedir.Expand(config.DataDir)
 
 	// read config file
 	config.ReadConfig()
+	if rpcConnect != "" {
+		config.RPCAddr = rpcConnect
+	}
+	if format != "json" && format != "table" {
+		log.Fatal().Str("format", format).Msg("unknown output format")
+	}
 
 	// parse args
-	opts, err := docopt.ParseDoc(USAGE)
+	opts, err := docopt.ParseArgs(USAGE, flag.Args(), "")
 	if err != nil {
+		os.Exit(1)
+	}
+
+	if handled, result, err := runWallet(opts); handled {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		if result != nil {
+			printResult(result)
+		}
 		return
 	}
 
-	// run the RPC call
-	method := opts["<method>"].(string)
-	params := opts["<params>"].([]string)
-
-	jreq, _ := json.Marshal(common.RPCRequest{
-		Method: method,
-		Params: params,
-	})
-	r, err := http.Post(config.RPCAddr, "application/json", bytes.NewReader(jreq))
-	if err != nil {
-		log.Fatal().Err(err).Msg("couldn't reach the rpc server. is named running?")
+	var method string
+	var params interface{}
+	if help, _ := opts.Bool("help"); help {
+		method = "help"
+		if m, ok := opts["<method>"].(string); ok {
+			params = []interface{}{m}
+		}
+	} else {
+		method, _ = opts.String("<method>")
+		params, err = parseParams(method, opts["<params>"].([]string))
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid params")
+		}
 	}
 
-	defer r.Body.Close()
-	body, _ := ioutil.ReadAll(r.Body)
-	var resp common.RPCResponse
-	err = json.Unmarshal(body, &resp)
+	// run the RPC call
+	result, err := call(method, params)
 	if err != nil {
-		log.Fatal().Err(err).Str("body", string(body)).
-			Msg("got an invalid response from rpc server")
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
 	}
 
-	var printable []byte
-	if resp.Error.Code != 0 {
-		printable, _ = json.Marshal(resp.Error)
+	if method == "help" && format == "json" {
+		printHelp(result)
 	} else {
-		printable, _ = json.Marshal(resp.Result)
+		printResult(result)
+	}
+}
+
+// parseParams returns either a map (if params were given as key=value) or a list.
+func parseParams(method string, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, nil
 	}
 
-	fmt.Println(string(printable))
+	if strings.Contains(args[0], "=") {
+		named := make(map[string]interface{}, len(args))
+		for _, arg := range args {
+			spl := strings.SplitN(arg, "=", 2)
+			if len(spl) != 2 {
+				return nil, fmt.Errorf("'%s' is not key=value, can't mix positional and named params", arg)
+			}
+			named[spl[0]] = inferParam(spl[0], spl[1])
+		}
+		return named, nil
+	}
+
+	names := methodParams(method)
+	positional := make([]interface{}, len(args))
+	for i, arg := range args {
+		if i < len(names) {
+			positional[i] = inferParam(names[i], arg)
+		} else {
+			positional[i] = inferType(arg)
+		}
+	}
+	return positional, nil
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+func printResult(result interface{}) {
+	if format == "table" {
+		// normalize structs into maps and slices
+		var normalized interface{}
+		j, _ := json.Marshal(result)
+		json.Unmarshal(j, &normalized)
+		printTable(normalized)
+		return
+	}
+
+	printable, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(printable))
+}
+
+// printHelp formats the result of the 'help' method as text.
+func printHelp(result interface{}) {
+	methods, ok := result.([]interface{})
+	if !ok {
+		methods = []interface{}{result}
+	}
+
+	for _, im := range methods {
+		m, _ := im.(map[string]interface{})
+		var params []string
+		if ps, ok := m["params"].([]interface{}); ok {
+			for _, p := range ps {
+				params = append(params, fmt.Sprintf("[%v]", p))
+			}
+		}
+		usage := strings.TrimSpace(fmt.Sprintf("%v %s", m["method"], strings.Join(params, " ")))
+		if admin, _ := m["admin"].(bool); admin {
+			usage += "  (admin)"
+		}
+		fmt.Println(usage)
+		fmt.Printf("    %v\n", m["description"])
+	}
+}
+
+func printTable(result interface{}) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	switch v := result.(type) {
+	case map[string]interface{}:
+		keys := sortedKeys(v)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s\t%s\n", k, cell(v[k]))
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			return
+		}
+		first, ok := v[0].(map[string]interface{})
+		if !ok {
+			for _, item := range v {
+				fmt.Fprintln(w, cell(item))
+			}
+			return
+		}
+
+		keys := sortedKeys(first)
+		fmt.Fprintln(w, strings.ToUpper(strings.Join(keys, "\t")))
+		for _, item := range v {
+			row, _ := item.(map[string]interface{})
+			cells := make([]string, len(keys))
+			for i, k := range keys {
+				cells[i] = cell(row[k])
+			}
+			fmt.Fprintln(w, strings.Join(cells, "\t"))
+		}
+	default:
+		fmt.Fprintln(w, cell(v))
+	}
+}
+
+func cell(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	case map[string]interface{}, []interface{}:
+		j, _ := json.Marshal(v)
+		return string(j)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
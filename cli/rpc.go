@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/namechain/common"
+)
+
+func rpcURL() string {
+	url := config.RPCAddr
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = "http://" + url
+	}
+	if !strings.HasSuffix(url, "/rpc") {
+		url = strings.TrimSuffix(url, "/") + "/rpc"
+	}
+	return url
+}
+
+func call(method string, params interface{}) (interface{}, error) {
+	jreq, _ := json.Marshal(common.RPCRequest{
+		ID:     1,
+		Method: method,
+		Params: params,
+	})
+	req, _ := http.NewRequest("POST", rpcURL(), bytes.NewReader(jreq))
+	req.Header.Set("Content-Type", "application/json")
+	if config.RPCUser != "" {
+		req.SetBasicAuth(config.RPCUser, config.RPCPassword)
+	} else if user, password, err := common.ReadCookie(config.DataDir); err == nil {
+		req.SetBasicAuth(user, password)
+	} else {
+		log.Warn().Err(err).Msg("couldn't read the rpc cookie file")
+	}
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't reach the rpc server. is named running?")
+	}
+
+	defer r.Body.Close()
+	if r.StatusCode == http.StatusUnauthorized {
+		log.Fatal().Msg("rpc server rejected our credentials")
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var resp common.RPCResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		log.Fatal().Err(err).Str("body", string(body)).
+			Msg("got an invalid response from rpc server")
+	}
+
+	if resp.Error.Code != 0 {
+		return nil, fmt.Errorf("error %d: %s", resp.Error.Code, resp.Error.Message)
+	}
+	if resp.Error.Message != "" {
+		return nil, errors.New(resp.Error.Message)
+	}
+
+	return resp.Result, nil
+}
+
+// params that are always strings, so a name like 1234 or a hash that happens to
+// be all digits isn't sent as a number.
+var stringParams = map[string]bool{
+	"method":     true,
+	"name":       true,
+	"namehash":   true,
+	"tx":         true,
+	"txhash":     true,
+	"block":      true,
+	"pubkey":     true,
+	"passphrase": true,
+}
+
+// methodParams asks named for the names of the params of method, in order, so
+// positional values can be matched with them. it's nil if named doesn't know it.
+func methodParams(method string) []string {
+	result, err := call("help", map[string]interface{}{"method": method})
+	if err != nil {
+		return nil
+	}
+	help, _ := result.(map[string]interface{})
+	params, _ := help["params"].([]interface{})
+
+	names := make([]string, len(params))
+	for i, param := range params {
+		names[i], _ = param.(string)
+	}
+	return names
+}
+
+// inferParam is inferType except for the params that are always strings.
+func inferParam(name string, value string) interface{} {
+	if !stringParams[name] {
+		return inferType(value)
+	}
+	if strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) && len(value) >= 2 {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// inferType turns command line values into JSON values.
+func inferType(value string) interface{} {
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+
+	if strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) && len(value) >= 2 {
+		return value[1 : len(value)-1]
+	}
+
+	// numbers with leading zeroes are probably hex
+	if value == "0" || !strings.HasPrefix(value, "0") {
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i
+		}
+		if f, err := strconv.ParseFloat(value, 64); err == nil && strings.Contains(value, ".") {
+			return f
+		}
+	}
+
+	if strings.HasPrefix(value, "[") || strings.HasPrefix(value, "{") {
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err == nil {
+			return v
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInferParam(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		value string
+		want  interface{}
+	}{
+		{"name", "1234", "1234"},
+		{"name", "true", "true"},
+		{"name", `"quoted"`, "quoted"},
+		{"txhash", "0123", "0123"},
+		{"passphrase", "[secret]", "[secret]"},
+		{"height", "12", int64(12)},
+		{"timeout", "1.5", 1.5},
+		{"blocks", `"6"`, "6"},
+		{"unknown", "null", nil},
+	} {
+		if got := inferParam(c.name, c.value); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s=%s: got %#v, want %#v", c.name, c.value, got, c.want)
+		}
+	}
+}
+
+func TestParseNamedParams(t *testing.T) {
+	params, err := parseParams("getname", []string{"name=42", "height=7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"name": "42", "height": int64(7)}
+	if !reflect.DeepEqual(params, want) {
+		t.Fatalf("got %#v, want %#v", params, want)
+	}
+
+	if _, err := parseParams("getname", []string{"name=42", "7"}); err == nil {
+		t.Fatal("mixed named and positional params were accepted")
+	}
+}
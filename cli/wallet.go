@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/namechain/common"
+)
+
+// runWallet handles the subcommands that build and sign transactions locally,
+// it returns false if the args were for a plain rpc call.
+func runWallet(opts docopt.Opts) (handled bool, result interface{}, err error) {
+	if keys, _ := opts.Bool("keys"); keys {
+		result, err := runKeys(opts)
+		return true, result, err
+	}
+	if handled, result, err := runEnvelope(opts); handled {
+		return true, result, err
+	}
+
+	name, _ := opts.String("<name>")
+	var tx common.Transaction
+
+	switch {
+	case opts["acquire"] == true:
+		ks, err := unlockedKeystore(true)
+		if err != nil {
+			return true, nil, err
+		}
+		defer ks.Lock()
+
+		// every name gets its own key
+		key, err := ks.NewKey(name)
+		if err != nil {
+			return true, nil, err
+		}
+		pk, _ := decodeKey(key.PubKey)
+
+		tx.Type = common.TYPE_ACQUIRE
+		tx.Key = pk
+		tx.NameHash = sha256.Sum256([]byte(name))
+	case opts["transfer"] == true:
+		pubkey, _ := opts.String("<pubkey>")
+		target, err := decodeKey(pubkey)
+		if err != nil {
+			return true, nil, err
+		}
+
+		tx.Type = common.TYPE_TRANSFER
+		tx.NameHash = sha256.Sum256([]byte(name))
+		tx.Key = target
+	case opts["renew"] == true:
+		tx.Type = common.TYPE_RENEW
+		tx.NameHash = sha256.Sum256([]byte(name))
+	case opts["publish"] == true:
+		target, _ := opts.String("<infohash_or_file>")
+		var infohash metainfo.Hash
+		if err := infohash.FromHexString(target); err != nil || len(target) != 40 {
+			infohash, err = common.FileInfoHash(target)
+			if err != nil {
+				return true, nil, fmt.Errorf("'%s' is not an infohash or a file: %w", target, err)
+			}
+		}
+
+		tx.Type = common.TYPE_PUBLISH
+		tx.Name = name
+		tx.PublishHash = infohash
+	default:
+		return false, nil, nil
+	}
+
+	if tx.Type != common.TYPE_ACQUIRE {
+		// signed transactions are only valid for 10 blocks after this one
+		if tx.RecentBlock, err = tipBlock(); err != nil {
+			return true, nil, err
+		}
+
+		owner, err := ownerPubKey(tx, name)
+		if err != nil {
+			return true, nil, err
+		}
+
+		if offline, _ := opts.Bool("--offline"); offline {
+			// to be signed elsewhere with 'namecli sign' and then sent with 'namecli submit'
+			signer, _ := decodeKey(owner)
+			return true, common.NewEnvelope(tx, signer, name).Encode(), nil
+		}
+
+		ks, err := unlockedKeystore(false)
+		if err != nil {
+			return true, nil, err
+		}
+		defer ks.Lock()
+		if err := ks.SignTransaction(&tx, owner); err != nil {
+			return true, nil, err
+		}
+	}
+
+	result, err = call("sendtransaction", []interface{}{hex.EncodeToString(tx.Serialize())})
+	return true, result, err
+}
+
+// tipBlock is the id of the latest block, zero if there are none yet.
+func tipBlock() (id metainfo.Hash, err error) {
+	info, err := call("getinfo", nil)
+	if err != nil {
+		return id, err
+	}
+	tip, ok := info.(map[string]interface{})["tip"].(string)
+	if !ok {
+		// the first block builds on the zero id
+		return id, nil
+	}
+	if err := id.FromHexString(tip); err != nil {
+		return id, fmt.Errorf("named returned an invalid tip '%s'", tip)
+	}
+	return id, nil
+}
+
+// ownerPubKey finds the key that currently owns the name the transaction
+// refers to. name may be empty, in which case only the name hash is used.
+func ownerPubKey(tx common.Transaction, name string) (string, error) {
+	nameHash := sha256.Sum256([]byte(tx.Name))
+	if tx.Type != common.TYPE_PUBLISH {
+		nameHash = tx.NameHash
+	}
+
+	data, err := call("getname", map[string]interface{}{
+		"namehash": hex.EncodeToString(nameHash[:]),
+	})
+	if err == nil {
+		owner, _ := data.(map[string]interface{})["key"].(string)
+		return owner, nil
+	} else if name == "" {
+		return "", err
+	}
+
+	// maybe the acquire isn't mined yet, so try the key labeled with the name
+	ks, err := openKeystore()
+	if err != nil {
+		return "", err
+	}
+	key, err := ks.Find(name)
+	if err != nil {
+		return "", fmt.Errorf("couldn't find the owner of '%s'", name)
+	}
+	return key.PubKey, nil
+}
+
+// runEnvelope handles the offline signing flow.
+func runEnvelope(opts docopt.Opts) (handled bool, result interface{}, err error) {
+	encoded, _ := opts.String("<envelope>")
+
+	switch {
+	case opts["sign"] == true:
+		env, err := common.DecodeEnvelope(encoded)
+		if err != nil {
+			return true, nil, err
+		}
+
+		ks, err := unlockedKeystore(false)
+		if err != nil {
+			return true, nil, err
+		}
+		defer ks.Lock()
+
+		if err := env.Sign(func(tx *common.Transaction) error {
+			return ks.SignTransaction(tx, env.Signer)
+		}); err != nil {
+			return true, nil, err
+		}
+		return true, env.Encode(), nil
+	case opts["submit"] == true:
+		env, err := common.DecodeEnvelope(encoded)
+		if err != nil {
+			return true, nil, err
+		}
+		if !env.Signed {
+			return true, nil, errors.New("envelope is not signed yet")
+		}
+
+		result, err := call("sendtransaction", []interface{}{env.Tx})
+		return true, result, err
+	}
+
+	return false, nil, nil
+}
+
+func runKeys(opts docopt.Opts) (interface{}, error) {
+	label, _ := opts.String("<label>")
+
+	switch {
+	case opts["new"] == true:
+		ks, err := unlockedKeystore(true)
+		if err != nil {
+			return nil, err
+		}
+		defer ks.Lock()
+		return ks.NewKey(label)
+	case opts["import"] == true:
+		secret, _ := opts.String("<secret>")
+		sk, err := decodeKey(secret)
+		if err != nil {
+			return nil, err
+		}
+		ks, err := unlockedKeystore(true)
+		if err != nil {
+			return nil, err
+		}
+		defer ks.Lock()
+		return ks.Import(label, sk)
+	case opts["list"] == true:
+		ks, err := openKeystore()
+		if err != nil {
+			return nil, err
+		}
+		return ks.Keys(), nil
+	case opts["sign"] == true:
+		// sign a transaction built elsewhere without exposing the key to it
+		rawTx, _ := opts.String("<tx>")
+		b, err := hex.DecodeString(rawTx)
+		if err != nil {
+			return nil, errors.New("<tx> is invalid hex")
+		}
+		tx, err := common.ParseTransaction(b)
+		if err != nil {
+			return nil, err
+		}
+		owner, err := ownerPubKey(tx, "")
+		if err != nil {
+			return nil, err
+		}
+		ks, err := unlockedKeystore(false)
+		if err != nil {
+			return nil, err
+		}
+		defer ks.Lock()
+		if err := ks.SignTransaction(&tx, owner); err != nil {
+			return nil, err
+		}
+		return hex.EncodeToString(tx.Serialize()), nil
+	}
+
+	return nil, nil
+}
@@ -1,11 +1,36 @@
 package common
 
 import (
+	"encoding/json"
 	"net/url"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
 	rpcclient "github.com/stevenroose/go-bitcoin-core-rpc"
+	"github.com/stevenroose/go-bitcoin-core-rpc/btcjson"
 )
 
+// BitcoinBackend is everything we ask bitcoind. it's satisfied by the RPC client
+// and by the in-memory chain in the fakebitcoin package.
+type BitcoinBackend interface {
+	GetBlockChainInfo() (*btcjson.GetBlockChainInfoResult, error)
+	GetBlockCount() (int64, error)
+	GetBlockHash(blockHeight int64) (*chainhash.Hash, error)
+	GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error)
+	GetRawTransaction(txHash *chainhash.Hash) (*btcutil.Tx, error)
+	GetRawTransactionVerbose(txHash *chainhash.Hash) (*btcjson.TxRawResult, error)
+	SendRawTransaction(tx *wire.MsgTx, allowHighFees bool) (*chainhash.Hash, error)
+	GetTxOut(txHash *chainhash.Hash, index uint32, mempool bool) (*btcjson.GetTxOutResult, error)
+	EstimateSmartFee(confTarget uint32) (*btcjson.EstimateSmartFeeResult, error)
+	ListUnspent() ([]btcjson.ListUnspentResult, error)
+
+	// for the calls the client doesn't have a method for
+	RawRequest(method string, params []json.RawMessage) (json.RawMessage, error)
+}
+
+var _ BitcoinBackend = (*rpcclient.Client)(nil)
+
 func OpenBitcoinRPC(uri string) *rpcclient.Client {
 	// initiate bitcoind connection
 	btcParams, _ := url.Parse(uri)
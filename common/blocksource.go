@@ -0,0 +1,169 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// BlockSource is where spacechain blocks are published to and fetched from by
+// their ID.
+type BlockSource interface {
+	// Publish makes a block available to others and returns its ID.
+	Publish(serializedBlock []byte) (metainfo.Hash, error)
+	// Fetch waits until the block with the given ID is available.
+	Fetch(id metainfo.Hash, timeout time.Duration) ([]byte, error)
+	Close() error
+}
+
+// TorrentBlockSource publishes blocks as torrents (see BlockTorrent) and keeps
+// seeding everything it has published or fetched while it is open.
+type TorrentBlockSource struct {
+	client  *torrent.Client
+	dataDir string
+
+	// other in-process clients we connect to directly, in loopback mode
+	mu    sync.Mutex
+	peers []*torrent.Client
+}
+
+var _ BlockSource = (*TorrentBlockSource)(nil)
+
+func NewTorrentBlockSource(config *Config) (*TorrentBlockSource, error) {
+	client, err := TorrentClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &TorrentBlockSource{
+		client:  client,
+		dataDir: filepath.Join(config.DataDir, "blocks"),
+	}, nil
+}
+
+// NewLoopbackBlockSource creates a source that doesn't use the DHT or trackers
+// and only listens on localhost, it can only get blocks from the sources it
+// was connected to with ConnectLoopback. it's meant for tests that run many
+// nodes in the same process without internet access.
+func NewLoopbackBlockSource(dataDir string) (*TorrentBlockSource, error) {
+	clientConfig := torrent.NewDefaultClientConfig()
+	clientConfig.Seed = true
+	clientConfig.DataDir = filepath.Join(dataDir, "blocks")
+	clientConfig.NoDHT = true
+	clientConfig.DisableTrackers = true
+	clientConfig.DisableIPv6 = true
+	clientConfig.NoDefaultPortForwarding = true
+	clientConfig.SetListenAddr("127.0.0.1:0")
+
+	client, err := torrent.NewClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &TorrentBlockSource{
+		client:  client,
+		dataDir: clientConfig.DataDir,
+	}, nil
+}
+
+// ConnectLoopback makes each of the given sources a peer of all the others.
+func ConnectLoopback(sources ...*TorrentBlockSource) {
+	for _, source := range sources {
+		source.mu.Lock()
+		for _, other := range sources {
+			if other != source {
+				source.peers = append(source.peers, other.client)
+			}
+		}
+		source.mu.Unlock()
+	}
+}
+
+func (source *TorrentBlockSource) addTorrent(mi *metainfo.MetaInfo, id metainfo.Hash) (*torrent.Torrent, error) {
+	var t *torrent.Torrent
+	if mi != nil {
+		var err error
+		if t, err = source.client.AddTorrent(mi); err != nil {
+			return nil, err
+		}
+	} else {
+		t, _ = source.client.AddTorrentInfoHash(id)
+	}
+
+	source.mu.Lock()
+	for _, peer := range source.peers {
+		t.AddClientPeer(peer)
+	}
+	source.mu.Unlock()
+
+	return t, nil
+}
+
+func (source *TorrentBlockSource) Publish(serializedBlock []byte) (metainfo.Hash, error) {
+	// the torrent client finds the file here and seeds it without downloading
+	if err := os.MkdirAll(source.dataDir, 0755); err != nil {
+		return metainfo.Hash{}, err
+	}
+	hash := sha256.Sum256(serializedBlock)
+	path := filepath.Join(source.dataDir, hex.EncodeToString(hash[:]))
+	if err := ioutil.WriteFile(path, serializedBlock, 0644); err != nil {
+		return metainfo.Hash{}, err
+	}
+
+	mi, err := BlockTorrent(serializedBlock)
+	if err != nil {
+		return metainfo.Hash{}, err
+	}
+	t, err := source.addTorrent(mi, metainfo.Hash{})
+	if err != nil {
+		return metainfo.Hash{}, err
+	}
+
+	return t.InfoHash(), nil
+}
+
+func (source *TorrentBlockSource) Fetch(id metainfo.Hash, timeout time.Duration) ([]byte, error) {
+	t, _ := source.addTorrent(nil, id)
+
+	// nothing is left waiting for the torrent after we return, it just keeps
+	// downloading in the background
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	timedOut := errors.New("timed out fetching block " + id.HexString())
+
+	select {
+	case <-t.GotInfo():
+	case <-ctx.Done():
+		return nil, timedOut
+	}
+
+	t.DownloadAll()
+	r := t.NewReader()
+	defer r.Close()
+	block, err := ioutil.ReadAll(contextReader{ctx, r})
+	if ctx.Err() != nil {
+		return nil, timedOut
+	}
+	return block, err
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   torrent.Reader
+}
+
+func (cr contextReader) Read(b []byte) (int, error) {
+	return cr.r.ReadContext(cr.ctx, b)
+}
+
+func (source *TorrentBlockSource) Close() error {
+	source.client.Close()
+	return nil
+}
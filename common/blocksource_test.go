@@ -0,0 +1,55 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func newLoopbackSource(t *testing.T) *TorrentBlockSource {
+	t.Helper()
+	source, err := NewLoopbackBlockSource(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { source.Close() })
+	return source
+}
+
+func TestLoopbackPublishAndFetch(t *testing.T) {
+	publisher := newLoopbackSource(t)
+	fetcher := newLoopbackSource(t)
+	ConnectLoopback(publisher, fetcher)
+
+	block := Block{}
+	block.Transactions = append(block.Transactions,
+		Transaction{Type: TYPE_ACQUIRE, Key: [32]byte{1}, NameHash: sha256.Sum256([]byte("a"))})
+	serializedBlock := block.Serialize()
+
+	id, err := publisher.Publish(serializedBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := fetcher.Fetch(id, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched, serializedBlock) {
+		t.Fatal("fetched block isn't the one published")
+	}
+}
+
+func TestFetchTimesOut(t *testing.T) {
+	source := newLoopbackSource(t)
+
+	start := time.Now()
+	if _, err := source.Fetch(metainfo.Hash{1}, 200*time.Millisecond); err == nil {
+		t.Fatal("block nobody has was fetched")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("fetch didn't give up after its timeout")
+	}
+}
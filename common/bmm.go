@@ -0,0 +1,470 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// the smallest outputs bitcoind will relay, see DustLimit.
+const (
+	P2WPKH_DUST int64 = 294
+	P2TR_DUST   int64 = 330 // the same for P2WSH
+	P2A_DUST    int64 = 240 // pay-to-anchor
+	DUST        int64 = 546 // for everything else, like P2PKH
+)
+
+// DustLimit is the smallest value bitcoind relays in an output with pkScript.
+func DustLimit(pkScript []byte) int64 {
+	switch {
+	case bytes.Equal(pkScript, payToAnchorScript):
+		return P2A_DUST
+	case len(pkScript) == 22 && pkScript[0] == txscript.OP_0 && pkScript[1] == txscript.OP_DATA_20:
+		return P2WPKH_DUST
+	case len(pkScript) == 34 && (pkScript[0] == txscript.OP_0 || pkScript[0] == txscript.OP_1) &&
+		pkScript[1] == txscript.OP_DATA_32:
+		return P2TR_DUST
+	default:
+		return DUST
+	}
+}
+
+const (
+	// vbytes the witness of a P2WPKH input adds to a transaction, roughly.
+	P2WPKH_WITNESS_VSIZE = 27
+
+	// confirmation target we ask estimatesmartfee for.
+	BMM_CONF_TARGET = 1
+)
+
+// a BMM chain is a genesis transaction followed by a string of pre-signed
+// links. link n spends output 0 of link n-1 (or of the genesis) and has an
+// anchor output at index 1 (OP_TRUE or pay-to-anchor, see BMMAnchorScript) that
+// a miner spends in a CPFP child that carries the spacechain block id in an
+// OP_RETURN.
+type BMMChain struct {
+	Params  BMMParams
+	Genesis *wire.MsgTx
+	Links   []*wire.MsgTx
+}
+
+// ReadBMMChain parses the output of bmm/generate, the lines
+//
+//	BMM <n>: <hex>
+//	genesis: <hex>
+//
+// and ignores everything else.
+func ReadBMMChain(r io.Reader) (*BMMChain, error) {
+	chain := &BMMChain{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		spl := strings.SplitN(line, ":", 2)
+		if len(spl) != 2 {
+			continue
+		}
+
+		var n int
+		isGenesis := spl[0] == "genesis"
+		if !isGenesis {
+			if _, err := fmt.Sscanf(spl[0], "BMM %d", &n); err != nil {
+				continue
+			}
+		}
+
+		tx, err := decodeTx(strings.TrimSpace(spl[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid transaction on line '%s': %w", spl[0], err)
+		}
+
+		if isGenesis {
+			chain.Genesis = tx
+		} else {
+			if n != len(chain.Links)+1 {
+				return nil, fmt.Errorf("expected BMM %d, got BMM %d", len(chain.Links)+1, n)
+			}
+			chain.Links = append(chain.Links, tx)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if chain.Genesis == nil {
+		return nil, errors.New("genesis transaction not found")
+	}
+	if len(chain.Links) == 0 {
+		return nil, errors.New("no BMM transactions found")
+	}
+
+	return chain, chain.check()
+}
+
+// check ensures each link spends the previous one, keeps the funds in the same
+// script and doesn't spend more than it has.
+func (chain *BMMChain) check() error {
+	if len(chain.Genesis.TxOut) == 0 {
+		return errors.New("genesis has no outputs")
+	}
+	bmmScript := chain.Genesis.TxOut[0].PkScript
+
+	for n := 1; n <= len(chain.Links); n++ {
+		link := chain.Links[n-1]
+		parent := chain.Parent(n)
+		if len(link.TxIn) != 1 || link.TxIn[0].PreviousOutPoint.Hash != parent.TxHash() ||
+			link.TxIn[0].PreviousOutPoint.Index != 0 {
+			return fmt.Errorf("BMM %d doesn't spend the previous transaction", n)
+		}
+		if chain.Params.BlockInterval != 0 &&
+			link.TxIn[0].Sequence != uint32(chain.Params.BlockInterval) {
+			return fmt.Errorf("BMM %d has the wrong relative locktime", n)
+		}
+		if len(link.TxOut) != 2 {
+			return fmt.Errorf("BMM %d must have 2 outputs", n)
+		}
+		if !IsBMMAnchor(link.TxOut[1].PkScript) {
+			return fmt.Errorf("BMM %d doesn't have an anchor output", n)
+		}
+		if !bytes.Equal(link.TxOut[0].PkScript, bmmScript) {
+			return fmt.Errorf("BMM %d doesn't pay to the chain script", n)
+		}
+		if chain.LinkFee(n) < 0 {
+			return fmt.Errorf("BMM %d spends more than its input", n)
+		}
+	}
+	return nil
+}
+
+// Parent returns the transaction spent by link n (1-based).
+func (chain *BMMChain) Parent(n int) *wire.MsgTx {
+	if n == 1 {
+		return chain.Genesis
+	}
+	return chain.Links[n-2]
+}
+
+// LinkFee is how much link n pays in fees by itself.
+func (chain *BMMChain) LinkFee(n int) int64 {
+	fee := chain.Parent(n).TxOut[0].Value
+	for _, out := range chain.Links[n-1].TxOut {
+		fee -= out.Value
+	}
+	return fee
+}
+
+// FindNextBMMLink returns the 1-based index of the first link whose parent output
+// is still unspent on the bitcoin chain.
+func FindNextBMMLink(bitcoin BitcoinBackend, chain *BMMChain) (int, error) {
+	for n := 1; n <= len(chain.Links); n++ {
+		parent := chain.Parent(n).TxHash()
+		out, err := bitcoin.GetTxOut(&parent, 0, false)
+		if err != nil {
+			return 0, fmt.Errorf("gettxout %s:0: %w", parent, err)
+		}
+		if out != nil {
+			return n, nil
+		}
+	}
+	return 0, errors.New("all BMM transactions were used or the genesis isn't confirmed")
+}
+
+func BMMBlockIdScript(blockId [20]byte) []byte {
+	script, _ := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_RETURN).
+		AddData(blockId[:]).
+		Script()
+	return script
+}
+
+// ParseBMMBlockId reads a spacechain block id from an OP_RETURN output.
+func ParseBMMBlockId(pkScript []byte) (blockId [20]byte, ok bool) {
+	if len(pkScript) != 22 ||
+		!bytes.HasPrefix(pkScript, []byte{txscript.OP_RETURN, txscript.OP_DATA_20}) {
+		return blockId, false
+	}
+	copy(blockId[:], pkScript[2:])
+	return blockId, true
+}
+
+// BuildBMMChild creates the unsigned CPFP child for link n. it spends the link's
+// anchor output plus one of the wallet's UTXOs, commits to blockId and pays
+// enough for the package (link + child) to be mined at the estimated feerate.
+//
+// the returned prevouts describe the inputs in order, for signing.
+func BuildBMMChild(
+	bitcoin BitcoinBackend,
+	chain *BMMChain,
+	n int,
+	blockId [20]byte,
+) (child *wire.MsgTx, prevouts []PrevOut, fee int64, err error) {
+	link := chain.Links[n-1]
+	linkHash := link.TxHash()
+
+	feerate, err := EstimateFeeRate(bitcoin, BMM_CONF_TARGET)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	changeScript, err := WalletChangeScript(bitcoin)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	child = wire.NewMsgTx(2)
+	child.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&linkHash, 1), nil, nil))
+	child.AddTxOut(wire.NewTxOut(0, BMMBlockIdScript(blockId)))
+	child.AddTxOut(wire.NewTxOut(0, changeScript))
+	prevouts = []PrevOut{{
+		OutPoint: *wire.NewOutPoint(&linkHash, 1),
+		PkScript: link.TxOut[1].PkScript,
+		Value:    link.TxOut[1].Value,
+	}}
+
+	// one wallet input, so we can compute the fee before picking it
+	child.AddTxIn(wire.NewTxIn(&wire.OutPoint{}, nil, nil))
+	childVSize := int64(child.SerializeSizeStripped()) + 1 + P2WPKH_WITNESS_VSIZE
+	fee = int64(math.Ceil(feerate*float64(VSize(link)+childVSize))) - chain.LinkFee(n)
+	if fee < 0 {
+		fee = 0
+	}
+
+	utxo, err := PickWalletUTXO(bitcoin, fee+DustLimit(changeScript)-link.TxOut[1].Value)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	child.TxIn[1].PreviousOutPoint = utxo.OutPoint
+	prevouts = append(prevouts, utxo)
+
+	child.TxOut[1].Value = link.TxOut[1].Value + utxo.Value - fee
+	return child, prevouts, fee, nil
+}
+
+type PrevOut struct {
+	OutPoint wire.OutPoint
+	PkScript []byte
+	Value    int64
+}
+
+// EstimateFeeRate returns sat/vbyte.
+func EstimateFeeRate(bitcoin BitcoinBackend, target uint32) (float64, error) {
+	res, err := bitcoin.EstimateSmartFee(target)
+	if err != nil {
+		return 0, fmt.Errorf("estimatesmartfee: %w", err)
+	}
+	if res.FeeRate == nil {
+		if res.Errors != nil {
+			return 0, fmt.Errorf("estimatesmartfee: %s", strings.Join(*res.Errors, ", "))
+		}
+		return 0, errors.New("estimatesmartfee: no estimate available")
+	}
+
+	// BTC/kvB to sat/vB
+	return *res.FeeRate * 1e8 / 1000, nil
+}
+
+func WalletChangeScript(bitcoin BitcoinBackend) ([]byte, error) {
+	var address string
+	if err := rawRequest(bitcoin, "getrawchangeaddress", &address); err != nil {
+		return nil, err
+	}
+
+	var info struct {
+		ScriptPubKey string `json:"scriptPubKey"`
+	}
+	if err := rawRequest(bitcoin, "getaddressinfo", &info, address); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(info.ScriptPubKey)
+}
+
+// PickWalletUTXO returns the smallest confirmed wallet output worth at least min.
+func PickWalletUTXO(bitcoin BitcoinBackend, min int64) (PrevOut, error) {
+	unspent, err := bitcoin.ListUnspent()
+	if err != nil {
+		return PrevOut{}, fmt.Errorf("listunspent: %w", err)
+	}
+	sort.Slice(unspent, func(i, j int) bool { return unspent[i].Amount < unspent[j].Amount })
+
+	for _, u := range unspent {
+		value := int64(math.Round(u.Amount * 1e8))
+		if !u.Spendable || u.Confirmations < 1 || value < min {
+			continue
+		}
+		hash, err := chainhash.NewHashFromStr(u.TxID)
+		if err != nil {
+			continue
+		}
+		script, err := hex.DecodeString(u.ScriptPubKey)
+		if err != nil {
+			continue
+		}
+		return PrevOut{*wire.NewOutPoint(hash, u.Vout), script, value}, nil
+	}
+
+	return PrevOut{}, fmt.Errorf("no confirmed wallet output with at least %d sat", min)
+}
+
+// SignBMMChildWithWallet signs the wallet input of the child with bitcoind.
+// the anchor input needs no signature so the error bitcoind reports for it is
+// ignored.
+func SignBMMChildWithWallet(bitcoin BitcoinBackend, child *wire.MsgTx, prevouts []PrevOut) (*wire.MsgTx, error) {
+	type prevtx struct {
+		TxID         string  `json:"txid"`
+		Vout         uint32  `json:"vout"`
+		ScriptPubKey string  `json:"scriptPubKey"`
+		Amount       float64 `json:"amount"`
+	}
+	prevtxs := make([]prevtx, len(prevouts))
+	for i, p := range prevouts {
+		prevtxs[i] = prevtx{p.OutPoint.Hash.String(), p.OutPoint.Index,
+			hex.EncodeToString(p.PkScript), float64(p.Value) / 1e8}
+	}
+
+	var res struct {
+		Hex    string `json:"hex"`
+		Errors []struct {
+			TxID  string `json:"txid"`
+			Vout  uint32 `json:"vout"`
+			Error string `json:"error"`
+		} `json:"errors"`
+	}
+	if err := rawRequest(bitcoin, "signrawtransactionwithwallet", &res,
+		EncodeTx(child), prevtxs); err != nil {
+		return nil, err
+	}
+
+	anchor := child.TxIn[0].PreviousOutPoint
+	for _, e := range res.Errors {
+		if e.TxID == anchor.Hash.String() && e.Vout == anchor.Index {
+			continue
+		}
+		return nil, fmt.Errorf("failed to sign %s:%d: %s", e.TxID, e.Vout, e.Error)
+	}
+
+	return decodeTx(res.Hex)
+}
+
+// SubmitBMMPackage broadcasts a link and its child together so the child can
+// pay for its zero-fee parent.
+func SubmitBMMPackage(bitcoin BitcoinBackend, link, child *wire.MsgTx) (json.RawMessage, error) {
+	var res json.RawMessage
+	err := rawRequest(bitcoin, "submitpackage", &res,
+		[]string{EncodeTx(link), EncodeTx(child)})
+	return res, err
+}
+
+func VSize(tx *wire.MsgTx) int64 {
+	weight := tx.SerializeSizeStripped()*3 + tx.SerializeSize()
+	return int64((weight + 3) / 4)
+}
+
+func EncodeTx(tx *wire.MsgTx) string {
+	var buf bytes.Buffer
+	tx.Serialize(&buf)
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func decodeTx(h string) (*wire.MsgTx, error) {
+	b, err := hex.DecodeString(h)
+	if err != nil {
+		return nil, err
+	}
+	tx := &wire.MsgTx{}
+	if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func rawRequest(bitcoin BitcoinBackend, method string, result interface{}, params ...interface{}) error {
+	rawParams := make([]json.RawMessage, len(params))
+	for i, p := range params {
+		rawParams[i], _ = json.Marshal(p)
+	}
+
+	res, err := bitcoin.RawRequest(method, rawParams)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	return json.Unmarshal(res, result)
+}
+
+// ParseWitness decodes a serialized witness stack, like a PSBT's final witness.
+func ParseWitness(b []byte) (wire.TxWitness, error) {
+	r := bytes.NewReader(b)
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(b)) {
+		return nil, errors.New("too many witness items")
+	}
+
+	witness := make(wire.TxWitness, count)
+	for i := range witness {
+		witness[i], err = wire.ReadVarBytes(r, 0, txscript.MaxScriptSize, "witness")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return witness, nil
+}
+
+// WalletProcessPSBT has bitcoind sign and finalize the inputs it owns.
+func WalletProcessPSBT(bitcoin BitcoinBackend, psbtBase64 string) (signed string, complete bool, err error) {
+	var res struct {
+		PSBT     string `json:"psbt"`
+		Complete bool   `json:"complete"`
+	}
+	if err := rawRequest(bitcoin, "walletprocesspsbt", &res, psbtBase64); err != nil {
+		return "", false, err
+	}
+	return res.PSBT, res.Complete, nil
+}
+
+// BumpBMMChild returns a copy of child paying fee instead, taken from the
+// change, so it can replace the original.
+func BumpBMMChild(child *wire.MsgTx, prevouts []PrevOut, fee int64) (*wire.MsgTx, error) {
+	var total int64
+	for _, p := range prevouts {
+		total += p.Value
+	}
+
+	change := total - fee
+	if change < DustLimit(child.TxOut[1].PkScript) {
+		return nil, fmt.Errorf("can't pay %d sat in fees, there are only %d", fee, total)
+	}
+
+	bumped := child.Copy()
+	for _, in := range bumped.TxIn {
+		in.SignatureScript = nil
+		in.Witness = nil
+	}
+	bumped.TxOut[1].Value = change
+	return bumped, nil
+}
+
+// WalletTxConfirmations uses the wallet so it works without -txindex, -1 means
+// the transaction conflicts with one that was confirmed.
+func WalletTxConfirmations(bitcoin BitcoinBackend, txid chainhash.Hash) (int64, error) {
+	var res struct {
+		Confirmations int64 `json:"confirmations"`
+	}
+	if err := rawRequest(bitcoin, "gettransaction", &res, txid.String()); err != nil {
+		return 0, err
+	}
+	return res.Confirmations, nil
+}
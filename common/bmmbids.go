@@ -0,0 +1,89 @@
+package common
+
+import (
+	"math"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// BMMBid is a CPFP child competing to get its spacechain block into a link. all
+// of them spend the same anchor, so bitcoind only keeps the one paying the most
+// in its mempool at a time.
+type BMMBid struct {
+	Child   chainhash.Hash
+	BlockId [20]byte
+	Fee     int64   // paid by the child alone
+	FeeRate float64 // sat/vbyte of the link and the child together
+}
+
+type mempoolEntry struct {
+	Fees struct {
+		Base     float64 `json:"base"`
+		Ancestor float64 `json:"ancestor"`
+	} `json:"fees"`
+	AncestorSize int64    `json:"ancestorsize"`
+	SpentBy      []string `json:"spentby"`
+}
+
+// FindBMMBids returns the children spending the anchor of link n that are in
+// bitcoind's mempool right now.
+func FindBMMBids(bitcoin BitcoinBackend, chain *BMMChain, n int) ([]BMMBid, error) {
+	linkHash := chain.Links[n-1].TxHash()
+
+	var entry mempoolEntry
+	if err := rawRequest(bitcoin, "getmempoolentry", &entry, linkHash.String()); err != nil {
+		if strings.Contains(err.Error(), "not in mempool") {
+			// nobody is bidding
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	bids := make([]BMMBid, 0, len(entry.SpentBy))
+	for _, txid := range entry.SpentBy {
+		var raw string
+		if err := rawRequest(bitcoin, "getrawtransaction", &raw, txid); err != nil {
+			// it may have been replaced in the meantime
+			continue
+		}
+		child, err := decodeTx(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		spendsAnchor := false
+		for _, in := range child.TxIn {
+			if in.PreviousOutPoint.Hash == linkHash && in.PreviousOutPoint.Index == 1 {
+				spendsAnchor = true
+			}
+		}
+		if !spendsAnchor {
+			continue
+		}
+
+		bid := BMMBid{Child: child.TxHash()}
+		found := false
+		for _, out := range child.TxOut {
+			if bid.BlockId, found = ParseBMMBlockId(out.PkScript); found {
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		var childEntry mempoolEntry
+		if err := rawRequest(bitcoin, "getmempoolentry", &childEntry, txid); err != nil {
+			continue
+		}
+		bid.Fee = int64(math.Round(childEntry.Fees.Base * 1e8))
+		if childEntry.AncestorSize > 0 {
+			bid.FeeRate = childEntry.Fees.Ancestor * 1e8 / float64(childEntry.AncestorSize)
+		}
+
+		bids = append(bids, bid)
+	}
+
+	return bids, nil
+}
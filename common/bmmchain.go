@@ -0,0 +1,142 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// BMMCHAIN_FILE is where bmm/generate saves the chain inside the datadir.
+const BMMCHAIN_FILE = "bmmchain.json"
+
+const BMMCHAIN_VERSION = 1
+
+type BMMParams struct {
+	Network       string `json:"network"`          // as in chaincfg.Params.Name
+	Format        string `json:"format,omitempty"` // BMM_FORMAT_*, empty means p2wpkh
+	BlockInterval int    `json:"blockinterval"`
+	PubKey        string `json:"pubkey"` // of the key that signed the links
+}
+
+func (params BMMParams) format() string {
+	if params.Format == "" {
+		return BMM_FORMAT_P2WPKH
+	}
+	return params.Format
+}
+
+type bmmChainFile struct {
+	Version  int       `json:"version"`
+	Params   BMMParams `json:"params"`
+	Genesis  string    `json:"genesis"`
+	Links    []string  `json:"links"`
+	Checksum string    `json:"checksum"`
+}
+
+// SaveBMMChain writes the chain to path. it won't overwrite an existing file
+// since that could mean losing the only copy of a chain that's already funded.
+func SaveBMMChain(path string, chain *BMMChain) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, EncodeBMMChain(chain), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadBMMChain reads a chain saved by SaveBMMChain and verifies it. the plain
+// output of older bmm/generate versions is also accepted.
+func LoadBMMChain(path string) (*BMMChain, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return ReadBMMChain(bytes.NewReader(data))
+	}
+
+	chain, err := DecodeBMMChain(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return chain, nil
+}
+
+// EncodeBMMChain serializes a chain the way it's saved in files.
+func EncodeBMMChain(chain *BMMChain) []byte {
+	f := bmmChainFile{
+		Version: BMMCHAIN_VERSION,
+		Params:  chain.Params,
+		Genesis: EncodeTx(chain.Genesis),
+		Links:   make([]string, len(chain.Links)),
+	}
+	for i, link := range chain.Links {
+		f.Links[i] = EncodeTx(link)
+	}
+	f.Checksum = f.checksum()
+
+	data, _ := json.MarshalIndent(f, "", "  ")
+	return data
+}
+
+func DecodeBMMChain(data []byte) (*BMMChain, error) {
+	var f bmmChainFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.Version != BMMCHAIN_VERSION {
+		return nil, fmt.Errorf("unsupported bmm chain version %d", f.Version)
+	}
+	if f.Checksum != f.checksum() {
+		return nil, errors.New("bmm chain checksum doesn't match, the file is corrupted")
+	}
+
+	var err error
+	chain := &BMMChain{Params: f.Params, Links: make([]*wire.MsgTx, len(f.Links))}
+	if chain.Genesis, err = decodeTx(f.Genesis); err != nil {
+		return nil, fmt.Errorf("invalid genesis: %w", err)
+	}
+	for i, link := range f.Links {
+		if chain.Links[i], err = decodeTx(link); err != nil {
+			return nil, fmt.Errorf("invalid BMM %d: %w", i+1, err)
+		}
+	}
+
+	return chain, chain.check()
+}
+
+func (f bmmChainFile) checksum() string {
+	h := sha256.New()
+	params, _ := json.Marshal(f.Params)
+	fmt.Fprintf(h, "%d\n%s\n%s\n", f.Version, params, f.Genesis)
+	for _, link := range f.Links {
+		fmt.Fprintf(h, "%s\n", link)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ReplaceBMMChain saves next at path, keeping the chain it replaces next to it
+// as <path>.<genesis txid>.
+func ReplaceBMMChain(path string, previous, next *BMMChain) error {
+	if _, err := os.Stat(path); err == nil {
+		archive := path + "." + previous.Genesis.TxHash().String()
+		if err := os.Rename(path, archive); err != nil {
+			return err
+		}
+	}
+	return SaveBMMChain(path, next)
+}
@@ -0,0 +1,208 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// the key that signs the BMM links isn't secret: it's derived from the outpoint
+// that funds the genesis and the chain parameters, so anyone can rebuild the
+// exact same chain (signatures are deterministic) and check that the
+// transactions being followed are the canonical ones.
+//
+//	key = sha256(BMM_DERIVATION_TAG || txid || vout || blockinterval || numtransactions [|| format])
+//
+// (the format is only included for formats other than p2wpkh.)
+//
+// since the key is public anyone can also sign a different spend of the chain.
+// named follows whatever spends it so all nodes stay on the same chain, but the
+// links of the pre-signed chain stop being valid and, if the spend doesn't pay
+// to a bmm output again, nobody else can continue it.
+const BMM_DERIVATION_TAG = "namechain/bmm/v1"
+
+// chains can hold their funds and anchor the miners' transactions in two ways:
+//
+//   - p2wpkh: funds in a P2WPKH output and a bare OP_TRUE anchor.
+//   - p2tr: funds in a P2TR output that can only be spent through a single
+//     <key> OP_CHECKSIG leaf and a pay-to-anchor (OP_1 <4e73>) anchor.
+const (
+	BMM_FORMAT_P2WPKH = "p2wpkh"
+	BMM_FORMAT_P2TR   = "p2tr"
+)
+
+var payToAnchorScript = []byte{txscript.OP_1, txscript.OP_DATA_2, 0x4e, 0x73}
+
+// BMMKey derives the key for a chain funded by the given outpoint.
+func BMMKey(funding wire.OutPoint, params BMMParams, numTransactions int) (*btcec.PrivateKey, *btcec.PublicKey) {
+	h := sha256.New()
+	h.Write([]byte(BMM_DERIVATION_TAG))
+	h.Write(funding.Hash[:])
+	binary.Write(h, binary.BigEndian, funding.Index)
+	binary.Write(h, binary.BigEndian, uint32(params.BlockInterval))
+	binary.Write(h, binary.BigEndian, uint32(numTransactions))
+	if params.format() != BMM_FORMAT_P2WPKH {
+		h.Write([]byte(params.format()))
+	}
+	return btcec.PrivKeyFromBytes(btcec.S256(), h.Sum(nil))
+}
+
+// BMMScript is the script that holds the chain funds.
+func BMMScript(pk *btcec.PublicKey, format string) []byte {
+	if format == BMM_FORMAT_P2TR {
+		return NewTaprootLeaf(CheckSigScript(pk)).PkScript()
+	}
+
+	script, _ := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_0).
+		AddData(btcutil.Hash160(pk.SerializeCompressed())).
+		Script()
+	return script
+}
+
+// BMMAnchorScript is the output miners spend to attach their CPFP child.
+func BMMAnchorScript(format string) []byte {
+	if format == BMM_FORMAT_P2TR {
+		return payToAnchorScript
+	}
+
+	script, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_TRUE).Script()
+	return script
+}
+
+// IsBMMAnchor recognizes the anchor of any format.
+func IsBMMAnchor(pkScript []byte) bool {
+	return bytes.Equal(pkScript, BMMAnchorScript(BMM_FORMAT_P2WPKH)) ||
+		bytes.Equal(pkScript, BMMAnchorScript(BMM_FORMAT_P2TR))
+}
+
+// BMMDust is what a chain of the given format leaves in each output it makes,
+// the dust limit of its bmm script.
+func BMMDust(format string) int64 {
+	if format == BMM_FORMAT_P2TR {
+		return P2TR_DUST
+	}
+	return P2WPKH_DUST
+}
+
+// BMMFundingAmount is what the genesis must lock in the chain so each link can
+// leave BMMDust in its anchor output and the last one still has a non-dust
+// output.
+func BMMFundingAmount(numTransactions int, format string) int64 {
+	return BMMDust(format)*int64(numTransactions) + BMMDust(format)
+}
+
+// DeriveBMMChain builds every link on top of a genesis transaction. the genesis
+// must spend the funding outpoint in its first input and pay BMMFundingAmount to
+// the derived script in its first output.
+func DeriveBMMChain(genesis *wire.MsgTx, params BMMParams, numTransactions int) (*BMMChain, error) {
+	if len(genesis.TxIn) == 0 || len(genesis.TxOut) == 0 {
+		return nil, errors.New("invalid genesis transaction")
+	}
+	if params.BlockInterval <= 0 || numTransactions <= 0 {
+		return nil, errors.New("blockinterval and numtransactions must be positive")
+	}
+	format := params.format()
+	if format != BMM_FORMAT_P2WPKH && format != BMM_FORMAT_P2TR {
+		return nil, fmt.Errorf("unknown bmm format '%s'", format)
+	}
+
+	sk, pk := BMMKey(genesis.TxIn[0].PreviousOutPoint, params, numTransactions)
+	bmmScript := BMMScript(pk, format)
+	if !bytes.Equal(genesis.TxOut[0].PkScript, bmmScript) {
+		return nil, errors.New("genesis doesn't pay to the derived bmm script")
+	}
+	if genesis.TxOut[0].Value != BMMFundingAmount(numTransactions, format) {
+		return nil, fmt.Errorf("genesis must lock exactly %d sat", BMMFundingAmount(numTransactions, format))
+	}
+
+	chain := &BMMChain{
+		Params: BMMParams{
+			Network:       params.Network,
+			Format:        params.Format,
+			BlockInterval: params.BlockInterval,
+			PubKey:        hex.EncodeToString(pk.SerializeCompressed()),
+		},
+		Genesis: genesis,
+	}
+
+	prev := genesis
+	for i := 0; i < numTransactions; i++ {
+		amount := prev.TxOut[0].Value
+
+		tx := wire.NewMsgTx(2)
+		tx.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Hash: prev.TxHash(), Index: 0},
+			Sequence:         uint32(params.BlockInterval),
+		})
+		tx.AddTxOut(wire.NewTxOut(amount-BMMDust(format), bmmScript))
+		tx.AddTxOut(wire.NewTxOut(BMMDust(format), BMMAnchorScript(format)))
+
+		prevouts := []PrevOut{{tx.TxIn[0].PreviousOutPoint, bmmScript, amount}}
+		if err := signBMMInput(tx, 0, prevouts, sk, format); err != nil {
+			return nil, err
+		}
+
+		chain.Links = append(chain.Links, tx)
+		prev = tx
+	}
+
+	return chain, nil
+}
+
+// signBMMInput signs input idx, which spends the bmm output described in
+// prevouts[idx]. for p2tr prevouts must describe all inputs.
+func signBMMInput(tx *wire.MsgTx, idx int, prevouts []PrevOut, sk *btcec.PrivateKey, format string) error {
+	prevout := prevouts[idx]
+
+	if format == BMM_FORMAT_P2TR {
+		leaf := NewTaprootLeaf(CheckSigScript(sk.PubKey()))
+		sighash, err := TaprootScriptSigHash(tx, idx, prevouts, TapLeafHash(leaf.Script))
+		if err != nil {
+			return err
+		}
+		sig, err := SchnorrSign(sk, sighash)
+		if err != nil {
+			return err
+		}
+		tx.TxIn[idx].Witness = leaf.Witness(sig)
+		return nil
+	}
+
+	witness, err := txscript.WitnessSignature(tx, txscript.NewTxSigHashes(tx), idx,
+		prevout.Value, prevout.PkScript, txscript.SigHashAll, sk, true)
+	if err != nil {
+		return err
+	}
+	tx.TxIn[idx].Witness = witness
+	return nil
+}
+
+// VerifyBMMChain rebuilds the chain from its genesis and parameters and checks
+// that every link is exactly the canonical one.
+func VerifyBMMChain(chain *BMMChain) error {
+	canonical, err := DeriveBMMChain(chain.Genesis, chain.Params, len(chain.Links))
+	if err != nil {
+		return err
+	}
+	if chain.Params.PubKey != canonical.Params.PubKey {
+		return errors.New("bmm pubkey doesn't match the derived key")
+	}
+
+	for i, link := range chain.Links {
+		if link.TxHash() != canonical.Links[i].TxHash() {
+			return fmt.Errorf("BMM %d is %s, expected %s", i+1,
+				link.TxHash(), canonical.Links[i].TxHash())
+		}
+	}
+
+	return nil
+}
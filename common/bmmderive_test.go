@@ -0,0 +1,54 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func deriveTestChain(t *testing.T, format string, n int) *BMMChain {
+	t.Helper()
+	funding := wire.OutPoint{Hash: chainhash.HashH([]byte(format)), Index: 1}
+	params := BMMParams{Format: format, BlockInterval: 1}
+	_, pk := BMMKey(funding, params, n)
+
+	genesis := wire.NewMsgTx(2)
+	genesis.AddTxIn(wire.NewTxIn(&funding, nil, nil))
+	genesis.AddTxOut(wire.NewTxOut(BMMFundingAmount(n, format), BMMScript(pk, format)))
+	chain, err := DeriveBMMChain(genesis, params, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+func TestBMMOutputsAreNotDust(t *testing.T) {
+	for _, format := range []string{BMM_FORMAT_P2WPKH, BMM_FORMAT_P2TR} {
+		chain := deriveTestChain(t, format, 3)
+		final := chain.Final()
+
+		if final.TxOut[0].Value != BMMDust(format) {
+			t.Fatalf("%s: final link keeps %d sat, expected %d", format, final.TxOut[0].Value, BMMDust(format))
+		}
+		for _, link := range chain.Links {
+			out := link.TxOut[0]
+			if out.Value < DustLimit(out.PkScript) {
+				t.Fatalf("%s: link output of %d sat is below the dust limit of %d",
+					format, out.Value, DustLimit(out.PkScript))
+			}
+		}
+	}
+
+	// every output of the final p2tr link, which the extension spends, is standard
+	final := deriveTestChain(t, BMM_FORMAT_P2TR, 3).Final()
+	for i, out := range final.TxOut {
+		if out.Value < DustLimit(out.PkScript) {
+			t.Fatalf("output %d of the final p2tr link has %d sat, the dust limit is %d",
+				i, out.Value, DustLimit(out.PkScript))
+		}
+	}
+	if DustLimit(final.TxOut[0].PkScript) != P2TR_DUST {
+		t.Fatal("p2tr output wasn't recognized")
+	}
+}
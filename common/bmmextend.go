@@ -0,0 +1,151 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// a chain is extended by a new genesis that spends output 0 of its final link.
+// the new genesis also has an OP_RETURN output with the parameters of the new
+// chain
+//
+//	OP_RETURN <"bmmx" || blockinterval (uint16) || numtransactions (uint32) [|| format (uint8)]>
+//
+// and the key of the new chain is derived from the final link outpoint like any
+// other genesis (see BMMKey), so named can follow the hand-off by itself. the
+// format byte is 1 for p2tr and omitted for p2wpkh.
+const BMM_EXTENSION_TAG = "bmmx"
+
+func BMMExtensionScript(params BMMParams, numTransactions int) []byte {
+	data := make([]byte, 10, 11)
+	copy(data, BMM_EXTENSION_TAG)
+	binary.BigEndian.PutUint16(data[4:], uint16(params.BlockInterval))
+	binary.BigEndian.PutUint32(data[6:], uint32(numTransactions))
+	if params.format() == BMM_FORMAT_P2TR {
+		data = append(data, 1)
+	}
+
+	script, _ := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_RETURN).
+		AddData(data).
+		Script()
+	return script
+}
+
+// ParseBMMExtension finds the extension parameters in a new genesis.
+func ParseBMMExtension(genesis *wire.MsgTx) (params BMMParams, numTransactions int, ok bool) {
+	for _, out := range genesis.TxOut {
+		script := out.PkScript
+		if len(script) < 12 || script[0] != txscript.OP_RETURN ||
+			int(script[1]) != len(script)-2 ||
+			!bytes.HasPrefix(script[2:], []byte(BMM_EXTENSION_TAG)) {
+			continue
+		}
+
+		params.BlockInterval = int(binary.BigEndian.Uint16(script[6:]))
+		numTransactions = int(binary.BigEndian.Uint32(script[8:]))
+		switch len(script) {
+		case 12:
+			params.Format = BMM_FORMAT_P2WPKH
+		case 13:
+			if script[12] != 1 {
+				continue
+			}
+			params.Format = BMM_FORMAT_P2TR
+		default:
+			continue
+		}
+		return params, numTransactions, true
+	}
+	return params, 0, false
+}
+
+// Key returns the (public) key that signs this chain's links.
+func (chain *BMMChain) Key() (*btcec.PrivateKey, *btcec.PublicKey) {
+	return BMMKey(chain.Genesis.TxIn[0].PreviousOutPoint, chain.Params, len(chain.Links))
+}
+
+// Final returns the last link of the chain.
+func (chain *BMMChain) Final() *wire.MsgTx {
+	return chain.Links[len(chain.Links)-1]
+}
+
+// ExtendBMMChain checks if tx is a valid extension of chain and returns the new
+// chain derived from it.
+func ExtendBMMChain(chain *BMMChain, tx *wire.MsgTx) (*BMMChain, error) {
+	final := chain.Final().TxHash()
+	if len(tx.TxIn) == 0 || tx.TxIn[0].PreviousOutPoint != *wire.NewOutPoint(&final, 0) {
+		return nil, errors.New("doesn't spend the final link")
+	}
+
+	return DeriveBMMExtension(tx, chain.Params.Network)
+}
+
+// DeriveBMMExtension derives the chain that starts at a new genesis from the
+// parameters it carries, without looking at what it spends, so it can be done
+// with nothing but the transaction. network only goes in the params.
+func DeriveBMMExtension(tx *wire.MsgTx, network string) (*BMMChain, error) {
+	params, numTransactions, ok := ParseBMMExtension(tx)
+	if !ok {
+		return nil, errors.New("no extension parameters")
+	}
+	params.Network = network
+
+	return DeriveBMMChain(tx, params, numTransactions)
+}
+
+// BuildBMMExtension creates the genesis of the chain that will follow the given
+// one, spending its final link and the funding outpoint. the first input is
+// signed here, the funding input must still be signed by its owner.
+func BuildBMMExtension(
+	chain *BMMChain,
+	params BMMParams,
+	numTransactions int,
+	funding PrevOut,
+	changeScript []byte,
+	fee int64,
+) (*wire.MsgTx, error) {
+	final := chain.Final()
+	finalHash := final.TxHash()
+	finalOutPoint := wire.NewOutPoint(&finalHash, 0)
+	finalAmount := final.TxOut[0].Value
+
+	_, pk := BMMKey(*finalOutPoint, params, numTransactions)
+	fundingAmount := BMMFundingAmount(numTransactions, params.format())
+
+	change := finalAmount + funding.Value - fundingAmount - fee
+	if change < 0 {
+		return nil, fmt.Errorf("funding has %d sat, but we need %d",
+			funding.Value, fundingAmount+fee-finalAmount)
+	}
+	if change > 0 && change < DustLimit(changeScript) {
+		return nil, fmt.Errorf("change would be %d sat, below the dust limit", change)
+	}
+
+	genesis := wire.NewMsgTx(wire.TxVersion)
+	genesis.AddTxIn(wire.NewTxIn(finalOutPoint, nil, nil))
+	genesis.AddTxIn(wire.NewTxIn(&funding.OutPoint, nil, nil))
+	genesis.AddTxOut(wire.NewTxOut(fundingAmount, BMMScript(pk, params.format())))
+	genesis.AddTxOut(wire.NewTxOut(0, BMMExtensionScript(params, numTransactions)))
+	if change > 0 {
+		genesis.AddTxOut(wire.NewTxOut(change, changeScript))
+	}
+
+	// the previous chain key is public, so we sign for it ourselves
+	sk, _ := chain.Key()
+	prevouts := []PrevOut{
+		{*finalOutPoint, final.TxOut[0].PkScript, finalAmount},
+		funding,
+	}
+	if err := signBMMInput(genesis, 0, prevouts, sk, chain.Params.format()); err != nil {
+		return nil, err
+	}
+
+	return genesis, nil
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
 
 	"gopkg.in/yaml.v2"
@@ -15,13 +16,65 @@ type Config struct {
 	IPv6       string `yaml:"ipv6"`
 	ListenAddr string `yaml:"listen-addr"`
 
-	RPCAddr string `yaml:"rpc-addr"`
+	// only localhost by default, set it to something like '0.0.0.0:24336' to
+	// accept gossip peers from other machines
+	GossipAddr string   `yaml:"gossip-addr"`
+	Peers      []string `yaml:"peers"` // other named instances to relay transactions with
+
+	RPCAddr string    `yaml:"rpc-addr"`
+	RPCAuth []RPCAuth `yaml:"rpc-auth"`
+
+	// used by namecli instead of the cookie file when set
+	RPCUser     string `yaml:"rpc-user"`
+	RPCPassword string `yaml:"rpc-password"`
+
+	// where named keeps its data: "badger" (the default) or "bbolt"
+	Storage string `yaml:"storage"`
+
+	// how many bitcoin blocks we wait for our BMM bid before raising its fee
+	BMMBumpBlocks int `yaml:"bmm-bump-blocks"`
+}
+
+type RPCAuth struct {
+	User     string `yaml:"user"`
+	Hash     string `yaml:"hash"`     // as generated by RPCAuthHash()
+	ReadOnly bool   `yaml:"readonly"` // if true this user can't call admin methods
 }
 
 func (c *Config) SetDefaults() {
 	if c.RPCAddr == "" {
 		c.RPCAddr = "localhost:24335" // 24335 can be read as "named"
 	}
+	if c.GossipAddr == "" {
+		c.GossipAddr = "localhost:24336"
+	}
+	if c.Storage == "" {
+		c.Storage = "badger"
+	}
+	if c.BMMBumpBlocks == 0 {
+		c.BMMBumpBlocks = 2
+	}
+}
+
+// Redacted is a copy of the config without the passwords, for logging.
+func (c Config) Redacted() Config {
+	if c.BitcoinRPC != "" {
+		if u, err := url.Parse(c.BitcoinRPC); err == nil {
+			c.BitcoinRPC = u.Redacted()
+		} else {
+			c.BitcoinRPC = "xxxxx"
+		}
+	}
+	if c.RPCPassword != "" {
+		c.RPCPassword = "xxxxx"
+	}
+	auth := make([]RPCAuth, len(c.RPCAuth))
+	for i, a := range c.RPCAuth {
+		a.Hash = "xxxxx"
+		auth[i] = a
+	}
+	c.RPCAuth = auth
+	return c
 }
 
 func (config *Config) ReadConfig() {
@@ -0,0 +1,107 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Envelope carries a namechain transaction to an offline signer and back, like a
+// PSBT does for bitcoin transactions. It's exchanged as base64-encoded JSON with
+// a prefix so it can't be confused with other things.
+type Envelope struct {
+	Version int    `json:"version"`
+	Tx      string `json:"tx"`      // hex-serialized, with an empty signature until signed
+	SigHash string `json:"sighash"` // what must be signed, so the signer can check it
+	Signer  string `json:"signer"`  // the public key expected to sign
+	Name    string `json:"name,omitempty"`
+	Signed  bool   `json:"signed"`
+}
+
+const (
+	ENVELOPE_VERSION = 1
+	ENVELOPE_PREFIX  = "nctx"
+)
+
+func NewEnvelope(tx Transaction, signer [32]byte, name string) Envelope {
+	sighash := tx.SigHash()
+	return Envelope{
+		Version: ENVELOPE_VERSION,
+		Tx:      hex.EncodeToString(tx.Serialize()),
+		SigHash: hex.EncodeToString(sighash[:]),
+		Signer:  hex.EncodeToString(signer[:]),
+		Name:    name,
+	}
+}
+
+func (env Envelope) Encode() string {
+	j, _ := json.Marshal(env)
+	return ENVELOPE_PREFIX + base64.StdEncoding.EncodeToString(j)
+}
+
+func DecodeEnvelope(encoded string) (env Envelope, err error) {
+	encoded = strings.TrimSpace(encoded)
+	if !strings.HasPrefix(encoded, ENVELOPE_PREFIX) {
+		return env, errors.New("not a transaction envelope")
+	}
+	j, err := base64.StdEncoding.DecodeString(encoded[len(ENVELOPE_PREFIX):])
+	if err != nil {
+		return env, fmt.Errorf("invalid envelope encoding: %w", err)
+	}
+	if err := json.Unmarshal(j, &env); err != nil {
+		return env, fmt.Errorf("invalid envelope: %w", err)
+	}
+	if env.Version != ENVELOPE_VERSION {
+		return env, fmt.Errorf("unsupported envelope version %d", env.Version)
+	}
+
+	// make sure it's consistent
+	tx, err := env.Transaction()
+	if err != nil {
+		return env, err
+	}
+	sighash := tx.SigHash()
+	if env.SigHash != hex.EncodeToString(sighash[:]) {
+		return env, errors.New("envelope sighash doesn't match its transaction")
+	}
+	if env.Signed && !tx.CheckSignature(env.SignerKey()) {
+		return env, errors.New("envelope signature is invalid")
+	}
+
+	return env, nil
+}
+
+func (env Envelope) Transaction() (Transaction, error) {
+	b, err := hex.DecodeString(env.Tx)
+	if err != nil {
+		return Transaction{}, errors.New("envelope transaction is invalid hex")
+	}
+	return ParseTransaction(b)
+}
+
+func (env Envelope) SignerKey() (key [32]byte) {
+	b, _ := hex.DecodeString(env.Signer)
+	copy(key[:], b)
+	return key
+}
+
+// Sign is called on the offline machine.
+func (env *Envelope) Sign(sign func(tx *Transaction) error) error {
+	tx, err := env.Transaction()
+	if err != nil {
+		return err
+	}
+	if err := sign(&tx); err != nil {
+		return err
+	}
+	if !tx.CheckSignature(env.SignerKey()) {
+		return errors.New("signed with a key other than the expected signer")
+	}
+
+	env.Tx = hex.EncodeToString(tx.Serialize())
+	env.Signed = true
+	return nil
+}
@@ -0,0 +1,118 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func testEnvelope() (env Envelope, sk [32]byte) {
+	sk = sha256.Sum256([]byte("owner"))
+	tx := Transaction{
+		Type:        TYPE_TRANSFER,
+		NameHash:    sha256.Sum256([]byte("a")),
+		Key:         PublicKey(sha256.Sum256([]byte("new owner"))),
+		RecentBlock: [20]byte{7},
+	}
+	return NewEnvelope(tx, PublicKey(sk), "a"), sk
+}
+
+func signWith(sk [32]byte) func(tx *Transaction) error {
+	return func(tx *Transaction) error { return tx.Sign(sk) }
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	env, sk := testEnvelope()
+
+	// unsigned, on its way to the signer
+	decoded, err := DecodeEnvelope(env.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != env || decoded.Signed {
+		t.Fatalf("decoded %v, not %v", decoded, env)
+	}
+
+	// signed, on its way back
+	if err := decoded.Sign(signWith(sk)); err != nil {
+		t.Fatal(err)
+	}
+	// whitespace from copying and pasting is fine
+	back, err := DecodeEnvelope("  " + decoded.Encode() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !back.Signed || back.Name != "a" || back.SignerKey() != PublicKey(sk) {
+		t.Fatalf("signed envelope came back as %v", back)
+	}
+	tx, err := back.Transaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tx.CheckSignature(PublicKey(sk)) {
+		t.Fatal("transaction in the envelope isn't signed")
+	}
+	original, _ := env.Transaction()
+	if tx.SigHash() != original.SigHash() {
+		t.Fatal("signing changed what was signed")
+	}
+}
+
+func TestEnvelopeWrongKey(t *testing.T) {
+	env, _ := testEnvelope()
+	if err := env.Sign(signWith(sha256.Sum256([]byte("someone else")))); err == nil {
+		t.Fatal("signed with a key other than the signer's")
+	}
+	if env.Signed {
+		t.Fatal("envelope marked as signed after a failed signature")
+	}
+}
+
+func TestEnvelopeTampered(t *testing.T) {
+	env, sk := testEnvelope()
+	if err := env.Sign(signWith(sk)); err != nil {
+		t.Fatal(err)
+	}
+
+	// flips the hex digit at position i of s
+	flip := func(s string, i int) string {
+		b, _ := hex.DecodeString(s[i : i+2])
+		b[0] ^= 0x01
+		return s[:i] + hex.EncodeToString(b) + s[i+2:]
+	}
+
+	for name, tamper := range map[string]func(env *Envelope){
+		// the new owner, which the sighash covers
+		"transaction": func(env *Envelope) { env.Tx = flip(env.Tx, 2*33) },
+		"signature":   func(env *Envelope) { env.Tx = flip(env.Tx, len(env.Tx)-2) },
+		"sighash":     func(env *Envelope) { env.SigHash = flip(env.SigHash, 0) },
+		"signer":      func(env *Envelope) { env.Signer = hex.EncodeToString(make([]byte, 32)) },
+		"version":     func(env *Envelope) { env.Version = ENVELOPE_VERSION + 1 },
+		"tx hex":      func(env *Envelope) { env.Tx = "zz" + env.Tx[2:] },
+	} {
+		tampered := env
+		tamper(&tampered)
+		if _, err := DecodeEnvelope(tampered.Encode()); err == nil {
+			t.Fatalf("envelope with tampered %s was accepted", name)
+		}
+	}
+
+	// an unsigned envelope can't claim to be signed
+	unsigned, _ := testEnvelope()
+	unsigned.Signed = true
+	if _, err := DecodeEnvelope(unsigned.Encode()); err == nil {
+		t.Fatal("unsigned envelope claiming to be signed was accepted")
+	}
+
+	encoded := env.Encode()
+	for name, s := range map[string]string{
+		"prefix": strings.TrimPrefix(encoded, ENVELOPE_PREFIX),
+		"base64": encoded[:len(encoded)-3] + "!!!",
+		"json":   ENVELOPE_PREFIX + "bm90IGpzb24=",
+	} {
+		if _, err := DecodeEnvelope(s); err == nil {
+			t.Fatalf("envelope with bad %s was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package common
+
+import "github.com/btcsuite/btcd/btcec"
+
+// names are owned by 32-byte x-only public keys, as in BIP-340.
+
+func GenerateSecretKey() (sk [32]byte, err error) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return sk, err
+	}
+	copy(sk[:], padKey(priv.D.Bytes()))
+	return sk, nil
+}
+
+func PublicKey(sk [32]byte) (pk [32]byte) {
+	_, pub := btcec.PrivKeyFromBytes(btcec.S256(), sk[:])
+	copy(pk[:], padKey(pub.X.Bytes()))
+	return pk
+}
+
+func padKey(b []byte) []byte {
+	padded := make([]byte, 32)
+	copy(padded[32-len(b):], b)
+	return padded
+}
@@ -7,16 +7,22 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
 
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/cbergoon/merkletree"
+	"github.com/fiatjaf/schnorr"
 	"go.uber.org/zap/buffer"
 )
 
+// MAX_BLOCK_SIZE is the largest a serialized block can be.
+const MAX_BLOCK_SIZE = 200000
+
 type Block struct {
 	PreviousBlock metainfo.Hash
 	MerkleRoot    []byte
-	BlockHash     []byte               // sha256(previousBlock, merkleRoot)
+	StateRoot     [32]byte             // of the tree of all names after this block
+	BlockHash     []byte               // sha256(previousBlock, merkleRoot, stateRoot)
 	Transactions  []merkletree.Content // this is []Transaction underneath
 
 	// ID is the torrent infohash of the block that will be published to both torrent
@@ -36,18 +42,19 @@ func (block Block) MerkleTree() *merkletree.MerkleTree {
 }
 
 func ParseBlock(serializedBlock []byte) (block Block, err error) {
-	if len(serializedBlock) < 52 {
+	if len(serializedBlock) < 84 {
 		return block, errors.New("serialized block is too short")
 	}
-	if len(serializedBlock) > 200000 {
+	if len(serializedBlock) > MAX_BLOCK_SIZE {
 		return block, errors.New("serialized block is too large")
 	}
 
-	// grab this from serialized format
-	block.PreviousBlock = metainfo.HashBytes(serializedBlock[0:20])
+	// grab these from serialized format
+	copy(block.PreviousBlock[:], serializedBlock[0:20])
+	copy(block.StateRoot[:], serializedBlock[52:84])
 
 	// deserialize transactions
-	reader := bufio.NewReader(bytes.NewBuffer(serializedBlock[52:]))
+	reader := bufio.NewReader(bytes.NewBuffer(serializedBlock[84:]))
 	for {
 		n, err := reader.ReadByte()
 		if err == io.EOF {
@@ -75,11 +82,7 @@ func ParseBlock(serializedBlock []byte) (block Block, err error) {
 	}
 	block.MerkleRoot = block.MerkleTree().MerkleRoot()
 
-	root := block.MerkleTree().MerkleRoot()
-	hash := sha256.New()
-	hash.Write(block.PreviousBlock.Bytes())
-	hash.Write(root)
-	block.BlockHash = hash.Sum(nil)
+	block.BlockHash = BlockHash(block.PreviousBlock, block.MerkleRoot, block.StateRoot)
 
 	// check if values match the serialized values
 	if bytes.Compare(block.BlockHash, serializedBlock[20:52]) != 0 {
@@ -96,12 +99,11 @@ func (block Block) Serialize() []byte {
 	previous := block.PreviousBlock.Bytes()
 	buf.Write(previous)
 
-	// sha256(previous block, merkle root)
-	root := block.MerkleTree().MerkleRoot()
-	hash := sha256.New()
-	hash.Write(previous)
-	hash.Write(root)
-	buf.Write(hash.Sum(nil))
+	// sha256(previous block, merkle root, state root)
+	buf.Write(BlockHash(block.PreviousBlock, block.MerkleTree().MerkleRoot(), block.StateRoot))
+
+	// state root
+	buf.Write(block.StateRoot[:])
 	// end of reader
 
 	// the transactions go here now
@@ -115,6 +117,16 @@ func (block Block) Serialize() []byte {
 	return buf.Bytes()
 }
 
+// BlockHash is what commits a block to its transactions and to the state they
+// lead to, it goes in the block right after the previous block id.
+func BlockHash(previous [20]byte, merkleRoot []byte, stateRoot [32]byte) []byte {
+	hash := sha256.New()
+	hash.Write(previous[:])
+	hash.Write(merkleRoot)
+	hash.Write(stateRoot[:])
+	return hash.Sum(nil)
+}
+
 type Transaction struct {
 	Type uint8
 
@@ -123,6 +135,11 @@ type Transaction struct {
 	Name        string
 	NameHash    [32]byte
 	PublishHash [20]byte
+	RecentBlock [20]byte
+
+	// all types except ACQUIRE must be signed by the current owner of the name
+	// and reference one of the latest blocks, so they can't be replayed later
+	Signature [64]byte
 }
 
 const (
@@ -133,31 +150,41 @@ const (
 )
 
 func ParseTransaction(serialized []byte) (tx Transaction, err error) {
+	if len(serialized) == 0 {
+		return tx, errors.New("empty transaction")
+	}
 	tx.Type = serialized[0]
 
 	switch tx.Type {
 	case TYPE_ACQUIRE:
-		if len(serialized) != 66 {
+		if len(serialized) != 65 {
 			return tx, errors.New("invalid transaction size")
 		}
 		copy(tx.Key[:], serialized[1:33])       // pubkey of the acquirer
-		copy(tx.NameHash[:], serialized[34:66]) // sha256(name)
+		copy(tx.NameHash[:], serialized[33:65]) // sha256(name)
 	case TYPE_TRANSFER:
-		if len(serialized) != 33 {
+		if len(serialized) != 149 {
 			return tx, errors.New("invalid transaction size")
 		}
-		copy(tx.NameHash[:], serialized[1:33]) // sha256(target_pubkey + name)
+		copy(tx.NameHash[:], serialized[1:33])     // sha256(name)
+		copy(tx.Key[:], serialized[33:65])         // pubkey of the new owner
+		copy(tx.RecentBlock[:], serialized[65:85]) // id of one of the latest blocks
+		copy(tx.Signature[:], serialized[85:149])
 	case TYPE_RENEW:
-		if len(serialized) != 66 {
+		if len(serialized) != 117 {
 			return tx, errors.New("invalid transaction size")
 		}
-		copy(tx.NameHash[:], serialized[1:33]) // sha256(previous_block_id + name)
+		copy(tx.NameHash[:], serialized[1:33])     // sha256(name)
+		copy(tx.RecentBlock[:], serialized[33:53]) // id of one of the latest blocks
+		copy(tx.Signature[:], serialized[53:117])
 	case TYPE_PUBLISH:
-		if len(serialized) < 23 || len(serialized) > 255 {
+		if len(serialized) < 106 || len(serialized) > 255 {
 			return tx, errors.New("invalid transaction size")
 		}
 		copy(tx.PublishHash[:], serialized[1:21])
-		tx.Name = string(serialized[22:])
+		copy(tx.RecentBlock[:], serialized[21:41]) // id of one of the latest blocks
+		copy(tx.Signature[:], serialized[41:105])
+		tx.Name = string(serialized[105:]) // the name is revealed here
 	default:
 		return tx, fmt.Errorf("unrecognized transaction type %d", tx.Type)
 	}
@@ -167,6 +194,26 @@ func ParseTransaction(serialized []byte) (tx Transaction, err error) {
 
 func (tx Transaction) Serialize() []byte {
 	buf := bytes.Buffer{}
+	buf.Write(tx.serializeUnsigned())
+
+	switch tx.Type {
+	case TYPE_TRANSFER, TYPE_RENEW:
+		buf.Write(tx.Signature[:])
+	case TYPE_PUBLISH:
+		// the name has variable length so it goes after the signature
+		unsigned := buf.Bytes()
+		signed := make([]byte, 0, len(unsigned)+64)
+		signed = append(signed, unsigned[0:41]...)
+		signed = append(signed, tx.Signature[:]...)
+		signed = append(signed, unsigned[41:]...)
+		return signed
+	}
+
+	return buf.Bytes()
+}
+
+func (tx Transaction) serializeUnsigned() []byte {
+	buf := bytes.Buffer{}
 
 	// type
 	buf.Write([]byte{tx.Type})
@@ -177,21 +224,49 @@ func (tx Transaction) Serialize() []byte {
 		buf.Write(tx.NameHash[:])
 	case TYPE_TRANSFER:
 		buf.Write(tx.NameHash[:])
+		buf.Write(tx.Key[:])
+		buf.Write(tx.RecentBlock[:])
 	case TYPE_RENEW:
 		buf.Write(tx.NameHash[:])
+		buf.Write(tx.RecentBlock[:])
 	case TYPE_PUBLISH:
 		buf.Write(tx.PublishHash[:])
+		buf.Write(tx.RecentBlock[:])
 		buf.Write([]byte(tx.Name))
 	}
 
 	return buf.Bytes()
 }
 
+// SigHash is what gets signed: the hash of the transaction without its signature.
+func (tx Transaction) SigHash() [32]byte {
+	return sha256.Sum256(tx.serializeUnsigned())
+}
+
+func (tx *Transaction) Sign(secretKey [32]byte) error {
+	sig, err := schnorr.Sign(new(big.Int).SetBytes(secretKey[:]), tx.SigHash(), nil)
+	if err != nil {
+		return err
+	}
+	tx.Signature = sig
+	return nil
+}
+
+func (tx Transaction) CheckSignature(key [32]byte) bool {
+	ok, _ := schnorr.Verify(key, tx.SigHash(), tx.Signature)
+	return ok
+}
+
 func (tx Transaction) CalculateHash() ([]byte, error) {
 	hash := sha256.Sum256(tx.Serialize())
 	return hash[:], nil
 }
 
+// Hash is the same as CalculateHash, but as an array so it can be used as a map key.
+func (tx Transaction) Hash() [32]byte {
+	return sha256.Sum256(tx.Serialize())
+}
+
 func (tx Transaction) Equals(other merkletree.Content) (bool, error) {
 	return bytes.Compare(tx.Serialize(), other.(Transaction).Serialize()) == 0, nil
 }
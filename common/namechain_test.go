@@ -0,0 +1,68 @@
+package common
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func TestTransactionRoundTrip(t *testing.T) {
+	sk := sha256.Sum256([]byte("owner"))
+	recent := [20]byte{9, 9, 9}
+
+	for _, tx := range []Transaction{
+		{Type: TYPE_ACQUIRE, Key: PublicKey(sk), NameHash: sha256.Sum256([]byte("a"))},
+		{Type: TYPE_TRANSFER, Key: [32]byte{1}, NameHash: sha256.Sum256([]byte("a")), RecentBlock: recent},
+		{Type: TYPE_RENEW, NameHash: sha256.Sum256([]byte("a")), RecentBlock: recent},
+		{Type: TYPE_PUBLISH, Name: "a", PublishHash: [20]byte{2}, RecentBlock: recent},
+	} {
+		if tx.Type != TYPE_ACQUIRE {
+			if err := tx.Sign(sk); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		parsed, err := ParseTransaction(tx.Serialize())
+		if err != nil {
+			t.Fatalf("type %d: %s", tx.Type, err)
+		}
+		if parsed != tx {
+			t.Fatalf("type %d: parsed %v, not %v", tx.Type, parsed, tx)
+		}
+		if tx.Type == TYPE_ACQUIRE {
+			continue
+		}
+
+		if !parsed.CheckSignature(PublicKey(sk)) {
+			t.Fatalf("type %d: signature doesn't check", tx.Type)
+		}
+		// the recent block is covered by the signature
+		parsed.RecentBlock[0]++
+		if parsed.CheckSignature(PublicKey(sk)) {
+			t.Fatalf("type %d: signature checks with another recent block", tx.Type)
+		}
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	block := Block{PreviousBlock: [20]byte{1, 2, 3}}
+	for i := 0; i < 5; i++ {
+		block.Transactions = append(block.Transactions, Transaction{
+			Type:     TYPE_ACQUIRE,
+			NameHash: sha256.Sum256([]byte{byte(i)}),
+		})
+	}
+
+	serialized := block.Serialize()
+	parsed, err := ParseBlock(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.PreviousBlock != block.PreviousBlock || len(parsed.Transactions) != 5 {
+		t.Fatalf("parsed block differs: %v", parsed)
+	}
+
+	serialized[len(serialized)-1]++
+	if _, err := ParseBlock(serialized); err == nil {
+		t.Fatal("a block with a changed transaction parsed")
+	}
+}
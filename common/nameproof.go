@@ -0,0 +1,213 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// NameProof is what a named gives to a client that doesn't want to trust it: the
+// data of a name (or that it has none) with a proof against the state root
+// committed in the block at some height, that block and the ones after it up
+// to one that was committed to in bitcoin, and the bitcoin transaction that
+// committed to it.
+type NameProof struct {
+	NameHash string `json:"namehash"`
+	Exists   bool   `json:"exists"`
+	Key      string `json:"key,omitempty"`
+	Name     string `json:"name,omitempty"`
+	InfoHash string `json:"infohash,omitempty"`
+
+	Height    int      `json:"height"`
+	StateRoot string   `json:"stateroot"`
+	Siblings  []string `json:"siblings"` // from the root down
+	// the name at the end of the path when it isn't this one
+	LeafNameHash string `json:"leafnamehash,omitempty"`
+	LeafDataHash string `json:"leafdatahash,omitempty"`
+
+	// serialized spacechain blocks from the one at height, each building on
+	// the one before, up to the one the bmm child commits to
+	Blocks     []string `json:"blocks"`
+	BMMChild   string   `json:"bmmchild"`   // the bitcoin tx with the last block's id in an OP_RETURN
+	TxOutProof string   `json:"txoutproof"` // from bitcoind's gettxoutproof for that tx
+}
+
+// NewNameProof assembles a proof, key is nil if the name has no data.
+func NewNameProof(nameHash [32]byte, key *[32]byte, name string, infohash [20]byte,
+	height int, root [32]byte, proof StateProof,
+	blocks [][]byte, child *wire.MsgTx, txOutProof []byte,
+) NameProof {
+	p := NameProof{
+		NameHash:   hex.EncodeToString(nameHash[:]),
+		Exists:     key != nil,
+		Height:     height,
+		StateRoot:  hex.EncodeToString(root[:]),
+		Siblings:   make([]string, len(proof.Siblings)),
+		Blocks:     make([]string, len(blocks)),
+		BMMChild:   EncodeTx(child),
+		TxOutProof: hex.EncodeToString(txOutProof),
+	}
+	if key != nil {
+		p.Key = hex.EncodeToString(key[:])
+		p.Name = name
+		p.InfoHash = hex.EncodeToString(infohash[:])
+	}
+	for i, sibling := range proof.Siblings {
+		p.Siblings[i] = hex.EncodeToString(sibling[:])
+	}
+	if proof.HasLeaf && proof.LeafKey != nameHash {
+		p.LeafNameHash = hex.EncodeToString(proof.LeafKey[:])
+		p.LeafDataHash = hex.EncodeToString(proof.LeafValueHash[:])
+	}
+	for i, block := range blocks {
+		p.Blocks[i] = hex.EncodeToString(block)
+	}
+	return p
+}
+
+// VerifyNameProof checks everything in the proof, offline, and returns the hash
+// of the bitcoin block it is anchored in. the bmm child must spend the anchor
+// of one of the links of chain, the bmm chain the caller follows, and it's up
+// to the caller to check that the bitcoin block is in the chain it follows.
+func VerifyNameProof(p NameProof, chain *BMMChain) (bitcoinBlock chainhash.Hash, err error) {
+	nameHash, err := decodeHash(p.NameHash)
+	if err != nil {
+		return bitcoinBlock, fmt.Errorf("namehash: %w", err)
+	}
+	root, err := decodeHash(p.StateRoot)
+	if err != nil {
+		return bitcoinBlock, fmt.Errorf("stateroot: %w", err)
+	}
+
+	// the name against the state root
+	proof := StateProof{Siblings: make([][32]byte, len(p.Siblings))}
+	for i, s := range p.Siblings {
+		if proof.Siblings[i], err = decodeHash(s); err != nil {
+			return bitcoinBlock, fmt.Errorf("sibling %d: %w", i, err)
+		}
+	}
+	var valueHash *[32]byte
+	if p.Exists {
+		key, err := decodeHash(p.Key)
+		if err != nil {
+			return bitcoinBlock, fmt.Errorf("key: %w", err)
+		}
+		b, err := hex.DecodeString(p.InfoHash)
+		if err != nil || len(b) != 20 {
+			return bitcoinBlock, errors.New("infohash must be 20 bytes of hex")
+		}
+		var infohash [20]byte
+		copy(infohash[:], b)
+		if p.Name != "" && sha256.Sum256([]byte(p.Name)) != nameHash {
+			return bitcoinBlock, errors.New("name doesn't match its hash")
+		}
+
+		hash := NameDataHash(key, p.Name, infohash)
+		valueHash = &hash
+		proof.HasLeaf = true
+		proof.LeafKey = nameHash
+		proof.LeafValueHash = hash
+	} else if p.LeafNameHash != "" {
+		proof.HasLeaf = true
+		if proof.LeafKey, err = decodeHash(p.LeafNameHash); err != nil {
+			return bitcoinBlock, fmt.Errorf("leafnamehash: %w", err)
+		}
+		if proof.LeafValueHash, err = decodeHash(p.LeafDataHash); err != nil {
+			return bitcoinBlock, fmt.Errorf("leafdatahash: %w", err)
+		}
+	}
+	if err := VerifyStateProof(root, nameHash, valueHash, proof); err != nil {
+		return bitcoinBlock, err
+	}
+
+	// the state root against the first block and the blocks against each other
+	if len(p.Blocks) == 0 {
+		return bitcoinBlock, errors.New("blocks are missing")
+	}
+	var block Block
+	for i, s := range p.Blocks {
+		serializedBlock, err := hex.DecodeString(s)
+		if err != nil {
+			return bitcoinBlock, fmt.Errorf("block %d is invalid hex", i)
+		}
+		next, err := ParseBlock(serializedBlock)
+		if err != nil {
+			return bitcoinBlock, fmt.Errorf("block %d: %w", i, err)
+		}
+		if i == 0 && next.StateRoot != root {
+			return bitcoinBlock, errors.New("stateroot isn't the one committed in the block")
+		}
+		if i > 0 && next.PreviousBlock != block.ID {
+			return bitcoinBlock, fmt.Errorf("block %d doesn't build on the one before it", i)
+		}
+		block = next
+	}
+
+	// the last block against the bmm child and the child against the bmm chain
+	child, err := decodeTx(p.BMMChild)
+	if err != nil {
+		return bitcoinBlock, fmt.Errorf("bmmchild: %w", err)
+	}
+	committed := false
+	for _, out := range child.TxOut {
+		if blockId, ok := ParseBMMBlockId(out.PkScript); ok && blockId == block.ID {
+			committed = true
+			break
+		}
+	}
+	if !committed {
+		return bitcoinBlock, errors.New("bmmchild doesn't commit to the last block")
+	}
+	if !spendsBMMAnchor(child, chain) {
+		return bitcoinBlock, errors.New("bmmchild doesn't spend the anchor of a link of the bmm chain")
+	}
+
+	// the bmm child against the bitcoin block
+	b, err := hex.DecodeString(p.TxOutProof)
+	if err != nil {
+		return bitcoinBlock, errors.New("txoutproof is invalid hex")
+	}
+	mb, err := ParseTxOutProof(b)
+	if err != nil {
+		return bitcoinBlock, fmt.Errorf("txoutproof: %w", err)
+	}
+	matched, err := VerifyTxOutProof(mb)
+	if err != nil {
+		return bitcoinBlock, err
+	}
+	childHash := child.TxHash()
+	for _, txid := range matched {
+		if txid == childHash {
+			return mb.Header.BlockHash(), nil
+		}
+	}
+	return bitcoinBlock, errors.New("txoutproof doesn't include bmmchild")
+}
+
+func spendsBMMAnchor(child *wire.MsgTx, chain *BMMChain) bool {
+	if chain == nil {
+		return false
+	}
+	for _, link := range chain.Links {
+		anchor := wire.OutPoint{Hash: link.TxHash(), Index: 1}
+		for _, inp := range child.TxIn {
+			if inp.PreviousOutPoint == anchor {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeHash(s string) (hash [32]byte, err error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		return hash, errors.New("must be 32 bytes of hex")
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
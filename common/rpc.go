@@ -1,9 +1,20 @@
 package common
 
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
 type RPCRequest struct {
-	ID     interface{}            `json:"id"`
-	Method string                 `json:"method"`
-	Params map[string]interface{} `json:"params"`
+	ID     interface{} `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"` // either an object or an array
 }
 
 type RPCResponse struct {
@@ -15,3 +26,55 @@ type RPCResponse struct {
 		Data    interface{} `json:"data"`
 	} `json:"error,omitempty"`
 }
+
+const (
+	// like bitcoind, named writes a random password to this file in the datadir
+	// every time it starts, so local clients can authenticate without configuration.
+	COOKIE_FILE = ".cookie"
+	COOKIE_USER = "__cookie__"
+)
+
+func WriteCookie(dataDir string) (password string, err error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	password = hex.EncodeToString(random)
+
+	path := filepath.Join(dataDir, COOKIE_FILE)
+	if err := ioutil.WriteFile(path, []byte(COOKIE_USER+":"+password), 0600); err != nil {
+		return "", err
+	}
+
+	return password, nil
+}
+
+func ReadCookie(dataDir string) (user string, password string, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, COOKIE_FILE))
+	if err != nil {
+		return "", "", err
+	}
+
+	spl := strings.SplitN(strings.TrimSpace(string(data)), ":", 2)
+	if len(spl) != 2 {
+		return "", "", errors.New("malformed cookie file")
+	}
+
+	return spl[0], spl[1], nil
+}
+
+// RPCAuthHash returns the value that goes in the 'hash' field of an 'rpc-auth'
+// config entry, in the format '<salt>$<hex hmac-sha256(salt, password)>'.
+func RPCAuthHash(salt string, password string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(password))
+	return salt + "$" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func CheckRPCAuthHash(hash string, password string) bool {
+	spl := strings.SplitN(hash, "$", 2)
+	if len(spl) != 2 {
+		return false
+	}
+	return hmac.Equal([]byte(RPCAuthHash(spl[0], password)), []byte(hash))
+}
@@ -0,0 +1,260 @@
+package common
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// StateTree is a sparse merkle tree over all the names, keyed by name hash, so
+// nodes can compare their chainstates by a single root and clients can check a
+// name against that root with a proof.
+//
+// it is the compact kind: an empty subtree hashes to 32 zero bytes, a subtree
+// with a single name hashes to that name's leaf hash, wherever it is, and
+// only subtrees with two or more names have inner nodes:
+//
+//	leaf  = sha256(0x00 || name hash || sha256(name data))
+//	inner = sha256(0x01 || left || right)
+//
+// so a path is only as long as needed to tell its name apart from the others.
+//
+// nodes are never changed once made, a change makes new nodes along its path,
+// so a copy of the tree is just a copy of its root and can be changed freely.
+type StateTree struct {
+	root *stateNode
+	size int
+}
+
+type stateNode struct {
+	hash [32]byte
+
+	// inner nodes have children (one of them may be nil), leaves don't
+	left, right *stateNode
+
+	leaf      bool
+	key       [32]byte
+	valueHash [32]byte
+}
+
+func NewStateTree() *StateTree {
+	return &StateTree{}
+}
+
+// NameDataHash is the hash of a name's data that goes in its leaf, the data is
+// serialized as key || infohash || name.
+func NameDataHash(key [32]byte, name string, infohash [20]byte) [32]byte {
+	v := make([]byte, 52+len(name))
+	copy(v[0:32], key[:])
+	copy(v[32:52], infohash[:])
+	copy(v[52:], name)
+	return sha256.Sum256(v)
+}
+
+func stateLeafHash(key [32]byte, valueHash [32]byte) (hash [32]byte) {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(key[:])
+	h.Write(valueHash[:])
+	copy(hash[:], h.Sum(nil))
+	return hash
+}
+
+func stateInnerHash(left, right [32]byte) (hash [32]byte) {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left[:])
+	h.Write(right[:])
+	copy(hash[:], h.Sum(nil))
+	return hash
+}
+
+// pathBit returns the bit of key at depth, starting from the most significant.
+func pathBit(key [32]byte, depth int) int {
+	return int(key[depth/8]>>(7-uint(depth%8))) & 1
+}
+
+func (n *stateNode) nodeHash() [32]byte {
+	if n == nil {
+		return [32]byte{}
+	}
+	return n.hash
+}
+
+func (n *stateNode) rehash() {
+	n.hash = stateInnerHash(n.left.nodeHash(), n.right.nodeHash())
+}
+
+// Copy returns a tree that starts with the same names as this one.
+func (t *StateTree) Copy() *StateTree {
+	return &StateTree{root: t.root, size: t.size}
+}
+
+// Root is the hash of the whole tree, 32 zero bytes if it's empty.
+func (t *StateTree) Root() [32]byte {
+	return t.root.nodeHash()
+}
+
+// Len is how many names are in the tree.
+func (t *StateTree) Len() int {
+	return t.size
+}
+
+// Set adds a name or changes its data.
+func (t *StateTree) Set(key [32]byte, valueHash [32]byte) {
+	t.root = t.insert(t.root, 0, &stateNode{
+		hash:      stateLeafHash(key, valueHash),
+		leaf:      true,
+		key:       key,
+		valueHash: valueHash,
+	})
+}
+
+func (t *StateTree) insert(n *stateNode, depth int, leaf *stateNode) *stateNode {
+	switch {
+	case n == nil:
+		t.size++
+		return leaf
+	case n.leaf && n.key == leaf.key:
+		return leaf
+	case n.leaf:
+		// the two leaves go down until their paths split
+		t.size++
+		return splitLeaves(n, leaf, depth)
+	}
+
+	c := *n
+	if pathBit(leaf.key, depth) == 0 {
+		c.left = t.insert(n.left, depth+1, leaf)
+	} else {
+		c.right = t.insert(n.right, depth+1, leaf)
+	}
+	c.rehash()
+	return &c
+}
+
+func splitLeaves(a, b *stateNode, depth int) *stateNode {
+	n := &stateNode{}
+	switch {
+	case pathBit(a.key, depth) == pathBit(b.key, depth) && pathBit(a.key, depth) == 0:
+		n.left = splitLeaves(a, b, depth+1)
+	case pathBit(a.key, depth) == pathBit(b.key, depth):
+		n.right = splitLeaves(a, b, depth+1)
+	case pathBit(a.key, depth) == 0:
+		n.left, n.right = a, b
+	default:
+		n.left, n.right = b, a
+	}
+	n.rehash()
+	return n
+}
+
+// Delete removes a name, if it's there.
+func (t *StateTree) Delete(key [32]byte) {
+	t.root = t.remove(t.root, 0, key)
+}
+
+func (t *StateTree) remove(n *stateNode, depth int, key [32]byte) *stateNode {
+	switch {
+	case n == nil:
+		return nil
+	case n.leaf && n.key == key:
+		t.size--
+		return nil
+	case n.leaf:
+		return n
+	}
+
+	c := *n
+	if pathBit(key, depth) == 0 {
+		c.left = t.remove(n.left, depth+1, key)
+	} else {
+		c.right = t.remove(n.right, depth+1, key)
+	}
+
+	// a single leaf left in this subtree takes its place
+	switch {
+	case c.left == nil && c.right == nil:
+		return nil
+	case c.left == nil && c.right.leaf:
+		return c.right
+	case c.right == nil && c.left.leaf:
+		return c.left
+	}
+	c.rehash()
+	return &c
+}
+
+// StateProof shows what the tree has at the end of the path of a name hash:
+// that name, another name that has the same path so far, or nothing.
+type StateProof struct {
+	// the hashes of the other side at each depth, from the root down
+	Siblings [][32]byte
+
+	HasLeaf       bool
+	LeafKey       [32]byte
+	LeafValueHash [32]byte
+}
+
+// Prove returns the proof for key, which may or may not be in the tree.
+func (t *StateTree) Prove(key [32]byte) (proof StateProof) {
+	n := t.root
+	for depth := 0; n != nil && !n.leaf; depth++ {
+		if pathBit(key, depth) == 0 {
+			proof.Siblings = append(proof.Siblings, n.right.nodeHash())
+			n = n.left
+		} else {
+			proof.Siblings = append(proof.Siblings, n.left.nodeHash())
+			n = n.right
+		}
+	}
+
+	if n != nil {
+		proof.HasLeaf = true
+		proof.LeafKey = n.key
+		proof.LeafValueHash = n.valueHash
+	}
+	return proof
+}
+
+// VerifyStateProof checks a proof against a state root. if valueHash is nil it
+// checks that key isn't in the tree, otherwise that it is there with that data.
+func VerifyStateProof(root [32]byte, key [32]byte, valueHash *[32]byte, proof StateProof) error {
+	if len(proof.Siblings) > 256 {
+		return errors.New("state proof is too long")
+	}
+
+	switch {
+	case valueHash != nil && (!proof.HasLeaf || proof.LeafKey != key):
+		return errors.New("state proof doesn't have this name")
+	case valueHash != nil && proof.LeafValueHash != *valueHash:
+		return errors.New("state proof has other data for this name")
+	case valueHash == nil && proof.HasLeaf && proof.LeafKey == key:
+		return errors.New("state proof has this name")
+	}
+
+	// any other leaf at the end of the path must share it so far
+	if proof.HasLeaf {
+		for depth := range proof.Siblings {
+			if pathBit(proof.LeafKey, depth) != pathBit(key, depth) {
+				return errors.New("state proof ends at a name with another path")
+			}
+		}
+	}
+
+	var hash [32]byte
+	if proof.HasLeaf {
+		hash = stateLeafHash(proof.LeafKey, proof.LeafValueHash)
+	}
+	for depth := len(proof.Siblings) - 1; depth >= 0; depth-- {
+		if pathBit(key, depth) == 0 {
+			hash = stateInnerHash(hash, proof.Siblings[depth])
+		} else {
+			hash = stateInnerHash(proof.Siblings[depth], hash)
+		}
+	}
+
+	if hash != root {
+		return errors.New("state proof doesn't lead to the state root")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func testNames(n int) [][32]byte {
+	keys := make([][32]byte, n)
+	for i := range keys {
+		keys[i] = sha256.Sum256([]byte{byte(i), byte(i >> 8)})
+	}
+	return keys
+}
+
+func TestStateTreeProofs(t *testing.T) {
+	tree := NewStateTree()
+	keys := testNames(50)
+	for i, key := range keys[:40] {
+		tree.Set(key, [32]byte{byte(i)})
+	}
+	root := tree.Root()
+
+	for i, key := range keys[:40] {
+		value := [32]byte{byte(i)}
+		if err := VerifyStateProof(root, key, &value, tree.Prove(key)); err != nil {
+			t.Fatalf("name %d: %s", i, err)
+		}
+		other := [32]byte{byte(i + 1)}
+		if err := VerifyStateProof(root, key, &other, tree.Prove(key)); err == nil {
+			t.Fatalf("name %d: proof checked with other data", i)
+		}
+		if err := VerifyStateProof(root, key, nil, tree.Prove(key)); err == nil {
+			t.Fatalf("name %d: proof of absence checked for a name that is there", i)
+		}
+	}
+	for i, key := range keys[40:] {
+		if err := VerifyStateProof(root, key, nil, tree.Prove(key)); err != nil {
+			t.Fatalf("missing name %d: %s", i, err)
+		}
+	}
+}
+
+func TestStateTreeRootDoesntDependOnOrder(t *testing.T) {
+	keys := testNames(30)
+
+	a := NewStateTree()
+	for _, key := range keys {
+		a.Set(key, key)
+	}
+	for _, key := range keys[10:20] {
+		a.Delete(key)
+	}
+
+	b := NewStateTree()
+	for i := len(keys) - 1; i >= 0; i-- {
+		if i < 10 || i >= 20 {
+			b.Set(keys[i], keys[i])
+		}
+	}
+
+	if a.Root() != b.Root() || a.Len() != 20 || b.Len() != 20 {
+		t.Fatalf("roots differ: %x (%d) and %x (%d)", a.Root(), a.Len(), b.Root(), b.Len())
+	}
+}
+
+func TestStateTreeCopy(t *testing.T) {
+	keys := testNames(20)
+	tree := NewStateTree()
+	for _, key := range keys[:10] {
+		tree.Set(key, key)
+	}
+	root := tree.Root()
+
+	scratch := tree.Copy()
+	for _, key := range keys[10:] {
+		scratch.Set(key, key)
+	}
+	scratch.Delete(keys[0])
+	scratch.Set(keys[1], [32]byte{})
+
+	if tree.Root() != root || tree.Len() != 10 {
+		t.Fatal("changing a copy changed the tree")
+	}
+	if scratch.Len() != 19 || scratch.Root() == root {
+		t.Fatal("copy didn't change")
+	}
+}
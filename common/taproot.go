@@ -0,0 +1,211 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// just enough of BIP340/BIP341 to create and spend a P2TR output with a single
+// script leaf and no key path, since btcd doesn't know about taproot yet.
+
+const TAPROOT_LEAF_VERSION = 0xc0
+
+// the BIP341 "nothing up my sleeve" point, nobody knows its discrete log so an
+// output with it as the internal key can only be spent through its scripts.
+var taprootNUMS, _ = parseXOnly(mustHex(
+	"50929b74c1a04954b78b4b6035e97a5e078a5a0f28ec96d547bfee9ace803ac0"))
+
+// TaprootLeaf is a single-leaf, script-path-only taproot output.
+type TaprootLeaf struct {
+	Script       []byte
+	OutputKey    [32]byte
+	ControlBlock []byte
+}
+
+// NewTaprootLeaf commits to script under the NUMS internal key.
+func NewTaprootLeaf(script []byte) TaprootLeaf {
+	return newTaprootLeaf(taprootNUMS, script)
+}
+
+func newTaprootLeaf(internalKey *btcec.PublicKey, script []byte) TaprootLeaf {
+	leafHash := TapLeafHash(script)
+	internal := xOnly(internalKey.X)
+
+	t := new(big.Int).SetBytes(taggedHash("TapTweak", internal[:], leafHash[:]))
+	tx, ty := btcec.S256().ScalarBaseMult(scalar(t))
+	qx, qy := btcec.S256().Add(internalKey.X, internalKey.Y, tx, ty)
+
+	controlBlock := make([]byte, 33)
+	controlBlock[0] = TAPROOT_LEAF_VERSION | byte(qy.Bit(0))
+	copy(controlBlock[1:], internal[:])
+
+	return TaprootLeaf{
+		Script:       script,
+		OutputKey:    xOnly(qx),
+		ControlBlock: controlBlock,
+	}
+}
+
+func (leaf TaprootLeaf) PkScript() []byte {
+	script, _ := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_1).
+		AddData(leaf.OutputKey[:]).
+		Script()
+	return script
+}
+
+// Witness spends the leaf with a single signature.
+func (leaf TaprootLeaf) Witness(sig [64]byte) wire.TxWitness {
+	return wire.TxWitness{sig[:], leaf.Script, leaf.ControlBlock}
+}
+
+// CheckSigScript is a leaf that requires a signature from the x-only key pk.
+func CheckSigScript(pk *btcec.PublicKey) []byte {
+	x := xOnly(pk.X)
+	script, _ := txscript.NewScriptBuilder().
+		AddData(x[:]).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+	return script
+}
+
+func TapLeafHash(script []byte) [32]byte {
+	var buf bytes.Buffer
+	buf.WriteByte(TAPROOT_LEAF_VERSION)
+	wire.WriteVarBytes(&buf, 0, script)
+
+	var hash [32]byte
+	copy(hash[:], taggedHash("TapLeaf", buf.Bytes()))
+	return hash
+}
+
+// TaprootScriptSigHash is the BIP341 SIGHASH_DEFAULT message for spending input
+// idx through the leaf with the given hash. prevouts must describe every input.
+func TaprootScriptSigHash(tx *wire.MsgTx, idx int, prevouts []PrevOut, leafHash [32]byte) ([32]byte, error) {
+	var hash [32]byte
+	if len(prevouts) != len(tx.TxIn) {
+		return hash, errors.New("need a prevout for every input")
+	}
+
+	var outpoints, amounts, scripts, sequences, outputs bytes.Buffer
+	for i, in := range tx.TxIn {
+		outpoints.Write(in.PreviousOutPoint.Hash[:])
+		binary.Write(&outpoints, binary.LittleEndian, in.PreviousOutPoint.Index)
+		binary.Write(&amounts, binary.LittleEndian, prevouts[i].Value)
+		wire.WriteVarBytes(&scripts, 0, prevouts[i].PkScript)
+		binary.Write(&sequences, binary.LittleEndian, in.Sequence)
+	}
+	for _, out := range tx.TxOut {
+		wire.WriteTxOut(&outputs, 0, 0, out)
+	}
+
+	var msg bytes.Buffer
+	msg.WriteByte(0x00) // epoch
+	msg.WriteByte(0x00) // SIGHASH_DEFAULT
+	binary.Write(&msg, binary.LittleEndian, tx.Version)
+	binary.Write(&msg, binary.LittleEndian, tx.LockTime)
+	msg.Write(sha256Sum(outpoints.Bytes()))
+	msg.Write(sha256Sum(amounts.Bytes()))
+	msg.Write(sha256Sum(scripts.Bytes()))
+	msg.Write(sha256Sum(sequences.Bytes()))
+	msg.Write(sha256Sum(outputs.Bytes()))
+	msg.WriteByte(0x02) // script path, no annex
+	binary.Write(&msg, binary.LittleEndian, uint32(idx))
+	msg.Write(leafHash[:])
+	msg.WriteByte(0x00)                                         // key version
+	binary.Write(&msg, binary.LittleEndian, uint32(0xffffffff)) // no OP_CODESEPARATOR
+
+	copy(hash[:], taggedHash("TapSighash", msg.Bytes()))
+	return hash, nil
+}
+
+// SchnorrSign is BIP340 signing with an all-zeros aux, so it's deterministic.
+func SchnorrSign(sk *btcec.PrivateKey, msg [32]byte) ([64]byte, error) {
+	var aux [32]byte
+	return schnorrSign(sk, msg, aux)
+}
+
+func schnorrSign(sk *btcec.PrivateKey, msg [32]byte, aux [32]byte) ([64]byte, error) {
+	var sig [64]byte
+	curve := btcec.S256()
+
+	d := new(big.Int).Set(sk.D)
+	px, py := curve.ScalarBaseMult(scalar(d))
+	if py.Bit(0) == 1 {
+		d.Sub(curve.N, d)
+	}
+	pxb := xOnly(px)
+
+	t := new(big.Int).Xor(d, new(big.Int).SetBytes(taggedHash("BIP0340/aux", aux[:])))
+	k := new(big.Int).SetBytes(taggedHash("BIP0340/nonce", scalar(t), pxb[:], msg[:]))
+	k.Mod(k, curve.N)
+	if k.Sign() == 0 {
+		return sig, errors.New("invalid nonce")
+	}
+
+	rx, ry := curve.ScalarBaseMult(scalar(k))
+	if ry.Bit(0) == 1 {
+		k.Sub(curve.N, k)
+	}
+	rxb := xOnly(rx)
+
+	e := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", rxb[:], pxb[:], msg[:]))
+	e.Mod(e, curve.N)
+
+	s := new(big.Int).Mul(e, d)
+	s.Add(s, k)
+	s.Mod(s, curve.N)
+
+	copy(sig[:32], rxb[:])
+	copy(sig[32:], scalar(s))
+	return sig, nil
+}
+
+func taggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func sha256Sum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+func scalar(i *big.Int) []byte {
+	b := make([]byte, 32)
+	ib := i.Bytes()
+	copy(b[32-len(ib):], ib)
+	return b
+}
+
+func xOnly(x *big.Int) (b [32]byte) {
+	copy(b[:], scalar(x))
+	return b
+}
+
+// parseXOnly lifts an x coordinate to the point with even y.
+func parseXOnly(x []byte) (*btcec.PublicKey, error) {
+	return btcec.ParsePubKey(append([]byte{0x02}, x...), btcec.S256())
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/fiatjaf/schnorr"
+)
+
+// the signing vectors from bip-0340/test-vectors.csv.
+func TestSchnorrSignBIP340Vectors(t *testing.T) {
+	for i, v := range []struct {
+		secretKey string
+		publicKey string
+		aux       string
+		message   string
+		signature string
+	}{
+		{
+			"0000000000000000000000000000000000000000000000000000000000000003",
+			"F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0",
+		},
+		{
+			"B7E151628AED2A6ABF7158809CF4F3C762E7160F38B4DA56A784D9045190CFEF",
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"6896BD60EEAE296DB48A229FF71DFE071BDE413E6D43F917DC8DCF8C78DE33418906D11AC976ABCCB20B091292BFF4EA897EFCB639EA871CFA95F6DE339E4B0A",
+		},
+		{
+			"C90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B14E5C9",
+			"DD308AFEC5777E13121FA72B9CC1B7CC0139715309B086C960E18FD969774EB8",
+			"C87AA53824B4D7AE2EB035A2B5BBBCCC080E76CDC6D1692C4B0B62D798E6D906",
+			"7E2D58D8B3BCDF1ABADEC7829054F90DDA9805AAB56C77333024B9D0A508B75C",
+			"5831AAEED7B44BB74E5EAB94BA9D4294C49BCF2A60728D8B4C200F50DD313C1BAB745879A5AD954A72C45A91C3A51D3C7ADEA98D82F8481E0E1E03674A6F3FB7",
+		},
+		{
+			"0B432B2677937381AEF05BB02A66ECD012773062CF3FA2549E44F58ED2401710",
+			"25D1DFF95105F5253C4022F628A996AD3A0D95FBF21D468A1B33F8C160D8F517",
+			"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+			"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+			"7EB0509757E246F19449885651611CB965ECC1A187DD51B64FDA1EDC9637D5EC97582B9CB13DB3933705B32BA982AF5AF25FD78881EBB32771FC5922EFC66EA3",
+		},
+	} {
+		sk, pk := btcec.PrivKeyFromBytes(btcec.S256(), mustHex(v.secretKey))
+		if x := xOnly(pk.X); !strings.EqualFold(hex.EncodeToString(x[:]), v.publicKey) {
+			t.Fatalf("vector %d: public key is %x", i, x)
+		}
+
+		var aux, msg [32]byte
+		copy(aux[:], mustHex(v.aux))
+		copy(msg[:], mustHex(v.message))
+		sig, err := schnorrSign(sk, msg, aux)
+		if err != nil {
+			t.Fatalf("vector %d: %v", i, err)
+		}
+		if !strings.EqualFold(hex.EncodeToString(sig[:]), v.signature) {
+			t.Fatalf("vector %d: signature is %x", i, sig)
+		}
+	}
+}
+
+func TestTaprootScriptSigHashCommitsToTheSpend(t *testing.T) {
+	chain := deriveTestChain(t, BMM_FORMAT_P2TR, 2)
+	link := chain.Links[1]
+	prev := chain.Links[0]
+	prevouts := []PrevOut{{link.TxIn[0].PreviousOutPoint, prev.TxOut[0].PkScript, prev.TxOut[0].Value}}
+
+	// the link signature verifies against the key in the leaf
+	leafScript := link.TxIn[0].Witness[1]
+	sighash, err := TaprootScriptSigHash(link, 0, prevouts, TapLeafHash(leafScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pk [32]byte
+	var sig [64]byte
+	copy(pk[:], leafScript[1:33])
+	copy(sig[:], link.TxIn[0].Witness[0])
+	if ok, err := schnorr.Verify(pk, sighash, sig); !ok {
+		t.Fatalf("link signature doesn't verify: %v", err)
+	}
+
+	// and anything it signs changes the message
+	for name, change := range map[string]func(tx *wire.MsgTx, prevouts []PrevOut){
+		"amount":   func(tx *wire.MsgTx, prevouts []PrevOut) { prevouts[0].Value++ },
+		"script":   func(tx *wire.MsgTx, prevouts []PrevOut) { prevouts[0].PkScript = []byte{1} },
+		"sequence": func(tx *wire.MsgTx, prevouts []PrevOut) { tx.TxIn[0].Sequence++ },
+		"output":   func(tx *wire.MsgTx, prevouts []PrevOut) { tx.TxOut[1].Value++ },
+		"locktime": func(tx *wire.MsgTx, prevouts []PrevOut) { tx.LockTime++ },
+	} {
+		tx := link.Copy()
+		changed := append([]PrevOut(nil), prevouts...)
+		change(tx, changed)
+		if again, _ := TaprootScriptSigHash(tx, 0, changed, TapLeafHash(leafScript)); again == sighash {
+			t.Fatalf("sighash doesn't commit to the %s", name)
+		}
+	}
+	other := TapLeafHash([]byte{txscript.OP_TRUE})
+	if again, _ := TaprootScriptSigHash(link, 0, prevouts, other); again == sighash {
+		t.Fatal("sighash doesn't commit to the leaf")
+	}
+}
@@ -37,7 +37,17 @@ func TorrentClient(config *Config) (*torrent.Client, error) {
 }
 
 func blockTorrentHash(serializedBlock []byte) (metainfo.Hash, error) {
-	mi := metainfo.MetaInfo{
+	mi, err := BlockTorrent(serializedBlock)
+	if err != nil {
+		return metainfo.Hash{}, err
+	}
+	return mi.HashInfoBytes(), nil
+}
+
+// BlockTorrent is the torrent a block is published as, its infohash is the block
+// ID. the block is a single file named after its sha256 hex.
+func BlockTorrent(serializedBlock []byte) (*metainfo.MetaInfo, error) {
+	mi := &metainfo.MetaInfo{
 		AnnounceList: make([][]string, 0),
 	}
 
@@ -55,14 +65,31 @@ func blockTorrentHash(serializedBlock []byte) (metainfo.Hash, error) {
 		return ioutil.NopCloser(bytes.NewBuffer(serializedBlock)), nil
 	})
 	if err != nil {
+		return nil, err
+	}
+
+	mi.InfoBytes, err = bencode.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	return mi, nil
+}
+
+// FileInfoHash returns the infohash of the torrent for a file or directory, so
+// it can be published for a name.
+func FileInfoHash(path string) (metainfo.Hash, error) {
+	mi := metainfo.MetaInfo{}
+	info := metainfo.Info{PieceLength: 256 * 1024}
+	if err := info.BuildFromFilePath(path); err != nil {
 		return metainfo.Hash{}, err
 	}
 
+	var err error
 	mi.InfoBytes, err = bencode.Marshal(info)
 	if err != nil {
 		return metainfo.Hash{}, err
 	}
 
-	infohash := mi.HashInfoBytes()
-	return infohash, nil
+	return mi.HashInfoBytes(), nil
 }
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// GetTxOutProof asks bitcoind for the merkle proof that a transaction is in a
+// block, serialized like a merkleblock message.
+func GetTxOutProof(bitcoin BitcoinBackend, txid chainhash.Hash, blockHash chainhash.Hash) ([]byte, error) {
+	var res string
+	if err := rawRequest(bitcoin, "gettxoutproof", &res,
+		[]string{txid.String()}, blockHash.String()); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(res)
+}
+
+func ParseTxOutProof(b []byte) (*wire.MsgMerkleBlock, error) {
+	mb := &wire.MsgMerkleBlock{}
+	if err := mb.BtcDecode(bytes.NewReader(b), wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return nil, err
+	}
+	return mb, nil
+}
+
+// VerifyTxOutProof walks the partial merkle tree of a merkleblock like bitcoind
+// does and returns the transactions it proves are in the block.
+func VerifyTxOutProof(mb *wire.MsgMerkleBlock) (matched []chainhash.Hash, err error) {
+	n := int(mb.Transactions)
+	if n == 0 {
+		return nil, errors.New("merkle proof has no transactions")
+	}
+	// no block has more transactions than fit in it with 60 bytes each
+	if n > wire.MaxBlockPayload/60 {
+		return nil, errors.New("merkle proof has too many transactions")
+	}
+	if len(mb.Hashes) > n {
+		return nil, errors.New("merkle proof has more hashes than transactions")
+	}
+	if len(mb.Flags)*8 < len(mb.Hashes) {
+		return nil, errors.New("merkle proof has less flags than hashes")
+	}
+
+	width := func(height uint) int {
+		return (n + (1 << height) - 1) >> height
+	}
+	var height uint
+	for width(height) > 1 {
+		height++
+	}
+
+	var usedBits, usedHashes int
+	var traverse func(height uint, pos int) (chainhash.Hash, error)
+	traverse = func(height uint, pos int) (chainhash.Hash, error) {
+		if usedBits >= len(mb.Flags)*8 {
+			return chainhash.Hash{}, errors.New("merkle proof ran out of flags")
+		}
+		parentOfMatch := mb.Flags[usedBits/8]&(1<<uint(usedBits%8)) != 0
+		usedBits++
+
+		if height == 0 || !parentOfMatch {
+			if usedHashes >= len(mb.Hashes) {
+				return chainhash.Hash{}, errors.New("merkle proof ran out of hashes")
+			}
+			hash := *mb.Hashes[usedHashes]
+			usedHashes++
+			if height == 0 && parentOfMatch {
+				matched = append(matched, hash)
+			}
+			return hash, nil
+		}
+
+		left, err := traverse(height-1, pos*2)
+		if err != nil {
+			return left, err
+		}
+		right := left
+		if pos*2+1 < width(height-1) {
+			if right, err = traverse(height-1, pos*2+1); err != nil {
+				return right, err
+			}
+			// the same trick as CVE-2012-2459 would let a proof show a tx twice
+			if right == left {
+				return right, errors.New("merkle proof has a duplicated branch")
+			}
+		}
+		return chainhash.DoubleHashH(append(left[:], right[:]...)), nil
+	}
+
+	root, err := traverse(height, 0)
+	if err != nil {
+		return nil, err
+	}
+	if usedHashes != len(mb.Hashes) {
+		return nil, errors.New("merkle proof has hashes left over")
+	}
+	if (usedBits+7)/8 != len(mb.Flags) {
+		return nil, errors.New("merkle proof has flags left over")
+	}
+	if root != mb.Header.MerkleRoot {
+		return nil, errors.New("merkle proof doesn't lead to the block's merkle root")
+	}
+
+	return matched, nil
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// TxProof shows that a transaction is in a block: the merkle path from it to the
+// block's merkle root and what else the block hash is made of. the block hash goes
+// right after the previous block id at the start of the serialized block, so
+// it can be checked against any copy of the block.
+type TxProof struct {
+	Tx            string   `json:"tx"`
+	Block         string   `json:"block"` // id
+	Height        int      `json:"height"`
+	PreviousBlock string   `json:"previous"`
+	MerkleRoot    string   `json:"merkleroot"`
+	StateRoot     string   `json:"stateroot"`
+	BlockHash     string   `json:"blockhash"` // sha256(previous, merkleroot, stateroot)
+	Path          []string `json:"path"`      // sibling hashes from the transaction up
+	Index         []int64  `json:"index"`     // 1 where the sibling is on the right
+}
+
+func NewTxProof(block Block, height int, tx Transaction) (p TxProof, err error) {
+	path, index, err := block.MerkleTree().GetMerklePath(tx)
+	if err != nil {
+		return p, err
+	}
+	if path == nil {
+		return p, errors.New("transaction isn't in the block")
+	}
+
+	p = TxProof{
+		Tx:            hex.EncodeToString(tx.Serialize()),
+		Block:         block.ID.HexString(),
+		Height:        height,
+		PreviousBlock: block.PreviousBlock.HexString(),
+		MerkleRoot:    hex.EncodeToString(block.MerkleRoot),
+		StateRoot:     hex.EncodeToString(block.StateRoot[:]),
+		BlockHash:     hex.EncodeToString(block.BlockHash),
+		Path:          make([]string, len(path)),
+		Index:         index,
+	}
+	for i, sibling := range path {
+		p.Path[i] = hex.EncodeToString(sibling)
+	}
+	return p, nil
+}
+
+// VerifyTxProof checks that the transaction leads to the merkle root and that
+// the block hash comes from it. it's up to the caller to check that the block
+// hash is the one of a block it knows.
+func VerifyTxProof(p TxProof) (tx Transaction, err error) {
+	rawTx, err := hex.DecodeString(p.Tx)
+	if err != nil {
+		return tx, errors.New("tx is invalid hex")
+	}
+	if tx, err = ParseTransaction(rawTx); err != nil {
+		return tx, err
+	}
+	if len(p.Path) == 0 {
+		// even a block with a single transaction has it paired with itself
+		return tx, errors.New("path is empty")
+	}
+	if len(p.Path) != len(p.Index) {
+		return tx, errors.New("path and index have different lengths")
+	}
+
+	hash, _ := tx.CalculateHash()
+	for i, s := range p.Path {
+		sibling, err := hex.DecodeString(s)
+		if err != nil || len(sibling) != sha256.Size {
+			return tx, fmt.Errorf("path %d must be 32 bytes of hex", i)
+		}
+
+		h := sha256.New()
+		switch p.Index[i] {
+		case 1:
+			h.Write(hash)
+			h.Write(sibling)
+		case 0:
+			h.Write(sibling)
+			h.Write(hash)
+		default:
+			return tx, fmt.Errorf("index %d must be 0 or 1", i)
+		}
+		hash = h.Sum(nil)
+	}
+
+	root, err := hex.DecodeString(p.MerkleRoot)
+	if err != nil || !bytes.Equal(root, hash) {
+		return tx, errors.New("path doesn't lead to the merkle root")
+	}
+
+	b, err := hex.DecodeString(p.PreviousBlock)
+	if err != nil || len(b) != 20 {
+		return tx, errors.New("previous must be 20 bytes of hex")
+	}
+	var previous [20]byte
+	copy(previous[:], b)
+	stateRoot, err := decodeHash(p.StateRoot)
+	if err != nil {
+		return tx, fmt.Errorf("stateroot: %w", err)
+	}
+	blockHash, err := hex.DecodeString(p.BlockHash)
+	if err != nil {
+		return tx, errors.New("blockhash is invalid hex")
+	}
+	if !bytes.Equal(BlockHash(previous, root, stateRoot), blockHash) {
+		return tx, errors.New("block hash doesn't come from the merkle root")
+	}
+
+	return tx, nil
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func TestTxProof(t *testing.T) {
+	for n := 1; n <= 7; n++ {
+		block := Block{PreviousBlock: [20]byte{1}, StateRoot: [32]byte{2}}
+		for i := 0; i < n; i++ {
+			block.Transactions = append(block.Transactions, Transaction{
+				Type:     TYPE_ACQUIRE,
+				NameHash: sha256.Sum256([]byte{byte(i)}),
+			})
+		}
+		block, err := ParseBlock(block.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, itx := range block.Transactions {
+			proof, err := NewTxProof(block, 1, itx.(Transaction))
+			if err != nil {
+				t.Fatalf("%d/%d: %s", i, n, err)
+			}
+			if _, err := VerifyTxProof(proof); err != nil {
+				t.Fatalf("%d/%d: %s", i, n, err)
+			}
+
+			proof.StateRoot = "03" + proof.StateRoot[2:]
+			if _, err := VerifyTxProof(proof); err == nil {
+				t.Fatalf("%d/%d: proof checked with another state root", i, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,725 @@
+// Package fakebitcoin is an in-memory bitcoin chain that can stand in for
+// bitcoind (it implements common.BitcoinBackend) so named and the bmm tools can
+// be run end-to-end without a regtest node.
+//
+// It doesn't check scripts, signatures, locktimes or proof of work, only that
+// transactions spend outputs that exist and weren't spent yet. Conflicting
+// transactions replace each other if they pay more fees, like with full RBF.
+package fakebitcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/fiatjaf/namechain/common"
+	"github.com/stevenroose/go-bitcoin-core-rpc/btcjson"
+)
+
+// what getrawchangeaddress gives and what Fund pays to. since nothing is
+// signed, the wallet can spend it without keys.
+var WalletScript = []byte{txscript.OP_0, txscript.OP_DATA_20,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+const WALLET_ADDRESS = "fakebitcoin-wallet"
+
+type Chain struct {
+	sync.Mutex
+
+	base     int64 // height of blocks[0]
+	blocks   []*wire.MsgBlock
+	mempool  []*wire.MsgTx
+	replaced map[chainhash.Hash]bool
+
+	// what EstimateSmartFee returns, in sat/vbyte.
+	FeeRate float64
+}
+
+var _ common.BitcoinBackend = (*Chain)(nil)
+
+// New starts a chain whose first block is at the given height, lower heights
+// don't exist.
+func New(base int64) *Chain {
+	c := &Chain{
+		base:     base,
+		replaced: make(map[chainhash.Hash]bool),
+		FeeRate:  1,
+	}
+	c.mine(nil)
+	return c
+}
+
+// Mine puts the given transactions in the mempool and mines a block with
+// everything that is there.
+func (c *Chain) Mine(txs ...*wire.MsgTx) (*chainhash.Hash, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, tx := range txs {
+		if err := c.accept(tx); err != nil {
+			return nil, fmt.Errorf("tx %s: %w", tx.TxHash(), err)
+		}
+	}
+	return c.mine(nil), nil
+}
+
+// Fund mines a block whose coinbase pays value to the wallet.
+func (c *Chain) Fund(value int64) wire.OutPoint {
+	c.Lock()
+	defer c.Unlock()
+
+	c.mine(wire.NewTxOut(value, WalletScript))
+	coinbase := c.tip().Transactions[0].TxHash()
+	return *wire.NewOutPoint(&coinbase, 0)
+}
+
+// Reorg disconnects the last depth blocks, sending their transactions back to
+// the mempool. mine again to build the competing branch.
+func (c *Chain) Reorg(depth int) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if depth >= len(c.blocks) {
+		return errors.New("can't disconnect the first block")
+	}
+
+	disconnected := c.blocks[len(c.blocks)-depth:]
+	c.blocks = c.blocks[:len(c.blocks)-depth]
+
+	var txs []*wire.MsgTx
+	for _, block := range disconnected {
+		txs = append(txs, block.Transactions[1:]...)
+	}
+	txs = append(txs, c.mempool...)
+	c.mempool = nil
+	for _, tx := range txs {
+		// the ones spending disconnected coinbases are gone for good
+		c.accept(tx)
+	}
+	return nil
+}
+
+// Mempool returns the transactions waiting to be mined.
+func (c *Chain) Mempool() []*wire.MsgTx {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]*wire.MsgTx(nil), c.mempool...)
+}
+
+func (c *Chain) tip() *wire.MsgBlock {
+	return c.blocks[len(c.blocks)-1]
+}
+
+func (c *Chain) height() int64 {
+	return c.base + int64(len(c.blocks)) - 1
+}
+
+func (c *Chain) mine(reward *wire.TxOut) *chainhash.Hash {
+	height := c.base + int64(len(c.blocks))
+
+	coinbase := wire.NewMsgTx(wire.TxVersion)
+	heightScript, _ := txscript.NewScriptBuilder().AddInt64(height).Script()
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex),
+		heightScript, nil))
+	if reward == nil {
+		reward = wire.NewTxOut(0, []byte{txscript.OP_RETURN})
+	}
+	coinbase.AddTxOut(reward)
+
+	var prev chainhash.Hash
+	if len(c.blocks) > 0 {
+		prev = c.tip().BlockHash()
+	}
+
+	block := wire.NewMsgBlock(wire.NewBlockHeader(4, &prev, &chainhash.Hash{}, 0x207fffff, 0))
+	block.Header.Timestamp = time.Unix(1600000000+height*600, 0)
+	block.AddTransaction(coinbase)
+	for _, tx := range c.mempool {
+		block.AddTransaction(tx)
+	}
+	block.Header.MerkleRoot = merkleRoot(block.Transactions)
+
+	c.blocks = append(c.blocks, block)
+	c.mempool = nil
+
+	hash := block.BlockHash()
+	return &hash
+}
+
+// find returns a transaction and its height, -1 if it's in the mempool.
+func (c *Chain) find(txid chainhash.Hash) (*wire.MsgTx, int64, bool) {
+	for i, block := range c.blocks {
+		for _, tx := range block.Transactions {
+			if tx.TxHash() == txid {
+				return tx, c.base + int64(i), true
+			}
+		}
+	}
+	for _, tx := range c.mempool {
+		if tx.TxHash() == txid {
+			return tx, -1, true
+		}
+	}
+	return nil, 0, false
+}
+
+func (c *Chain) output(outpoint wire.OutPoint, mempool bool) (*wire.TxOut, int64, bool) {
+	tx, height, ok := c.find(outpoint.Hash)
+	if !ok || (height == -1 && !mempool) || int(outpoint.Index) >= len(tx.TxOut) {
+		return nil, 0, false
+	}
+	return tx.TxOut[outpoint.Index], height, true
+}
+
+// spender returns the transaction that spends outpoint, if any.
+func (c *Chain) spender(outpoint wire.OutPoint, mempool bool) (*wire.MsgTx, bool) {
+	txs := make([]*wire.MsgTx, 0)
+	for _, block := range c.blocks {
+		txs = append(txs, block.Transactions...)
+	}
+	if mempool {
+		txs = append(txs, c.mempool...)
+	}
+	for _, tx := range txs {
+		for _, in := range tx.TxIn {
+			if in.PreviousOutPoint == outpoint {
+				return tx, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (c *Chain) fee(tx *wire.MsgTx) (int64, error) {
+	var fee int64
+	for _, in := range tx.TxIn {
+		out, _, ok := c.output(in.PreviousOutPoint, true)
+		if !ok {
+			return 0, fmt.Errorf("missing input %s", in.PreviousOutPoint)
+		}
+		fee += out.Value
+	}
+	for _, out := range tx.TxOut {
+		fee -= out.Value
+	}
+	if fee < 0 {
+		return 0, errors.New("outputs are larger than inputs")
+	}
+	return fee, nil
+}
+
+// accept adds tx to the mempool, replacing the transactions it conflicts with
+// (and their descendants) if it pays more than all of them.
+func (c *Chain) accept(tx *wire.MsgTx) error {
+	txid := tx.TxHash()
+	if _, _, ok := c.find(txid); ok {
+		return errors.New("transaction already in block chain or mempool")
+	}
+
+	fee, err := c.fee(tx)
+	if err != nil {
+		return err
+	}
+
+	conflicts := make(map[chainhash.Hash]*wire.MsgTx)
+	for _, in := range tx.TxIn {
+		if _, ok := c.spender(in.PreviousOutPoint, false); ok {
+			return fmt.Errorf("input %s was already spent", in.PreviousOutPoint)
+		}
+		if conflict, ok := c.spender(in.PreviousOutPoint, true); ok {
+			conflicts[conflict.TxHash()] = conflict
+		}
+	}
+
+	if len(conflicts) > 0 {
+		evict := make(map[chainhash.Hash]bool)
+		for hash := range conflicts {
+			c.descendants(hash, evict)
+		}
+
+		var evictedFees int64
+		for hash := range evict {
+			evicted, _, _ := c.find(hash)
+			f, _ := c.fee(evicted)
+			evictedFees += f
+		}
+		if fee <= evictedFees {
+			return fmt.Errorf("insufficient fee, replacing %d sat with %d sat", evictedFees, fee)
+		}
+
+		kept := c.mempool[:0]
+		for _, mtx := range c.mempool {
+			if evict[mtx.TxHash()] {
+				c.replaced[mtx.TxHash()] = true
+			} else {
+				kept = append(kept, mtx)
+			}
+		}
+		c.mempool = kept
+	}
+
+	c.mempool = append(c.mempool, tx)
+	delete(c.replaced, txid)
+	return nil
+}
+
+func (c *Chain) descendants(txid chainhash.Hash, found map[chainhash.Hash]bool) {
+	found[txid] = true
+	for _, tx := range c.mempool {
+		for _, in := range tx.TxIn {
+			if in.PreviousOutPoint.Hash == txid && !found[tx.TxHash()] {
+				c.descendants(tx.TxHash(), found)
+			}
+		}
+	}
+}
+
+func (c *Chain) ancestors(tx *wire.MsgTx, found map[chainhash.Hash]*wire.MsgTx) {
+	found[tx.TxHash()] = tx
+	for _, in := range tx.TxIn {
+		if parent, height, ok := c.find(in.PreviousOutPoint.Hash); ok && height == -1 {
+			c.ancestors(parent, found)
+		}
+	}
+}
+
+func merkleRoot(txs []*wire.MsgTx) chainhash.Hash {
+	level := make([]chainhash.Hash, len(txs))
+	for i, tx := range txs {
+		level[i] = tx.TxHash()
+	}
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([]chainhash.Hash, len(level)/2)
+		for i := range next {
+			next[i] = chainhash.DoubleHashH(append(level[2*i][:], level[2*i+1][:]...))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// txOutProof builds the partial merkle tree of a merkleblock for the given
+// transactions, the same way bitcoind does.
+func txOutProof(block *wire.MsgBlock, txids map[chainhash.Hash]bool) *wire.MsgMerkleBlock {
+	n := len(block.Transactions)
+	leaves := make([]chainhash.Hash, n)
+	for i, tx := range block.Transactions {
+		leaves[i] = tx.TxHash()
+	}
+	width := func(height uint) int {
+		return (n + (1 << height) - 1) >> height
+	}
+	var hash func(height uint, pos int) chainhash.Hash
+	hash = func(height uint, pos int) chainhash.Hash {
+		if height == 0 {
+			return leaves[pos]
+		}
+		left := hash(height-1, pos*2)
+		right := left
+		if pos*2+1 < width(height-1) {
+			right = hash(height-1, pos*2+1)
+		}
+		return chainhash.DoubleHashH(append(left[:], right[:]...))
+	}
+
+	mb := &wire.MsgMerkleBlock{Header: block.Header, Transactions: uint32(n)}
+	var bits []bool
+	var build func(height uint, pos int)
+	build = func(height uint, pos int) {
+		parentOfMatch := false
+		for i := pos << height; i < (pos+1)<<height && i < n; i++ {
+			parentOfMatch = parentOfMatch || txids[leaves[i]]
+		}
+		bits = append(bits, parentOfMatch)
+
+		if height == 0 || !parentOfMatch {
+			h := hash(height, pos)
+			mb.Hashes = append(mb.Hashes, &h)
+			return
+		}
+		build(height-1, pos*2)
+		if pos*2+1 < width(height-1) {
+			build(height-1, pos*2+1)
+		}
+	}
+	var height uint
+	for width(height) > 1 {
+		height++
+	}
+	build(height, 0)
+
+	mb.Flags = make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			mb.Flags[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return mb
+}
+
+func encodeTx(tx *wire.MsgTx) string {
+	var buf bytes.Buffer
+	tx.Serialize(&buf)
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func decodeTx(h string) (*wire.MsgTx, error) {
+	b, err := hex.DecodeString(h)
+	if err != nil {
+		return nil, err
+	}
+	tx := &wire.MsgTx{}
+	if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (c *Chain) GetBlockChainInfo() (*btcjson.GetBlockChainInfoResult, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return &btcjson.GetBlockChainInfoResult{
+		Chain:         "regtest",
+		Blocks:        int32(c.height()),
+		Headers:       int32(c.height()),
+		BestBlockHash: c.tip().BlockHash().String(),
+	}, nil
+}
+
+func (c *Chain) GetBlockCount() (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.height(), nil
+}
+
+func (c *Chain) GetBlockHash(blockHeight int64) (*chainhash.Hash, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if blockHeight < c.base || blockHeight > c.height() {
+		return nil, errors.New("Block height out of range")
+	}
+	hash := c.blocks[blockHeight-c.base].BlockHash()
+	return &hash, nil
+}
+
+func (c *Chain) GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, block := range c.blocks {
+		if block.BlockHash() == *blockHash {
+			return block, nil
+		}
+	}
+	return nil, errors.New("Block not found")
+}
+
+func (c *Chain) GetRawTransaction(txHash *chainhash.Hash) (*btcutil.Tx, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	tx, _, ok := c.find(*txHash)
+	if !ok {
+		return nil, errors.New("No such mempool or blockchain transaction")
+	}
+	return btcutil.NewTx(tx), nil
+}
+
+func (c *Chain) GetRawTransactionVerbose(txHash *chainhash.Hash) (*btcjson.TxRawResult, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	tx, height, ok := c.find(*txHash)
+	if !ok {
+		return nil, errors.New("No such mempool or blockchain transaction")
+	}
+
+	res := &btcjson.TxRawResult{
+		Hex:      encodeTx(tx),
+		Txid:     tx.TxHash().String(),
+		Hash:     tx.WitnessHash().String(),
+		Size:     int32(tx.SerializeSize()),
+		Vsize:    int32(common.VSize(tx)),
+		Version:  tx.Version,
+		LockTime: tx.LockTime,
+	}
+	if height != -1 {
+		block := c.blocks[height-c.base]
+		res.BlockHash = block.BlockHash().String()
+		res.Confirmations = uint64(c.height() - height + 1)
+		res.Time = block.Header.Timestamp.Unix()
+		res.Blocktime = block.Header.Timestamp.Unix()
+	}
+	return res, nil
+}
+
+func (c *Chain) SendRawTransaction(tx *wire.MsgTx, allowHighFees bool) (*chainhash.Hash, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if err := c.accept(tx); err != nil {
+		return nil, err
+	}
+	hash := tx.TxHash()
+	return &hash, nil
+}
+
+func (c *Chain) GetTxOut(txHash *chainhash.Hash, index uint32, mempool bool) (*btcjson.GetTxOutResult, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	outpoint := *wire.NewOutPoint(txHash, index)
+	out, height, ok := c.output(outpoint, mempool)
+	if !ok {
+		return nil, nil
+	}
+	if _, spent := c.spender(outpoint, mempool); spent {
+		return nil, nil
+	}
+
+	res := &btcjson.GetTxOutResult{
+		BestBlock:    c.tip().BlockHash().String(),
+		Value:        btcutil.Amount(out.Value).ToBTC(),
+		ScriptPubKey: btcjson.ScriptPubKeyResult{Hex: hex.EncodeToString(out.PkScript)},
+	}
+	if height != -1 {
+		res.Confirmations = c.height() - height + 1
+		res.Coinbase = c.blocks[height-c.base].Transactions[0].TxHash() == *txHash
+	}
+	return res, nil
+}
+
+func (c *Chain) EstimateSmartFee(confTarget uint32) (*btcjson.EstimateSmartFeeResult, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	// sat/vbyte to BTC/kvB
+	feerate := c.FeeRate * 1000 / 1e8
+	return &btcjson.EstimateSmartFeeResult{FeeRate: &feerate, Blocks: int(confTarget)}, nil
+}
+
+// ListUnspent lists the confirmed outputs paying to WalletScript.
+func (c *Chain) ListUnspent() ([]btcjson.ListUnspentResult, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	unspent := make([]btcjson.ListUnspentResult, 0)
+	for i, block := range c.blocks {
+		for _, tx := range block.Transactions {
+			txid := tx.TxHash()
+			for vout, out := range tx.TxOut {
+				if !bytes.Equal(out.PkScript, WalletScript) {
+					continue
+				}
+				if _, spent := c.spender(*wire.NewOutPoint(&txid, uint32(vout)), true); spent {
+					continue
+				}
+				unspent = append(unspent, btcjson.ListUnspentResult{
+					TxID:          txid.String(),
+					Vout:          uint32(vout),
+					Address:       WALLET_ADDRESS,
+					ScriptPubKey:  hex.EncodeToString(out.PkScript),
+					Amount:        btcutil.Amount(out.Value).ToBTC(),
+					Confirmations: c.height() - (c.base + int64(i)) + 1,
+					Spendable:     true,
+				})
+			}
+		}
+	}
+	return unspent, nil
+}
+
+// RawRequest handles the few calls we make that have no method in the client.
+func (c *Chain) RawRequest(method string, rawParams []json.RawMessage) (json.RawMessage, error) {
+	params := make([]interface{}, len(rawParams))
+	for i, p := range rawParams {
+		if err := json.Unmarshal(p, &params[i]); err != nil {
+			return nil, err
+		}
+	}
+	txidParam := func() (chainhash.Hash, error) {
+		if len(params) < 1 {
+			return chainhash.Hash{}, errors.New("missing txid")
+		}
+		s, _ := params[0].(string)
+		hash, err := chainhash.NewHashFromStr(s)
+		if err != nil {
+			return chainhash.Hash{}, err
+		}
+		return *hash, nil
+	}
+
+	var result interface{}
+	switch method {
+	case "getrawtransaction":
+		txid, err := txidParam()
+		if err != nil {
+			return nil, err
+		}
+		tx, err := c.GetRawTransaction(&txid)
+		if err != nil {
+			return nil, err
+		}
+		result = encodeTx(tx.MsgTx())
+
+	case "submitpackage":
+		if len(params) < 1 {
+			return nil, errors.New("missing package")
+		}
+		c.Lock()
+		list, _ := params[0].([]interface{})
+		for _, item := range list {
+			s, _ := item.(string)
+			tx, err := decodeTx(s)
+			if err != nil {
+				c.Unlock()
+				return nil, err
+			}
+			if _, _, ok := c.find(tx.TxHash()); ok {
+				continue
+			}
+			if err := c.accept(tx); err != nil {
+				c.Unlock()
+				return nil, fmt.Errorf("package rejected, tx %s: %w", tx.TxHash(), err)
+			}
+		}
+		c.Unlock()
+		result = map[string]interface{}{"package_msg": "success"}
+
+	case "getmempoolentry":
+		txid, err := txidParam()
+		if err != nil {
+			return nil, err
+		}
+		c.Lock()
+		tx, height, ok := c.find(txid)
+		if !ok || height != -1 {
+			c.Unlock()
+			return nil, errors.New("Transaction not in mempool")
+		}
+
+		ancestors := make(map[chainhash.Hash]*wire.MsgTx)
+		c.ancestors(tx, ancestors)
+		var ancestorFees, ancestorSize int64
+		for _, atx := range ancestors {
+			f, _ := c.fee(atx)
+			ancestorFees += f
+			ancestorSize += common.VSize(atx)
+		}
+		fee, _ := c.fee(tx)
+
+		spentBy := make([]string, 0)
+		for _, mtx := range c.mempool {
+			for _, in := range mtx.TxIn {
+				if in.PreviousOutPoint.Hash == txid {
+					spentBy = append(spentBy, mtx.TxHash().String())
+					break
+				}
+			}
+		}
+		c.Unlock()
+
+		result = map[string]interface{}{
+			"vsize": common.VSize(tx),
+			"fees": map[string]interface{}{
+				"base":     btcutil.Amount(fee).ToBTC(),
+				"ancestor": btcutil.Amount(ancestorFees).ToBTC(),
+			},
+			"ancestorsize": ancestorSize,
+			"spentby":      spentBy,
+		}
+
+	case "gettransaction":
+		txid, err := txidParam()
+		if err != nil {
+			return nil, err
+		}
+		c.Lock()
+		_, height, ok := c.find(txid)
+		replaced := c.replaced[txid]
+		tipHeight := c.height()
+		c.Unlock()
+
+		switch {
+		case ok && height != -1:
+			result = map[string]interface{}{"confirmations": tipHeight - height + 1}
+		case ok:
+			result = map[string]interface{}{"confirmations": 0}
+		case replaced:
+			result = map[string]interface{}{"confirmations": -1}
+		default:
+			return nil, errors.New("Invalid or non-wallet transaction id")
+		}
+
+	case "gettxoutproof":
+		if len(params) < 1 {
+			return nil, errors.New("missing txids")
+		}
+		list, _ := params[0].([]interface{})
+		txids := make(map[chainhash.Hash]bool)
+		for _, item := range list {
+			s, _ := item.(string)
+			txid, err := chainhash.NewHashFromStr(s)
+			if err != nil {
+				return nil, err
+			}
+			txids[*txid] = true
+		}
+
+		c.Lock()
+		var block *wire.MsgBlock
+		for _, b := range c.blocks {
+			if len(params) > 1 && params[1] != b.BlockHash().String() {
+				continue
+			}
+			for _, tx := range b.Transactions {
+				if txids[tx.TxHash()] {
+					block = b
+				}
+			}
+		}
+		c.Unlock()
+		if block == nil {
+			return nil, errors.New("Transaction not yet in block")
+		}
+
+		var buf bytes.Buffer
+		if err := txOutProof(block, txids).BtcEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+			return nil, err
+		}
+		result = hex.EncodeToString(buf.Bytes())
+
+	case "getrawchangeaddress":
+		result = WALLET_ADDRESS
+
+	case "getaddressinfo":
+		result = map[string]interface{}{"scriptPubKey": hex.EncodeToString(WalletScript)}
+
+	case "signrawtransactionwithwallet":
+		// nothing is checked, so there is nothing to sign
+		if len(params) < 1 {
+			return nil, errors.New("missing transaction")
+		}
+		result = map[string]interface{}{"hex": params[0], "complete": true}
+
+	default:
+		return nil, fmt.Errorf("%s is not supported by fakebitcoin", method)
+	}
+
+	return json.Marshal(result)
+}
@@ -14,12 +14,15 @@ require (
 	github.com/dgraph-io/badger v1.6.2
 	github.com/dgraph-io/badger/v2 v2.2007.2 // indirect
 	github.com/docopt/docopt-go v0.0.0-20180111231733-ee0de3bc6815
-	github.com/fiatjaf/schnorr v0.2.1-hack // indirect
+	github.com/fiatjaf/schnorr v0.2.1-hack
+	github.com/gorilla/websocket v1.4.2
 	github.com/kr/pretty v0.2.0
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/rs/zerolog v1.20.0
 	github.com/stevenroose/go-bitcoin-core-rpc v0.0.0-20181021223752-1f5e57e12ba1
 	go.etcd.io/bbolt v1.3.5
 	go.uber.org/zap v1.16.0
+	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
+	golang.org/x/time v0.0.0-20200416051211-89c76fbcd5d1
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,471 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/schnorr"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Keystore keeps the keys that own names. All of them are derived from a single
+// seed, BIP86-style, at m/86'/0'/0'/0/<index>, except for imported keys. The seed
+// and the imported keys are encrypted with AES-GCM using a key derived from the
+// passphrase with scrypt.
+//
+// The keystore must be unlocked before new keys can be created or anything can
+// be signed, and it can lock itself again after a timeout.
+type Keystore struct {
+	path    string
+	file    keystoreFile
+	modTime time.Time // of the file when we last read or wrote it
+
+	mu        sync.Mutex
+	aesKey    []byte // only set while unlocked
+	master    *hdkeychain.ExtendedKey
+	lockTimer *time.Timer
+}
+
+type Key struct {
+	Label    string `json:"label"`
+	PubKey   string `json:"pubkey"`
+	Index    uint32 `json:"index"`
+	Imported bool   `json:"imported"`
+}
+
+const VERSION = 1
+
+// FILENAME is where the keystore is kept inside the datadir.
+const FILENAME = "keystore.json"
+
+const (
+	SCRYPT_N = 1 << 15
+	SCRYPT_R = 8
+	SCRYPT_P = 1
+)
+
+var (
+	ErrLocked         = errors.New("keystore is locked")
+	ErrBadPassphrase  = errors.New("wrong passphrase")
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrAlreadyExists  = errors.New("keystore already exists")
+	ErrNotInitialized = errors.New("keystore doesn't exist")
+)
+
+type keystoreFile struct {
+	Version int         `json:"version"`
+	KDF     kdfParams   `json:"kdf"`
+	Seed    encrypted   `json:"seed"`
+	Next    uint32      `json:"next"`
+	Keys    []storedKey `json:"keys"`
+}
+
+type storedKey struct {
+	Key
+	Secret *encrypted `json:"secret,omitempty"` // only for imported keys
+}
+
+type kdfParams struct {
+	Name string `json:"name"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt string `json:"salt"`
+}
+
+type encrypted struct {
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// Create makes a new keystore with a random seed and saves it to path.
+func Create(path string, passphrase string) (*Keystore, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, ErrAlreadyExists
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	seed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &Keystore{path: path}
+	ks.file.Version = VERSION
+	ks.file.KDF = kdfParams{"scrypt", SCRYPT_N, SCRYPT_R, SCRYPT_P, hex.EncodeToString(salt)}
+
+	aesKey, err := deriveAESKey(ks.file.KDF, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ks.file.Seed, err = encrypt(aesKey, seed)
+	if err != nil {
+		return nil, err
+	}
+
+	return ks, ks.save()
+}
+
+// Open loads a keystore from path. It starts locked.
+func Open(path string) (*Keystore, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotInitialized
+	} else if err != nil {
+		return nil, err
+	}
+
+	ks := &Keystore{path: path}
+	if err := json.Unmarshal(data, &ks.file); err != nil {
+		return nil, fmt.Errorf("failed to parse keystore: %w", err)
+	}
+	if ks.file.Version != VERSION {
+		return nil, fmt.Errorf("unsupported keystore version %d", ks.file.Version)
+	}
+	if ks.file.KDF.Name != "scrypt" {
+		return nil, fmt.Errorf("unsupported kdf '%s'", ks.file.KDF.Name)
+	}
+	if info, err := os.Stat(path); err == nil {
+		ks.modTime = info.ModTime()
+	}
+
+	return ks, nil
+}
+
+// Reload reads the file again if it changed since we last did, so keys added
+// by another process (like namecli while named is running) show up. It stays
+// unlocked unless the seed or the passphrase changed.
+func (ks *Keystore) Reload() error {
+	info, err := os.Stat(ks.path)
+	if os.IsNotExist(err) {
+		return ErrNotInitialized
+	} else if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if info.ModTime().Equal(ks.modTime) {
+		return nil
+	}
+
+	fresh, err := Open(ks.path)
+	if err != nil {
+		return err
+	}
+	if fresh.file.Seed != ks.file.Seed || fresh.file.KDF != ks.file.KDF {
+		ks.lock()
+	}
+	ks.file = fresh.file
+	ks.modTime = fresh.modTime
+	return nil
+}
+
+// Unlock decrypts the seed. If timeout is not zero the keystore locks itself
+// again after that.
+func (ks *Keystore) Unlock(passphrase string, timeout time.Duration) error {
+	// scrypt is slow, so don't hold the lock while deriving
+	ks.mu.Lock()
+	kdf, encryptedSeed := ks.file.KDF, ks.file.Seed
+	ks.mu.Unlock()
+
+	aesKey, err := deriveAESKey(kdf, passphrase)
+	if err != nil {
+		return err
+	}
+	seed, err := decrypt(aesKey, encryptedSeed)
+	if err != nil {
+		return ErrBadPassphrase
+	}
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	zero(seed)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.file.KDF != kdf || ks.file.Seed != encryptedSeed {
+		// reloaded with a different seed meanwhile
+		master.Zero()
+		zero(aesKey)
+		return errors.New("keystore changed while unlocking, try again")
+	}
+
+	ks.aesKey = aesKey
+	ks.master = master
+	if ks.lockTimer != nil {
+		ks.lockTimer.Stop()
+		ks.lockTimer = nil
+	}
+	if timeout > 0 {
+		ks.lockTimer = time.AfterFunc(timeout, ks.Lock)
+	}
+
+	return nil
+}
+
+// Lock forgets all decrypted material.
+func (ks *Keystore) Lock() {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.lock()
+}
+
+func (ks *Keystore) lock() {
+	if ks.master != nil {
+		ks.master.Zero()
+		ks.master = nil
+	}
+	zero(ks.aesKey)
+	ks.aesKey = nil
+	if ks.lockTimer != nil {
+		ks.lockTimer.Stop()
+		ks.lockTimer = nil
+	}
+}
+
+func (ks *Keystore) IsLocked() bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.master == nil
+}
+
+// NewKey derives the next key from the seed.
+func (ks *Keystore) NewKey(label string) (Key, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.master == nil {
+		return Key{}, ErrLocked
+	}
+
+	index := ks.file.Next
+	sk, err := ks.derive(index)
+	if err != nil {
+		return Key{}, err
+	}
+	pk := common.PublicKey(sk)
+	zero(sk[:])
+
+	key := Key{Label: label, PubKey: hex.EncodeToString(pk[:]), Index: index}
+	ks.file.Keys = append(ks.file.Keys, storedKey{Key: key})
+	ks.file.Next++
+
+	return key, ks.save()
+}
+
+// Import adds a key that wasn't derived from our seed.
+func (ks *Keystore) Import(label string, sk [32]byte) (Key, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.master == nil {
+		return Key{}, ErrLocked
+	}
+
+	pk := common.PublicKey(sk)
+	pubkey := hex.EncodeToString(pk[:])
+	for _, k := range ks.file.Keys {
+		if k.PubKey == pubkey {
+			return Key{}, fmt.Errorf("key already exists with label '%s'", k.Label)
+		}
+	}
+
+	secret, err := encrypt(ks.aesKey, sk[:])
+	if err != nil {
+		return Key{}, err
+	}
+
+	key := Key{Label: label, PubKey: pubkey, Imported: true}
+	ks.file.Keys = append(ks.file.Keys, storedKey{key, &secret})
+
+	return key, ks.save()
+}
+
+// Keys lists public information about all keys, it works while locked.
+func (ks *Keystore) Keys() []Key {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	keys := make([]Key, len(ks.file.Keys))
+	for i, k := range ks.file.Keys {
+		keys[i] = k.Key
+	}
+	return keys
+}
+
+// Find looks for a key by its label or its public key.
+func (ks *Keystore) Find(labelOrPubKey string) (Key, error) {
+	for _, key := range ks.Keys() {
+		if key.Label == labelOrPubKey || key.PubKey == labelOrPubKey {
+			return key, nil
+		}
+	}
+	return Key{}, ErrKeyNotFound
+}
+
+// Sign signs a 32-byte hash with the key that has the given public key.
+func (ks *Keystore) Sign(pubkey string, hash [32]byte) (sig [64]byte, err error) {
+	sk, err := ks.secretKey(pubkey)
+	if err != nil {
+		return sig, err
+	}
+	defer zero(sk[:])
+
+	return schnorr.Sign(new(big.Int).SetBytes(sk[:]), hash, nil)
+}
+
+// SignTransaction fills the signature of a transaction with the given key.
+func (ks *Keystore) SignTransaction(tx *common.Transaction, pubkey string) error {
+	sk, err := ks.secretKey(pubkey)
+	if err != nil {
+		return err
+	}
+	defer zero(sk[:])
+
+	return tx.Sign(sk)
+}
+
+func (ks *Keystore) secretKey(pubkey string) (sk [32]byte, err error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.master == nil {
+		return sk, ErrLocked
+	}
+
+	for _, k := range ks.file.Keys {
+		if k.PubKey != pubkey {
+			continue
+		}
+
+		if k.Imported {
+			secret, err := decrypt(ks.aesKey, *k.Secret)
+			if err != nil {
+				return sk, err
+			}
+			copy(sk[:], secret)
+			zero(secret)
+			return sk, nil
+		}
+
+		return ks.derive(k.Index)
+	}
+
+	return sk, ErrKeyNotFound
+}
+
+// derive returns the key at m/86'/0'/0'/0/index.
+func (ks *Keystore) derive(index uint32) (sk [32]byte, err error) {
+	key := ks.master
+	for _, i := range []uint32{
+		hdkeychain.HardenedKeyStart + 86,
+		hdkeychain.HardenedKeyStart + 0,
+		hdkeychain.HardenedKeyStart + 0,
+		0,
+		index,
+	} {
+		key, err = key.Derive(i)
+		if err != nil {
+			return sk, err
+		}
+	}
+
+	priv, err := key.ECPrivKey()
+	if err != nil {
+		return sk, err
+	}
+	b := priv.D.Bytes()
+	copy(sk[32-len(b):], b)
+	return sk, nil
+}
+
+func deriveAESKey(kdf kdfParams, passphrase string) ([]byte, error) {
+	salt, err := hex.DecodeString(kdf.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return scrypt.Key([]byte(passphrase), salt, kdf.N, kdf.R, kdf.P, 32)
+}
+
+func (ks *Keystore) save() error {
+	data, _ := json.MarshalIndent(ks.file, "", "  ")
+	tmp := ks.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ks.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(ks.path); err == nil {
+		ks.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func encrypt(aesKey []byte, plaintext []byte) (encrypted, error) {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return encrypted{}, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return encrypted{}, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return encrypted{}, err
+	}
+
+	return encrypted{
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(gcm.Seal(nil, nonce, plaintext, nil)),
+	}, nil
+}
+
+func decrypt(aesKey []byte, enc encrypted) ([]byte, error) {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(enc.Nonce)
+	if err != nil || len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	ciphertext, err := hex.DecodeString(enc.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,283 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/schnorr"
+)
+
+func TestReloadPicksUpKeysFromAnotherProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FILENAME)
+	if _, err := Create(path, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	daemon, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.Unlock("secret", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing changed
+	if err := daemon.Reload(); err != nil || daemon.IsLocked() {
+		t.Fatalf("reload without changes: %v, locked %v", err, daemon.IsLocked())
+	}
+
+	cli, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Unlock("secret", 0); err != nil {
+		t.Fatal(err)
+	}
+	key, err := cli.NewKey("example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Lock()
+	// make sure the modification time is different on coarse filesystems
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+
+	if _, err := daemon.Find("example"); err == nil {
+		t.Fatal("found a key before reloading")
+	}
+	if err := daemon.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	found, err := daemon.Find("example")
+	if err != nil || found.PubKey != key.PubKey {
+		t.Fatalf("didn't find the new key after reloading: %v %v", found, err)
+	}
+	if daemon.IsLocked() {
+		t.Fatal("reloading with the same seed locked the keystore")
+	}
+}
+
+func TestReloadLocksWhenTheSeedChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FILENAME)
+	ks, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock("secret", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// replaced by a different keystore
+	os.Remove(path)
+	if _, err := Create(path, "other"); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+
+	if err := ks.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !ks.IsLocked() {
+		t.Fatal("still unlocked with the seed of the previous keystore")
+	}
+	if err := ks.Unlock("other", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove(path)
+	if err := ks.Reload(); err != ErrNotInitialized {
+		t.Fatalf("reload of a removed keystore: %v", err)
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	plaintext := []byte("the seed")
+
+	enc, err := encrypt(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := decrypt(key, enc); err != nil || !bytes.Equal(dec, plaintext) {
+		t.Fatalf("decrypted to %x, %v", dec, err)
+	}
+
+	if _, err := decrypt(bytes.Repeat([]byte{2}, 32), enc); err == nil {
+		t.Fatal("decrypted with the wrong key")
+	}
+	tampered := enc
+	tampered.Ciphertext = "00" + enc.Ciphertext[2:]
+	if tampered.Ciphertext == enc.Ciphertext {
+		tampered.Ciphertext = "01" + enc.Ciphertext[2:]
+	}
+	if _, err := decrypt(key, tampered); err == nil {
+		t.Fatal("decrypted a tampered ciphertext")
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	ks, err := Create(filepath.Join(t.TempDir(), FILENAME), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock("not the secret", 0); err != ErrBadPassphrase {
+		t.Fatalf("unlock with the wrong passphrase: %v", err)
+	}
+	if !ks.IsLocked() {
+		t.Fatal("unlocked with the wrong passphrase")
+	}
+	if _, err := ks.NewKey("nope"); err != ErrLocked {
+		t.Fatalf("new key while locked: %v", err)
+	}
+}
+
+// createWithSeed is Create with a known seed.
+func createWithSeed(t *testing.T, path string, passphrase string, seed []byte) {
+	ks := &Keystore{path: path}
+	ks.file.Version = VERSION
+	ks.file.KDF = kdfParams{"scrypt", SCRYPT_N, SCRYPT_R, SCRYPT_P, hex.EncodeToString(make([]byte, 32))}
+	aesKey, err := deriveAESKey(ks.file.KDF, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.file.Seed, err = encrypt(aesKey, seed); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDerivationIsDeterministic(t *testing.T) {
+	// the seed of "abandon abandon ... about" and the internal keys of its
+	// first receiving addresses from the BIP86 test vectors (m/86'/0'/0'/0/i)
+	seed, _ := hex.DecodeString("5eb00bbddcf069084889a8ab9155568165f5c453ccb85e70811aaed6f6da5fc19a5ac40b389cd370d086206dec8aa6c43daea6690f20ad3d8d48b2d2ce9e38e4")
+	expected := []string{
+		"cc8a4bc64d897bddc5fbc2f670f7a8ba0b386779106cf1223c6fc5d7cd6fc115",
+		"83dfe85a3151d2517290da461fe2815591ef69f2b18a2ce63f01697a8b313145",
+	}
+
+	path := filepath.Join(t.TempDir(), FILENAME)
+	createWithSeed(t, path, "secret", seed)
+
+	ks, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock("secret", 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, pubkey := range expected {
+		key, err := ks.NewKey("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.PubKey != pubkey || key.Index != uint32(i) {
+			t.Fatalf("key %d is %s, expected %s", key.Index, key.PubKey, pubkey)
+		}
+	}
+
+	// the same keys sign after reopening
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Unlock("secret", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, pubkey := range expected {
+		checkSigns(t, reopened, pubkey)
+	}
+	if key, _ := reopened.NewKey(""); key.Index != uint32(len(expected)) {
+		t.Fatalf("next key after reopening has index %d", key.Index)
+	}
+}
+
+func checkSigns(t *testing.T, ks *Keystore, pubkey string) {
+	t.Helper()
+	var hash [32]byte
+	copy(hash[:], "some hash")
+	sig, err := ks.Sign(pubkey, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pk [32]byte
+	b, _ := hex.DecodeString(pubkey)
+	copy(pk[:], b)
+	if ok, err := schnorr.Verify(pk, hash, sig); !ok || err != nil {
+		t.Fatalf("signature by %s doesn't verify: %v", pubkey, err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FILENAME)
+	ks, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock("secret", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var sk [32]byte
+	copy(sk[:], bytes.Repeat([]byte{7}, 32))
+	pk := common.PublicKey(sk)
+	key, err := ks.Import("imported", sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.PubKey != hex.EncodeToString(pk[:]) || !key.Imported {
+		t.Fatalf("imported key is %+v", key)
+	}
+	if _, err := ks.Import("again", sk); err == nil {
+		t.Fatal("imported the same key twice")
+	}
+
+	// it is saved encrypted and signs after reopening
+	data, _ := ioutil.ReadFile(path)
+	if bytes.Contains(data, []byte(hex.EncodeToString(sk[:]))) {
+		t.Fatal("imported key saved in plaintext")
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, err := reopened.Find("imported"); err != nil || found != key {
+		t.Fatalf("found %+v, %v", found, err)
+	}
+	if err := reopened.Unlock("secret", 0); err != nil {
+		t.Fatal(err)
+	}
+	checkSigns(t, reopened, key.PubKey)
+}
+
+func TestLocksAfterTimeout(t *testing.T) {
+	ks, err := Create(filepath.Join(t.TempDir(), FILENAME), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock("secret", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if ks.IsLocked() {
+		t.Fatal("locked right after unlocking")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !ks.IsLocked() {
+		if time.Now().After(deadline) {
+			t.Fatal("still unlocked after the timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := ks.NewKey("late"); err != ErrLocked {
+		t.Fatalf("new key after the timeout: %v", err)
+	}
+}
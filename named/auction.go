@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/fiatjaf/namechain/common"
+)
+
+// seenBMMBid is a bid we saw in the mempool at some point. bids that were
+// outbid are kept until the link is confirmed so we can show the whole auction.
+type seenBMMBid struct {
+	common.BMMBid
+	FirstSeen time.Time
+	InMempool bool
+}
+
+// the auction for the next BMM link as seen from our bitcoind mempool.
+var auction = struct {
+	sync.Mutex
+	n    int
+	bids map[chainhash.Hash]*seenBMMBid
+}{}
+
+func watchBMMAuction() {
+	for {
+		if chain := currentBMMChain(); chain != nil {
+			if err := refreshBMMAuction(chain); err != nil {
+				log.Debug().Err(err).Msg("failed to look at competing bmm bids")
+			}
+		}
+
+		time.Sleep(BMM_BID_CHECK_INTERVAL)
+	}
+}
+
+func refreshBMMAuction(chain *common.BMMChain) error {
+	n, err := nextBMMLink(chain)
+	if err != nil {
+		return err
+	}
+	bids, err := common.FindBMMBids(bitcoin, chain, n)
+	if err != nil {
+		return err
+	}
+
+	auction.Lock()
+	defer auction.Unlock()
+
+	if auction.n != n {
+		// the previous link was confirmed, a new auction begins
+		auction.n = n
+		auction.bids = make(map[chainhash.Hash]*seenBMMBid)
+	}
+
+	for _, seen := range auction.bids {
+		seen.InMempool = false
+	}
+	for _, bid := range bids {
+		seen, ok := auction.bids[bid.Child]
+		if !ok {
+			seen = &seenBMMBid{FirstSeen: time.Now()}
+			auction.bids[bid.Child] = seen
+			log.Info().Int("bmm", n).Str("child", bid.Child.String()).
+				Float64("feerate", bid.FeeRate).
+				Msg("spotted a bmm bid")
+		}
+		seen.BMMBid = bid
+		seen.InMempool = true
+	}
+
+	return nil
+}
+
+// sortedBMMBids returns the bids for the current link, the highest feerate first.
+func sortedBMMBids() (n int, bids []seenBMMBid) {
+	auction.Lock()
+	defer auction.Unlock()
+
+	bids = make([]seenBMMBid, 0, len(auction.bids))
+	for _, seen := range auction.bids {
+		bids = append(bids, *seen)
+	}
+	sort.Slice(bids, func(i, j int) bool { return bids[i].FeeRate > bids[j].FeeRate })
+	return auction.n, bids
+}
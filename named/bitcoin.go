@@ -1,14 +1,15 @@
 package main
 
 import (
-	"bytes"
+	"errors"
 	"strconv"
 	"time"
 
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
-	"github.com/dgraph-io/badger"
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/store"
 )
 
 const (
@@ -22,135 +23,226 @@ const (
 )
 
 func watchBitcoinBlocks() {
-	var lastScannedBlock int
-	var lastSpottedTxid *chainhash.Hash
+	for {
+		scanned, err := scanNextBitcoinBlock()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to scan bitcoin block")
+		}
+		if !scanned {
+			time.Sleep(2 * time.Minute)
+		}
+	}
+}
 
-	// load checkpoints
-	if err := kvdb.View(func(txn *badger.Txn) error {
-		if v, err := txn.Get([]byte(LAST_SCANNED_BLOCK)); err == badger.ErrKeyNotFound {
+// loadCheckpoints returns the last bitcoin block we scanned and the last
+// transaction of the bmm chain we saw.
+func loadCheckpoints() (lastScannedBlock int, lastSpottedTxid chainhash.Hash, err error) {
+	err = db.View(func(txn store.Txn) error {
+		v, err := txn.Get(checkpointKey(LAST_SCANNED_BLOCK))
+		if err == store.ErrNotFound {
 			lastScannedBlock = GENESIS_BLOCK
-			lastSpottedTxid, _ = chainhash.NewHashFromStr(GENESIS_TXID)
+			if chain := currentBMMChain(); chain != nil {
+				lastSpottedTxid = chain.Genesis.TxHash()
+			} else {
+				genesis, _ := chainhash.NewHashFromStr(GENESIS_TXID)
+				lastSpottedTxid = *genesis
+			}
+			return nil
 		} else if err != nil {
 			return err
-		} else {
-			lastScannedBlock, _ = strconv.Atoi(v.String())
+		}
+		lastScannedBlock, _ = strconv.Atoi(string(v))
 
-			if v, err := txn.Get([]byte(LAST_SEEN_TXID)); err != nil {
-				return err
-			} else {
-				v.Value(func(val []byte) error {
-					lastSpottedTxid.SetBytes(val)
-					return nil
-				})
-			}
+		v, err = txn.Get(checkpointKey(LAST_SEEN_TXID))
+		if err != nil {
+			return err
 		}
+		return lastSpottedTxid.SetBytes(v)
+	})
+	return lastScannedBlock, lastSpottedTxid, err
+}
 
-		return nil
-	}); err != nil {
-		log.Fatal().Err(err).Msg("failed to load our bitcoin checkpoints")
+// scanNextBitcoinBlock looks for spends of the bmm chain in the bitcoin block
+// after the last one we scanned. it returns false if that block isn't there yet.
+func scanNextBitcoinBlock() (scanned bool, err error) {
+	lastScannedBlock, lastSpottedTxid, err := loadCheckpoints()
+	if err != nil {
+		return false, err
+	}
+	if reorged, err := checkBitcoinReorg(lastScannedBlock); err != nil || reorged {
+		return reorged, err
 	}
+	height := lastScannedBlock + 1
 
-	// instantiate variables
-	var (
-		relevantTxHash    chainhash.Hash
-		payingChild       *wire.MsgTx
-		spacechainBlockId metainfo.Hash
-		serializedBlock   []byte
-	)
+	hash, err := bitcoin.GetBlockHash(int64(height))
+	if err != nil {
+		log.Info().Int("block", height).
+			Msg("this block doesn't exist yet, let's wait 2 minutes")
+		return false, nil
+	}
 
-	// start scanning
-	for {
-		lastScannedBlock++
+	if tip, err := bitcoin.GetBlockCount(); err == nil {
+		emitSyncProgress(height, tip)
+	}
 
-		hash, err := bitcoin.GetBlockHash(int64(lastScannedBlock))
-		if err != nil {
-			log.Info().Int("block", lastScannedBlock).
-				Msg("this block doesn't exist yet, let's wait 2 minutes")
-			time.Sleep(2 * time.Minute)
-			continue
-		}
+	block, err := bitcoin.GetBlock(hash)
+	if err != nil {
+		log.Warn().Err(err).Int("block", height).Msg("failed to get block, trying again later")
+		return false, nil
+	}
+
+	// where we start, to go back to if everything we scan is reorged out
+	var start *scanEntry
+	if lastScannedBlock == GENESIS_BLOCK {
+		e := currentScanEntry(chainhash.Hash{}, lastSpottedTxid)
+		start = &e
+	}
 
-		block, _ := bitcoin.GetBlock(hash)
-		var relevantTx *wire.MsgTx
-		for _, tx := range block.Transactions {
-			for _, inp := range tx.TxIn {
-				if inp.PreviousOutPoint.Hash.IsEqual(lastSpottedTxid) {
-					// found. it means this tx contains the next spacechain block.
-					relevantTx = tx
-					goto foundTx
+	// the chain may be spent more than once in the same block, but a spend always
+	// comes after what it spends so a single pass finds all of them
+	for _, tx := range block.Transactions {
+		for _, inp := range tx.TxIn {
+			if inp.PreviousOutPoint.Hash == lastSpottedTxid && inp.PreviousOutPoint.Index == 0 {
+				if err := followBMMSpend(height, *hash, block, tx); err != nil {
+					return false, err
 				}
+				lastSpottedTxid = tx.TxHash()
+				break
 			}
 		}
+	}
 
-		// we didn't find anything, go to the next block.
-		goto saveCheckpoints
-
-	foundTx:
-		// this transaction contains a spacechain block
-		relevantTxHash = relevantTx.TxHash()
-		// let's find the child who is paying for it with CPFP
-		// it must be a transaction in this same block (please, miners)
-		for _, tx := range block.Transactions {
-			for _, inp := range tx.TxIn {
-				if inp.PreviousOutPoint.Hash.IsEqual(&relevantTxHash) {
-					payingChild = tx
-					goto foundChild
-				}
+	return true, db.Update(func(txn store.Txn) error {
+		if start != nil {
+			if err := saveScanEntry(txn, GENESIS_BLOCK, *start); err != nil {
+				return err
 			}
 		}
+		if err := saveScanEntry(txn, height, currentScanEntry(*hash, lastSpottedTxid)); err != nil {
+			return err
+		}
+		return saveCheckpoints(txn, height, &lastSpottedTxid)
+	})
+}
 
-		// we didn't find anything. it means miners did it wrong and not include
-		// both transactions in the same block.
-		log.Fatal().Int("block", lastScannedBlock).Str("tx", relevantTxHash.String()).
-			Msg("miners are wrong! please report.")
-
-	foundChild:
-		// now we search for an OP_RETURN here which contains the spacechain block id
-		for _, out := range payingChild.TxOut {
-			if bytes.HasPrefix(out.PkScript, []byte{
-				106 /* OP_RETURN */, 14 /* 20 bytes */}) {
-				for i, b := range out.PkScript[2:] {
-					spacechainBlockId[i] = b
-				}
-				break
+// followBMMSpend handles a transaction that spent output 0 of the last one we
+// followed. whatever spent it is followed from now on: the key that signs the
+// links is public, so anyone can spend the chain, and since every node sees the
+// same spends this is what keeps all of them on the same chain. if it has an
+// anchor spent by a CPFP child in the same block, the child commits to the next
+// spacechain block.
+func followBMMSpend(height int, hash chainhash.Hash, block *wire.MsgBlock, tx *wire.MsgTx) error {
+	txid := tx.TxHash()
+	log := log.With().Int("block", height).Stringer("tx", txid).Logger()
+
+	// the rest of this bitcoin block is still to be scanned after this
+	checkpoint := func(txn store.Txn) error {
+		return saveCheckpoints(txn, height-1, &txid)
+	}
+
+	chain := currentBMMChain()
+	if next := bmmExtension(chain, tx); next != nil {
+		// switching chains and moving past the genesis go together
+		if err := db.Update(func(txn store.Txn) error {
+			if err := saveBMMExtension(txn, chain, next); err != nil {
+				return err
 			}
+			return checkpoint(txn)
+		}); err != nil {
+			return err
 		}
+		switchBMMChain(next)
+		return nil
+	}
+	if chain != nil && !isCanonicalBMMLink(chain, tx) {
+		log.Warn().Msg("bmm chain was spent by a transaction that isn't in our bmm chain, following it anyway")
+	}
 
-		// later we can implement a queue here to download all blocks
-		// concurrently but process sequentially.
-		// for now let's just download sequentially too.
-		log.Info().Str("id", spacechainBlockId.HexString()).
-			Msg("downloading spacechain block")
-		serializedBlock = <-downloadBlock(spacechainBlockId)
+	child, spacechainBlockId, ok := findBMMChild(block, tx)
+	if !ok {
+		// miners did it wrong and didn't include both transactions in the same
+		// block, or it isn't a link at all
+		log.Warn().Msg("bmm chain was spent without committing to a spacechain block")
+		return db.Update(checkpoint)
+	}
 
-		err = addBlock(serializedBlock)
-		if err != nil {
-			log.Fatal().Err(err).Msg("failed to process block")
+	// later we can implement a queue here to download all blocks
+	// concurrently but process sequentially.
+	// for now let's just download sequentially too.
+	serializedBlock := downloadBlock(spacechainBlockId)
+
+	// the checkpoints are saved with the block, so we never apply it twice
+	err := addBlock(serializedBlock, func(txn store.Txn) error {
+		if err := saveAnchor(txn, spacechainBlockId, hash, child.TxHash()); err != nil {
+			return err
 		}
+		return checkpoint(txn)
+	})
+	if err != nil {
+		// every node rejects it the same way, the link was used anyway and
+		// the next block will build on the same tip
+		log.Error().Err(err).Stringer("spacechain-block", spacechainBlockId).
+			Msg("bmm link committed to an invalid spacechain block, skipping it")
+		return db.Update(checkpoint)
+	}
+	return nil
+}
 
-		// assign this here so we can save it
-		lastSpottedTxid = &relevantTxHash
+// findBMMChild finds the CPFP child that spends the anchor of a link in the
+// same bitcoin block and the spacechain block id in its OP_RETURN.
+func findBMMChild(block *wire.MsgBlock, link *wire.MsgTx) (child *wire.MsgTx, blockId metainfo.Hash, ok bool) {
+	if len(link.TxOut) < 2 || !common.IsBMMAnchor(link.TxOut[1].PkScript) {
+		return nil, blockId, false
+	}
 
-	saveCheckpoints:
-		// save checkpoints
-		if err := kvdb.Update(func(txn *badger.Txn) error {
-			if err := txn.Set(
-				[]byte(LAST_SCANNED_BLOCK),
-				[]byte(strconv.Itoa(lastScannedBlock)),
-			); err != nil {
-				return err
+	anchor := wire.OutPoint{Hash: link.TxHash(), Index: 1}
+	for _, tx := range block.Transactions {
+		for _, inp := range tx.TxIn {
+			if inp.PreviousOutPoint != anchor {
+				continue
 			}
-
-			if err := txn.Set(
-				[]byte(LAST_SEEN_TXID),
-				relevantTxHash[:],
-			); err != nil {
-				return err
+			for _, out := range tx.TxOut {
+				if blockId, ok := common.ParseBMMBlockId(out.PkScript); ok {
+					return tx, blockId, true
+				}
 			}
-
-			return nil
-		}); err != nil {
-			log.Fatal().Err(err).Msg("failed to save checkpoints on db")
+			return nil, blockId, false
 		}
 	}
+	return nil, blockId, false
+}
+
+func saveCheckpoints(txn store.Txn, lastScannedBlock int, lastSpottedTxid *chainhash.Hash) error {
+	if err := txn.Set(
+		checkpointKey(LAST_SCANNED_BLOCK),
+		[]byte(strconv.Itoa(lastScannedBlock)),
+	); err != nil {
+		return err
+	}
+
+	return txn.Set(
+		checkpointKey(LAST_SEEN_TXID),
+		lastSpottedTxid[:],
+	)
+}
+
+// saveAnchor remembers where in bitcoin a block was committed to, for proofs.
+func saveAnchor(txn store.Txn, id metainfo.Hash, bitcoinBlock chainhash.Hash, child chainhash.Hash) error {
+	return txn.Set(anchorKey(id), append(bitcoinBlock[:], child[:]...))
+}
+
+func loadAnchor(id metainfo.Hash) (bitcoinBlock chainhash.Hash, child chainhash.Hash, err error) {
+	err = db.View(func(txn store.Txn) error {
+		v, err := txn.Get(anchorKey(id))
+		if err != nil {
+			return err
+		}
+		if len(v) != 64 {
+			return errors.New("invalid anchor")
+		}
+		copy(bitcoinBlock[:], v[0:32])
+		copy(child[:], v[32:64])
+		return nil
+	})
+	return bitcoinBlock, child, err
 }
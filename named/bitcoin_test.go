@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/fakebitcoin"
+)
+
+// memBlockSource keeps blocks in memory, it stands in for the torrent client.
+type memBlockSource struct {
+	sync.Mutex
+	blocks map[metainfo.Hash][]byte
+}
+
+func (source *memBlockSource) Publish(serializedBlock []byte) (metainfo.Hash, error) {
+	block, err := common.ParseBlock(serializedBlock)
+	if err != nil {
+		return block.ID, err
+	}
+	source.Lock()
+	defer source.Unlock()
+	source.blocks[block.ID] = serializedBlock
+	return block.ID, nil
+}
+
+func (source *memBlockSource) Fetch(id metainfo.Hash, timeout time.Duration) ([]byte, error) {
+	source.Lock()
+	defer source.Unlock()
+	if block, ok := source.blocks[id]; ok {
+		return block, nil
+	}
+	return nil, errors.New("block not published")
+}
+
+func (source *memBlockSource) Close() error { return nil }
+
+// newTestBitcoin starts a fake bitcoin chain with the genesis of a bmm chain of
+// n links mined on it, and makes them the ones named uses.
+func newTestBitcoin(t *testing.T, n int) *fakebitcoin.Chain {
+	t.Helper()
+
+	chain := fakebitcoin.New(GENESIS_BLOCK)
+	funding := chain.Fund(common.BMMFundingAmount(n, common.BMM_FORMAT_P2WPKH))
+	params := common.BMMParams{Network: "regtest", BlockInterval: 1}
+	_, pk := common.BMMKey(funding, params, n)
+
+	genesis := wire.NewMsgTx(2)
+	genesis.AddTxIn(wire.NewTxIn(&funding, nil, nil))
+	genesis.AddTxOut(wire.NewTxOut(common.BMMFundingAmount(n, common.BMM_FORMAT_P2WPKH), common.BMMScript(pk, common.BMM_FORMAT_P2WPKH)))
+	if _, err := chain.Mine(genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	derived, err := common.DeriveBMMChain(genesis, params, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setBMMChain(derived)
+	t.Cleanup(func() { setBMMChain(nil) })
+
+	openBitcoin = func() common.BitcoinBackend { return chain }
+	newBlockSource = func() (common.BlockSource, error) {
+		return &memBlockSource{blocks: make(map[metainfo.Hash][]byte)}, nil
+	}
+	connectBitcoin()
+	openBlockSource()
+	return chain
+}
+
+// bmmChild commits to a spacechain block by spending the anchor of link.
+func bmmChild(link *wire.MsgTx, blockId metainfo.Hash) *wire.MsgTx {
+	linkHash := link.TxHash()
+	child := wire.NewMsgTx(2)
+	child.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&linkHash, 1), nil, nil))
+	child.AddTxOut(wire.NewTxOut(0, common.BMMBlockIdScript(blockId)))
+	return child
+}
+
+// publishTestBlock makes a valid block with txs on top of our tip and
+// publishes it without adding it.
+func publishTestBlock(t *testing.T, txs ...common.Transaction) common.Block {
+	t.Helper()
+	block, err := newBlock(txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.ID, err = blockSource.Publish(block.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// syncBitcoin scans bitcoin blocks until we reach the tip.
+func syncBitcoin(t *testing.T) {
+	t.Helper()
+	for {
+		scanned, err := scanNextBitcoinBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !scanned {
+			return
+		}
+	}
+}
+
+func lastSpotted(t *testing.T) chainhash.Hash {
+	t.Helper()
+	_, txid, err := loadCheckpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return txid
+}
+
+func TestFollowsNonCanonicalSpends(t *testing.T) {
+	for _, withChain := range []bool{true, false} {
+		newTestChain(t)
+		chain := newTestBitcoin(t, 5)
+		_, alice := testKey("alice")
+		syncBitcoin(t)
+		script := currentBMMChain().Genesis.TxOut[0].PkScript
+		if !withChain {
+			// we only know where the chain starts
+			setBMMChain(nil)
+		}
+
+		// a third party spends the genesis with the public key, but to the
+		// same script and with an anchor, so it can carry a block
+		genesis := lastSpotted(t)
+		spend := wire.NewMsgTx(2)
+		spend.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&genesis, 0), nil, nil))
+		spend.AddTxOut(wire.NewTxOut(common.P2WPKH_DUST*3, script))
+		spend.AddTxOut(wire.NewTxOut(common.P2WPKH_DUST, common.BMMAnchorScript(common.BMM_FORMAT_P2WPKH)))
+
+		block := publishTestBlock(t, acquireTx("first", alice))
+		if _, err := chain.Mine(spend, bmmChild(spend, block.ID)); err != nil {
+			t.Fatal(err)
+		}
+		syncBitcoin(t)
+
+		if height, tip := chainstate.Current(); height != 1 || tip != block.ID {
+			t.Fatalf("with chain %v: block on the non-canonical spend wasn't added", withChain)
+		}
+		if lastSpotted(t) != spend.TxHash() {
+			t.Fatalf("with chain %v: we aren't following the spend", withChain)
+		}
+
+		// and then spent again, twice in the same bitcoin block, without blocks
+		spendHash := spend.TxHash()
+		again := wire.NewMsgTx(2)
+		again.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&spendHash, 0), nil, nil))
+		again.AddTxOut(wire.NewTxOut(common.P2WPKH_DUST*2, script))
+		againHash := again.TxHash()
+		twice := wire.NewMsgTx(2)
+		twice.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&againHash, 0), nil, nil))
+		twice.AddTxOut(wire.NewTxOut(common.P2WPKH_DUST, script))
+		if _, err := chain.Mine(again, twice); err != nil {
+			t.Fatal(err)
+		}
+		syncBitcoin(t)
+
+		if lastSpotted(t) != twice.TxHash() {
+			t.Fatalf("with chain %v: we didn't follow both spends in the same block", withChain)
+		}
+	}
+}
+
+// mineLink mines the next link of our bmm chain with a child committing to
+// block, or without one if block is nil.
+func mineLink(t *testing.T, chain *fakebitcoin.Chain, n int, block *common.Block) {
+	t.Helper()
+	link := currentBMMChain().Links[n-1]
+	txs := []*wire.MsgTx{link}
+	if block != nil {
+		txs = append(txs, bmmChild(link, block.ID))
+	}
+	if _, err := chain.Mine(txs...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtensionIsFollowedByEveryNode(t *testing.T) {
+	for _, withChain := range []bool{true, false} {
+		newTestChain(t)
+		chain := newTestBitcoin(t, 2)
+		_, alice := testKey("alice")
+		syncBitcoin(t)
+		previous := currentBMMChain()
+
+		for n := 1; n <= 2; n++ {
+			block := publishTestBlock(t, acquireTx(fmt.Sprintf("name%d", n), alice))
+			mineLink(t, chain, n, &block)
+			syncBitcoin(t)
+		}
+
+		funding := chain.Fund(100000)
+		extension, err := common.BuildBMMExtension(previous, common.BMMParams{BlockInterval: 1}, 3,
+			common.PrevOut{OutPoint: funding, PkScript: fakebitcoin.WalletScript, Value: 100000},
+			fakebitcoin.WalletScript, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := chain.Mine(extension); err != nil {
+			t.Fatal(err)
+		}
+
+		if !withChain {
+			setBMMChain(nil)
+		}
+		syncBitcoin(t)
+
+		if loaded := currentBMMChain(); loaded == nil || loaded.Genesis.TxHash() != extension.TxHash() {
+			t.Fatalf("with chain %v: didn't switch to the extension", withChain)
+		}
+		if lastSpotted(t) != extension.TxHash() {
+			t.Fatalf("with chain %v: we aren't following the extension", withChain)
+		}
+
+		// blocks keep coming through the new chain
+		block := publishTestBlock(t, acquireTx("extended", alice))
+		mineLink(t, chain, 1, &block)
+		syncBitcoin(t)
+		if height, tip := chainstate.Current(); height != 3 || tip != block.ID {
+			t.Fatalf("with chain %v: block on the extension wasn't added", withChain)
+		}
+
+		// and we load it again after a restart
+		extended := currentBMMChain()
+		setBMMChain(nil)
+		loadBMMChain()
+		if loaded := currentBMMChain(); loaded == nil || loaded.Genesis.TxHash() != extended.Genesis.TxHash() ||
+			len(loaded.Links) != 3 {
+			t.Fatalf("with chain %v: extended chain wasn't loaded from the database", withChain)
+		}
+	}
+}
+
+func TestBitcoinReorgUndoesBlocks(t *testing.T) {
+	newTestChain(t)
+	chain := newTestBitcoin(t, 3)
+	_, alice := testKey("alice")
+	syncBitcoin(t)
+
+	sub := subscribe()
+	defer sub.unsubscribe()
+	sub.topics[EVENT_REORG] = true
+
+	kept := publishTestBlock(t, acquireTx("kept", alice))
+	mineLink(t, chain, 1, &kept)
+	syncBitcoin(t)
+	dropped := publishTestBlock(t, acquireTx("dropped", alice))
+	replacement := publishTestBlock(t, acquireTx("replacement", alice))
+	mineLink(t, chain, 2, &dropped)
+	syncBitcoin(t)
+	if height, tip := chainstate.Current(); height != 2 || tip != dropped.ID {
+		t.Fatal("block before the reorg wasn't added")
+	}
+
+	// the bitcoin block with the second link is reorged out and a third party
+	// spend of the first link, paying more fees, takes its place
+	if err := chain.Reorg(1); err != nil {
+		t.Fatal(err)
+	}
+	link := currentBMMChain().Links[1]
+	spend := wire.NewMsgTx(2)
+	spend.AddTxIn(link.TxIn[0])
+	spend.AddTxOut(wire.NewTxOut(link.TxOut[0].Value-10000, link.TxOut[0].PkScript))
+	spend.AddTxOut(link.TxOut[1])
+	if _, err := chain.Mine(spend, bmmChild(spend, replacement.ID)); err != nil {
+		t.Fatal(err)
+	}
+	syncBitcoin(t)
+
+	if height, tip := chainstate.Current(); height != 2 || tip != replacement.ID {
+		t.Fatal("block from the new bitcoin branch wasn't added")
+	}
+	if lastSpotted(t) != spend.TxHash() {
+		t.Fatal("we aren't following the spend in the new branch")
+	}
+	if _, ok := chainstate.Name(sha256.Sum256([]byte("dropped"))); ok {
+		t.Fatal("name from the reorged out block is still there")
+	}
+	if _, ok := chainstate.Name(sha256.Sum256([]byte("kept"))); !ok {
+		t.Fatal("name from before the fork is gone")
+	}
+	if err := checkChainState(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-sub.events:
+		if event.Data.(map[string]interface{})["disconnected"] != dropped.ID.HexString() {
+			t.Fatalf("reorg event for the wrong block: %v", event.Data)
+		}
+	default:
+		t.Fatal("no reorg event")
+	}
+}
+
+func TestBitcoinReorgGoesBackToThePreviousBMMChain(t *testing.T) {
+	newTestChain(t)
+	chain := newTestBitcoin(t, 1)
+	_, alice := testKey("alice")
+	syncBitcoin(t)
+	previous := currentBMMChain()
+
+	block := publishTestBlock(t, acquireTx("first", alice))
+	mineLink(t, chain, 1, &block)
+	syncBitcoin(t)
+
+	funding := chain.Fund(100000)
+	extension, err := common.BuildBMMExtension(previous, common.BMMParams{BlockInterval: 1}, 1,
+		common.PrevOut{OutPoint: funding, PkScript: fakebitcoin.WalletScript, Value: 100000},
+		fakebitcoin.WalletScript, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Mine(extension); err != nil {
+		t.Fatal(err)
+	}
+	syncBitcoin(t)
+	if currentBMMChain().Genesis.TxHash() != extension.TxHash() {
+		t.Fatal("didn't switch to the extension")
+	}
+
+	// the block that funded the extension is reorged out too, so it can't be
+	// mined again in the new branch
+	if err := chain.Reorg(2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := chain.Mine(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syncBitcoin(t)
+
+	if currentBMMChain().Genesis.TxHash() != previous.Genesis.TxHash() {
+		t.Fatal("didn't go back to the previous bmm chain")
+	}
+	last := previous.Links[0].TxHash()
+	if lastSpotted(t) != last {
+		t.Fatal("we aren't following the previous chain from its last link")
+	}
+	setBMMChain(nil)
+	loadBMMChain()
+	if loaded := currentBMMChain(); loaded == nil || loaded.Genesis.TxHash() != previous.Genesis.TxHash() {
+		t.Fatal("previous bmm chain wasn't saved as the one to load")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/store"
+)
+
+// the chain of pre-signed BMM transactions saved by bmm/generate. it's only
+// needed to mine, all nodes follow the spends from its genesis (or GENESIS_TXID)
+// whether they have it or not. the watcher replaces it when the chain is
+// extended or reorged, so everybody else takes one with currentBMMChain and
+// uses that for the whole operation.
+var bmm = struct {
+	sync.RWMutex
+	chain *common.BMMChain
+}{}
+
+// currentBMMChain is nil if we don't have one.
+func currentBMMChain() *common.BMMChain {
+	bmm.RLock()
+	defer bmm.RUnlock()
+	return bmm.chain
+}
+
+func setBMMChain(chain *common.BMMChain) {
+	bmm.Lock()
+	defer bmm.Unlock()
+	bmm.chain = chain
+}
+
+// the chain we follow after an extension, in the checkpoints bucket so it is
+// saved together with the checkpoint that follows it.
+const BMM_CHAIN = "bmm-chain"
+
+func loadBMMChain() {
+	// a chain we switched to is newer than whatever is in the file
+	var stored []byte
+	if err := db.View(func(txn store.Txn) (err error) {
+		stored, err = txn.Get(checkpointKey(BMM_CHAIN))
+		return err
+	}); err == nil {
+		chain, err := common.DecodeBMMChain(stored)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to decode the bmm chain saved in the database")
+		}
+		setBMMChain(chain)
+		log.Info().Str("genesis", chain.Genesis.TxHash().String()).
+			Int("links", len(chain.Links)).Msg("loaded extended bmm chain")
+		return
+	} else if err != store.ErrNotFound {
+		log.Fatal().Err(err).Msg("failed to load the bmm chain saved in the database")
+	}
+
+	path := filepath.Join(config.DataDir, common.BMMCHAIN_FILE)
+	chain, err := common.LoadBMMChain(path)
+	if os.IsNotExist(err) {
+		log.Info().Str("path", path).Msg("no bmm chain file, we won't be able to mine")
+		return
+	} else if err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("failed to load bmm chain")
+	}
+
+	if err := common.VerifyBMMChain(chain); err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("bmm chain isn't the canonical one")
+	}
+
+	setBMMChain(chain)
+	log.Info().Str("genesis", chain.Genesis.TxHash().String()).
+		Int("links", len(chain.Links)).Str("network", chain.Params.Network).
+		Msg("loaded bmm chain")
+}
+
+// nextBMMLink returns the 1-based index of the first link of chain that wasn't
+// used yet.
+func nextBMMLink(chain *common.BMMChain) (int, error) {
+	return common.FindNextBMMLink(bitcoin, chain)
+}
+
+// isCanonicalBMMLink checks if a transaction that spent the previous link is one
+// of the links of chain, it's false if we don't have one.
+func isCanonicalBMMLink(chain *common.BMMChain, tx *wire.MsgTx) bool {
+	if chain == nil {
+		return false
+	}
+
+	txid := tx.TxHash()
+	for _, link := range chain.Links {
+		if link.TxHash() == txid {
+			return true
+		}
+	}
+	return false
+}
+
+// bmmExtension derives the chain that starts at tx if it is a new genesis with
+// the extension parameters (see common.BMMExtensionScript). the parameters are
+// in the transaction, so every node derives the same chain whether it had the
+// previous one or not. the key of the previous chain is public so anyone could
+// have made it, but whichever confirmed is the one all nodes follow and all
+// miners can use.
+func bmmExtension(previous *common.BMMChain, tx *wire.MsgTx) *common.BMMChain {
+	network := ""
+	if previous != nil {
+		network = previous.Params.Network
+	}
+
+	next, err := common.DeriveBMMExtension(tx, network)
+	if err != nil {
+		return nil
+	}
+	return next
+}
+
+// saveBMMExtension saves the chain we'll follow from now on within txn, the
+// caller must switch to it once txn is committed.
+// both chains are also kept by genesis so a reorg can go back to the previous
+// one even after the file was replaced.
+func saveBMMExtension(txn store.Txn, previous *common.BMMChain, next *common.BMMChain) error {
+	if previous != nil {
+		if err := txn.Set(bmmChainKey(previous.Genesis.TxHash()), common.EncodeBMMChain(previous)); err != nil {
+			return err
+		}
+	}
+	encoded := common.EncodeBMMChain(next)
+	if err := txn.Set(bmmChainKey(next.Genesis.TxHash()), encoded); err != nil {
+		return err
+	}
+	return txn.Set(checkpointKey(BMM_CHAIN), encoded)
+}
+
+// restoreBMMChain goes back to the chain with this genesis within txn after a
+// reorg. it returns the chain to switch to once txn is committed, or nil if we
+// didn't have one then.
+func restoreBMMChain(txn store.Txn, genesis chainhash.Hash) (*common.BMMChain, error) {
+	encoded, err := txn.Get(bmmChainKey(genesis))
+	if err == store.ErrNotFound {
+		if err := txn.Delete(checkpointKey(BMM_CHAIN)); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	chain, err := common.DecodeBMMChain(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return chain, txn.Set(checkpointKey(BMM_CHAIN), encoded)
+}
+
+// switchBMMChain starts using the chain we saved, also over the chain file if
+// there is one so the bmm tools use it too.
+func switchBMMChain(next *common.BMMChain) {
+	log := log.With().Str("genesis", next.Genesis.TxHash().String()).
+		Int("links", len(next.Links)).Logger()
+
+	if previous := currentBMMChain(); previous != nil {
+		path := filepath.Join(config.DataDir, common.BMMCHAIN_FILE)
+		if _, err := os.Stat(path); err == nil {
+			if err := common.ReplaceBMMChain(path, previous, next); err != nil {
+				log.Error().Err(err).Str("path", path).
+					Msg("failed to save extended bmm chain to file, it is still in the database")
+			}
+		}
+		log = log.With().Str("previous", previous.Genesis.TxHash().String()).Logger()
+	}
+
+	log.Info().Msg("switched bmm chain")
+	setBMMChain(next)
+}
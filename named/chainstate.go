@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/store"
+)
+
+// ChainState is the in-memory copy of the chainstate on disk. it's only changed
+// by addBlock and undoBlocks, while holding the lock and right after the same
+// change was committed to disk, so readers never see anything else.
+type ChainState struct {
+	sync.RWMutex
+
+	BlockHeight int
+	Tip         metainfo.Hash         // zero before the first block
+	KnownNames  map[[32]byte]NameData // name hash: data
+	Tree        *common.StateTree     // the same names, for the state root
+}
+
+var chainstate = &ChainState{
+	KnownNames: make(map[[32]byte]NameData),
+	Tree:       common.NewStateTree(),
+}
+
+func loadChainState() error {
+	height, tip, names, err := readChainState()
+	if err != nil {
+		return err
+	}
+
+	chainstate.Lock()
+	chainstate.BlockHeight = height
+	chainstate.Tip = tip
+	chainstate.KnownNames = names
+	chainstate.Tree = buildStateTree(names)
+	root := chainstate.Tree.Root()
+	chainstate.Unlock()
+
+	log.Info().Int("height", height).Str("tip", tip.HexString()).
+		Int("names", len(names)).Hex("root", root[:]).Msg("loaded chainstate")
+	return nil
+}
+
+// readChainState reads the chainstate from disk.
+func readChainState() (height int, tip metainfo.Hash, names map[[32]byte]NameData, err error) {
+	names = make(map[[32]byte]NameData)
+	err = db.View(func(txn store.Txn) error {
+		v, err := txn.Get(checkpointKey(BLOCK_HEIGHT))
+		if err == store.ErrNotFound {
+			// no blocks yet
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if height, err = strconv.Atoi(string(v)); err != nil {
+			return fmt.Errorf("invalid block height '%s'", v)
+		}
+
+		if height > 0 {
+			id, err := txn.Get(heightKey(height))
+			if err != nil {
+				return fmt.Errorf("no block at the tip height %d: %w", height, err)
+			}
+			copy(tip[:], id)
+		}
+
+		return txn.ForEach(BUCKET_NAMES, func(key, value []byte) error {
+			var nameHash [32]byte
+			copy(nameHash[:], key[len(BUCKET_NAMES):])
+			names[nameHash] = decodeNameData(value)
+			return nil
+		})
+	})
+	return height, tip, names, err
+}
+
+func buildStateTree(names map[[32]byte]NameData) *common.StateTree {
+	tree := common.NewStateTree()
+	for nameHash, nd := range names {
+		tree.Set(nameHash, nameDataHash(nd))
+	}
+	return tree
+}
+
+func nameDataHash(nd NameData) [32]byte {
+	return common.NameDataHash(nd.Key, nd.Name, nd.DataBlobInfoHash)
+}
+
+// Current returns the height and the id of the latest block.
+func (cs *ChainState) Current() (height int, tip metainfo.Hash) {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	return cs.BlockHeight, cs.Tip
+}
+
+// Root returns the state root at the tip.
+func (cs *ChainState) Root() [32]byte {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	return cs.Tree.Root()
+}
+
+func (cs *ChainState) Name(nameHash [32]byte) (nd NameData, ok bool) {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	nd, ok = cs.KnownNames[nameHash]
+	return nd, ok
+}
+
+// checkChainState compares what we have in memory with what is on disk.
+func checkChainState() error {
+	chainstate.RLock()
+	defer chainstate.RUnlock()
+
+	height, tip, names, err := readChainState()
+	if err != nil {
+		return err
+	}
+
+	if height != chainstate.BlockHeight {
+		return fmt.Errorf("height is %d in memory but %d on disk", chainstate.BlockHeight, height)
+	}
+	if tip != chainstate.Tip {
+		return fmt.Errorf("tip is %s in memory but %s on disk",
+			chainstate.Tip.HexString(), tip.HexString())
+	}
+	if len(names) != len(chainstate.KnownNames) {
+		return fmt.Errorf("there are %d names in memory but %d on disk",
+			len(chainstate.KnownNames), len(names))
+	}
+	for nameHash, nd := range names {
+		if known, ok := chainstate.KnownNames[nameHash]; !ok || known != nd {
+			return fmt.Errorf("name %x differs from disk", nameHash)
+		}
+	}
+
+	if chainstate.Tree.Len() != len(names) {
+		return fmt.Errorf("there are %d names in the state tree but %d on disk",
+			chainstate.Tree.Len(), len(names))
+	}
+	root := chainstate.Tree.Root()
+	if diskRoot := buildStateTree(names).Root(); root != diskRoot {
+		return fmt.Errorf("state root is %x in memory but %x on disk", root, diskRoot)
+	}
+	if height > 0 {
+		if saved, err := loadStateRoot(tip); err == nil && saved != root {
+			return fmt.Errorf("state root is %x but %x was saved for the tip", root, saved)
+		} else if err != nil && err != store.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadStateRoot returns the state root saved after a block. blocks added by
+// older versions don't have one.
+func loadStateRoot(id metainfo.Hash) (root [32]byte, err error) {
+	err = db.View(func(txn store.Txn) error {
+		v, err := txn.Get(rootKey(id))
+		if err != nil {
+			return err
+		}
+		copy(root[:], v)
+		return nil
+	})
+	return root, err
+}
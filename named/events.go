@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/fiatjaf/namechain/common"
+)
+
+const (
+	EVENT_NEWBLOCK     = "newblock"
+	EVENT_NAMECHANGED  = "namechanged"
+	EVENT_REORG        = "reorg"
+	EVENT_SYNCPROGRESS = "syncprogress"
+
+	// how many events can be waiting to be delivered to a subscriber before we
+	// consider it too slow and drop it.
+	SUBSCRIBER_BUFFER = 256
+)
+
+type Event struct {
+	Topic string      `json:"topic"`
+	Data  interface{} `json:"data"`
+}
+
+type subscriber struct {
+	events chan Event
+	slow   chan struct{} // closed when the subscriber can't keep up
+
+	mu     sync.Mutex
+	topics map[string]bool
+	names  map[[32]byte]bool // filter for namechanged, empty means all names
+}
+
+var subscribers = struct {
+	sync.Mutex
+	m map[*subscriber]struct{}
+}{m: make(map[*subscriber]struct{})}
+
+func subscribe() *subscriber {
+	sub := &subscriber{
+		events: make(chan Event, SUBSCRIBER_BUFFER),
+		slow:   make(chan struct{}),
+		topics: make(map[string]bool),
+		names:  make(map[[32]byte]bool),
+	}
+
+	subscribers.Lock()
+	subscribers.m[sub] = struct{}{}
+	subscribers.Unlock()
+
+	return sub
+}
+
+func (sub *subscriber) unsubscribe() {
+	subscribers.Lock()
+	delete(subscribers.m, sub)
+	subscribers.Unlock()
+}
+
+func (sub *subscriber) wants(topic string, nameHash *[32]byte) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if !sub.topics[topic] {
+		return false
+	}
+	if nameHash != nil && len(sub.names) > 0 {
+		return sub.names[*nameHash]
+	}
+	return true
+}
+
+// emitEvent never blocks. subscribers whose buffer is full are signaled through
+// their 'slow' channel and removed, so they must reconnect and catch up.
+func emitEvent(topic string, data interface{}, nameHash *[32]byte) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+
+	for sub := range subscribers.m {
+		if !sub.wants(topic, nameHash) {
+			continue
+		}
+
+		select {
+		case sub.events <- Event{topic, data}:
+		default:
+			delete(subscribers.m, sub)
+			close(sub.slow)
+		}
+	}
+}
+
+func emitNewBlock(block common.Block, height int) {
+	emitEvent(EVENT_NEWBLOCK, map[string]interface{}{
+		"id":           block.ID.HexString(),
+		"height":       height,
+		"previous":     block.PreviousBlock.HexString(),
+		"transactions": len(block.Transactions),
+	}, nil)
+}
+
+func emitNameChanged(nameHash [32]byte, nd NameData, blockId metainfo.Hash) {
+	emitEvent(EVENT_NAMECHANGED, map[string]interface{}{
+		"namehash": hex.EncodeToString(nameHash[:]),
+		"name":     nd.Name,
+		"key":      hex.EncodeToString(nd.Key[:]),
+		"infohash": hex.EncodeToString(nd.DataBlobInfoHash[:]),
+		"block":    blockId.HexString(),
+	}, &nameHash)
+}
+
+func emitReorg(disconnected metainfo.Hash, height int) {
+	emitEvent(EVENT_REORG, map[string]interface{}{
+		"disconnected": disconnected.HexString(),
+		"height":       height,
+	}, nil)
+}
+
+func emitSyncProgress(scanned int, tip int64) {
+	emitEvent(EVENT_SYNCPROGRESS, map[string]interface{}{
+		"scanned": scanned,
+		"tip":     tip,
+	}, nil)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/namechain/common"
+	"golang.org/x/time/rate"
+)
+
+// a tiny protocol for relaying pending namechain transactions between named
+// instances so their mempools converge. every message is framed as
+//
+//	<type: 1 byte> <payload length: 4 bytes, big-endian> <payload>
+//
+// INV and GETDATA payloads are lists of 32-byte transaction hashes, TX payloads
+// are a single serialized transaction.
+const (
+	MSG_INV     uint8 = 1
+	MSG_GETDATA uint8 = 2
+	MSG_TX      uint8 = 3
+
+	GOSSIP_MAX_HASHES  = 1000
+	GOSSIP_MAX_PAYLOAD = 32 * GOSSIP_MAX_HASHES
+
+	// each peer can send us this many items (hashes or transactions) per second,
+	// with some burst allowed. after too many dropped messages we disconnect it.
+	GOSSIP_RATE          = 50
+	GOSSIP_BURST         = GOSSIP_MAX_HASHES
+	GOSSIP_MAX_VIOLATION = 20
+
+	// how long we wait for a peer to answer a GETDATA before asking someone else
+	GOSSIP_REQUEST_TIMEOUT = 30 * time.Second
+)
+
+type gossipMessage struct {
+	Type    uint8
+	Payload []byte
+}
+
+type gossipPeer struct {
+	addr    string
+	conn    net.Conn
+	send    chan gossipMessage
+	limiter *rate.Limiter
+
+	mu         sync.Mutex
+	known      map[[32]byte]bool // hashes this peer already has
+	violations int
+}
+
+var gossip = struct {
+	sync.Mutex
+	peers     map[*gossipPeer]struct{}
+	requested map[[32]byte]time.Time // hashes we've asked for and are waiting
+	expired   time.Time              // last time we forgot the requests nobody answered
+}{
+	peers:     make(map[*gossipPeer]struct{}),
+	requested: make(map[[32]byte]time.Time),
+}
+
+func listenGossip() {
+	listener, err := net.Listen("tcp", config.GossipAddr)
+	if err != nil {
+		log.Error().Err(err).Str("addr", config.GossipAddr).
+			Msg("failed to listen for gossip peers")
+		return
+	}
+	log.Info().Str("addr", config.GossipAddr).Msg("listening for gossip peers")
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Warn().Err(err).Msg("error accepting gossip connection")
+			continue
+		}
+		go handleGossipPeer(conn)
+	}
+}
+
+func connectGossipPeers() {
+	for _, addr := range config.Peers {
+		go func(addr string) {
+			// keep reconnecting forever
+			for {
+				conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+				if err != nil {
+					log.Debug().Err(err).Str("peer", addr).
+						Msg("failed to connect to gossip peer")
+				} else {
+					handleGossipPeer(conn)
+				}
+				time.Sleep(time.Minute)
+			}
+		}(addr)
+	}
+}
+
+// handleGossipPeer blocks until the connection is closed.
+func handleGossipPeer(conn net.Conn) {
+	peer := &gossipPeer{
+		addr:    conn.RemoteAddr().String(),
+		conn:    conn,
+		send:    make(chan gossipMessage, 100),
+		limiter: rate.NewLimiter(GOSSIP_RATE, GOSSIP_BURST),
+		known:   make(map[[32]byte]bool),
+	}
+	log := log.With().Str("peer", peer.addr).Logger()
+	log.Info().Msg("gossip peer connected")
+
+	gossip.Lock()
+	gossip.peers[peer] = struct{}{}
+	gossip.Unlock()
+
+	defer func() {
+		gossip.Lock()
+		delete(gossip.peers, peer)
+		gossip.Unlock()
+		close(peer.send)
+		conn.Close()
+		log.Info().Msg("gossip peer disconnected")
+	}()
+
+	// writer
+	go func() {
+		w := bufio.NewWriter(conn)
+		for msg := range peer.send {
+			if err := writeGossipMessage(w, msg); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	// tell the peer about everything we have
+	hashes := mempool.Hashes()
+	for i := 0; i < len(hashes); i += GOSSIP_MAX_HASHES {
+		end := i + GOSSIP_MAX_HASHES
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		peer.queue(gossipMessage{MSG_INV, encodeHashes(hashes[i:end])})
+	}
+
+	// reader
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := readGossipMessage(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Debug().Err(err).Msg("error reading gossip message")
+			}
+			return
+		}
+
+		if err := peer.handle(msg); err != nil {
+			log.Warn().Err(err).Uint8("type", msg.Type).Msg("bad gossip message")
+			if peer.violate() {
+				return
+			}
+		}
+	}
+}
+
+func (peer *gossipPeer) handle(msg gossipMessage) error {
+	switch msg.Type {
+	case MSG_INV:
+		hashes, err := decodeHashes(msg.Payload)
+		if err != nil {
+			return err
+		}
+		if !peer.limiter.AllowN(time.Now(), len(hashes)) {
+			return errors.New("rate limited")
+		}
+
+		var wanted [][32]byte
+		now := time.Now()
+		gossip.Lock()
+		expireGossipRequests(now)
+		for _, hash := range hashes {
+			peer.markKnown(hash)
+			if mempool.Has(hash) {
+				continue
+			}
+			if at, ok := gossip.requested[hash]; ok && now.Sub(at) < GOSSIP_REQUEST_TIMEOUT {
+				continue
+			}
+			gossip.requested[hash] = now
+			wanted = append(wanted, hash)
+		}
+		gossip.Unlock()
+
+		if len(wanted) > 0 {
+			peer.queue(gossipMessage{MSG_GETDATA, encodeHashes(wanted)})
+		}
+	case MSG_GETDATA:
+		hashes, err := decodeHashes(msg.Payload)
+		if err != nil {
+			return err
+		}
+		if !peer.limiter.AllowN(time.Now(), len(hashes)) {
+			return errors.New("rate limited")
+		}
+
+		for _, hash := range hashes {
+			if tx, ok := mempool.Get(hash); ok {
+				peer.markKnown(hash)
+				peer.queue(gossipMessage{MSG_TX, tx.Serialize()})
+			}
+		}
+	case MSG_TX:
+		if !peer.limiter.Allow() {
+			return errors.New("rate limited")
+		}
+
+		tx, err := common.ParseTransaction(msg.Payload)
+		if err != nil {
+			return err
+		}
+		hash := tx.Hash()
+		peer.markKnown(hash)
+
+		gossip.Lock()
+		_, wasRequested := gossip.requested[hash]
+		delete(gossip.requested, hash)
+		gossip.Unlock()
+		if !wasRequested {
+			return errors.New("unrequested transaction")
+		}
+
+		if err := acceptTransaction(tx); err != nil {
+			return fmt.Errorf("invalid transaction: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown message type %d", msg.Type)
+	}
+
+	return nil
+}
+
+// expireGossipRequests forgets the requests that weren't answered in time, so
+// peers can't make the map grow by announcing what they never send. it must be
+// called with the gossip lock held.
+func expireGossipRequests(now time.Time) {
+	if now.Sub(gossip.expired) < GOSSIP_REQUEST_TIMEOUT {
+		return
+	}
+	for hash, at := range gossip.requested {
+		if now.Sub(at) >= GOSSIP_REQUEST_TIMEOUT {
+			delete(gossip.requested, hash)
+		}
+	}
+	gossip.expired = now
+}
+
+// violate returns true if the peer has misbehaved too much and should be dropped.
+func (peer *gossipPeer) violate() bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.violations++
+	return peer.violations > GOSSIP_MAX_VIOLATION
+}
+
+func (peer *gossipPeer) markKnown(hash [32]byte) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.known[hash] = true
+}
+
+func (peer *gossipPeer) knows(hash [32]byte) bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return peer.known[hash]
+}
+
+// queue never blocks: if the peer isn't reading fast enough it just misses messages.
+func (peer *gossipPeer) queue(msg gossipMessage) {
+	select {
+	case peer.send <- msg:
+	default:
+		log.Debug().Str("peer", peer.addr).Msg("gossip send queue full, dropping message")
+	}
+}
+
+// acceptTransaction validates a transaction, adds it to the mempool and announces
+// it to our gossip peers. it's used both by the RPC and by gossip.
+func acceptTransaction(tx common.Transaction) error {
+	if err := validateTransaction(tx); err != nil {
+		return err
+	}
+	if !mempool.Add(tx) {
+		return nil
+	}
+
+	hash := tx.Hash()
+	gossip.Lock()
+	defer gossip.Unlock()
+	for peer := range gossip.peers {
+		if !peer.knows(hash) {
+			peer.markKnown(hash)
+			peer.queue(gossipMessage{MSG_INV, hash[:]})
+		}
+	}
+
+	return nil
+}
+
+func readGossipMessage(r io.Reader) (msg gossipMessage, err error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return msg, err
+	}
+	msg.Type = header[0]
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > GOSSIP_MAX_PAYLOAD {
+		return msg, fmt.Errorf("message too large: %d bytes", size)
+	}
+	msg.Payload = make([]byte, size)
+	if _, err := io.ReadFull(r, msg.Payload); err != nil {
+		return msg, err
+	}
+
+	return msg, nil
+}
+
+func writeGossipMessage(w *bufio.Writer, msg gossipMessage) error {
+	var header [5]byte
+	header[0] = msg.Type
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg.Payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func encodeHashes(hashes [][32]byte) []byte {
+	payload := make([]byte, 0, 32*len(hashes))
+	for _, hash := range hashes {
+		payload = append(payload, hash[:]...)
+	}
+	return payload
+}
+
+func decodeHashes(payload []byte) ([][32]byte, error) {
+	if len(payload)%32 != 0 {
+		return nil, errors.New("payload is not a list of hashes")
+	}
+	if len(payload)/32 > GOSSIP_MAX_HASHES {
+		return nil, errors.New("too many hashes")
+	}
+
+	hashes := make([][32]byte, len(payload)/32)
+	for i := range hashes {
+		copy(hashes[i][:], payload[i*32:])
+	}
+	return hashes, nil
+}
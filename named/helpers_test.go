@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/store"
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	log = log.Level(zerolog.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// newTestChain gives the package a fresh database and an empty chainstate.
+func newTestChain(t *testing.T) {
+	t.Helper()
+
+	config = &common.Config{DataDir: t.TempDir(), Storage: store.BACKEND_BBOLT}
+
+	var err error
+	db, err = store.Open(store.BACKEND_BBOLT, filepath.Join(config.DataDir, DB_NAMED_BOLT))
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	chainstate = &ChainState{
+		KnownNames: make(map[[32]byte]NameData),
+		Tree:       common.NewStateTree(),
+	}
+	mempool = newMempool()
+	if err := loadChainState(); err != nil {
+		t.Fatalf("failed to load chainstate: %s", err)
+	}
+}
+
+func testKey(seed string) (sk [32]byte, pk [32]byte) {
+	sk = sha256.Sum256([]byte(seed))
+	return sk, common.PublicKey(sk)
+}
+
+func signed(t *testing.T, tx common.Transaction, sk [32]byte) common.Transaction {
+	t.Helper()
+	if err := tx.Sign(sk); err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	return tx
+}
+
+func acquireTx(name string, pk [32]byte) common.Transaction {
+	return common.Transaction{
+		Type:     common.TYPE_ACQUIRE,
+		Key:      pk,
+		NameHash: sha256.Sum256([]byte(name)),
+	}
+}
+
+// signed transactions reference the tip as their recent block.
+func transferTx(t *testing.T, name string, to [32]byte, sk [32]byte) common.Transaction {
+	_, tip := chainstate.Current()
+	return signed(t, common.Transaction{
+		Type:        common.TYPE_TRANSFER,
+		NameHash:    sha256.Sum256([]byte(name)),
+		Key:         to,
+		RecentBlock: tip,
+	}, sk)
+}
+
+func publishTx(t *testing.T, name string, infohash [20]byte, sk [32]byte) common.Transaction {
+	_, tip := chainstate.Current()
+	return signed(t, common.Transaction{
+		Type:        common.TYPE_PUBLISH,
+		Name:        name,
+		PublishHash: infohash,
+		RecentBlock: tip,
+	}, sk)
+}
+
+// testBlock makes a block with these transactions on top of the tip, with the
+// state root they lead to if they are valid.
+func testBlock(txs ...common.Transaction) common.Block {
+	_, tip := chainstate.Current()
+	block := common.Block{PreviousBlock: tip}
+	for _, tx := range txs {
+		block.Transactions = append(block.Transactions, tx)
+	}
+	if valid, err := newBlock(txs); err == nil && len(valid.Transactions) == len(txs) {
+		block.StateRoot = valid.StateRoot
+	}
+	return block
+}
+
+func addTestBlock(t *testing.T, txs ...common.Transaction) common.Block {
+	t.Helper()
+	block := testBlock(txs...)
+	if err := addBlock(block.Serialize(), nil); err != nil {
+		t.Fatalf("failed to add block: %s", err)
+	}
+	parsed, _ := common.ParseBlock(block.Serialize())
+	return parsed
+}
@@ -3,57 +3,62 @@ package main
 import (
 	"flag"
 	"os"
-	"path/filepath"
 
-	"github.com/dgraph-io/badger"
 	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/store"
 	"github.com/kr/pretty"
 	"github.com/mitchellh/go-homedir"
 	"github.com/rs/zerolog"
-	rpcclient "github.com/stevenroose/go-bitcoin-core-rpc"
 )
 
 var log = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stderr})
 var config *common.Config
-var kvdb *badger.DB
-var blocksdb *badger.DB
-var chainstatedb *badger.DB
-var bitcoin *rpcclient.Client
+var db store.Store
+var bitcoin common.BitcoinBackend
+
+// openBitcoin connects to bitcoind, tests replace it with a fake chain.
+var openBitcoin = func() common.BitcoinBackend {
+	return common.OpenBitcoinRPC(config.BitcoinRPC)
+}
 
 var (
+	DB_NAMED      = "named.db"
+	DB_NAMED_BOLT = "named.bolt" // when the 'storage' option is 'bbolt'
+
+	// the separate databases of older versions, see migrateOldDatabases()
 	DB_KV         = "kv.db"
 	DB_BLOCKS     = "blocks.db"
 	DB_CHAINSTATE = "chainstate.db"
 )
 
 func main() {
-	var err error
 	config = &common.Config{}
 
 	// find datadir
 	flag.StringVar(&config.DataDir, "datadir", "~/.namechain", "the base directory we will use to read your config file from and store data into.")
+	reindex := flag.Bool("reindex-chainstate", false, "rebuild the chainstate from the blocks we have stored.")
 	flag.Parse()
 	config.DataDir, _ = homedir.Expand(config.DataDir)
 
 	// read config file
 	config.ReadConfig()
-	pretty.Log(config)
+	pretty.Log(config.Redacted())
 
-	// initiate databases
-	dbpath := filepath.Join(config.DataDir, DB_KV)
-	kvdb, err = badger.Open(badger.DefaultOptions(dbpath))
+	// initiate database
+	openStore()
+
+	// a reindex that was interrupted must be finished before we use the chainstate
+	phase, err := loadReindexPhase()
 	if err != nil {
-		log.Fatal().Err(err).Str("path", dbpath).Msg("failed to open database")
+		log.Fatal().Err(err).Msg("failed to read the reindex checkpoint")
 	}
-	dbpath = filepath.Join(config.DataDir, DB_BLOCKS)
-	blocksdb, err = badger.Open(badger.DefaultOptions(dbpath))
-	if err != nil {
-		log.Fatal().Err(err).Str("path", dbpath).Msg("failed to open database")
+	if phase != "" {
+		log.Warn().Str("phase", phase).Msg("the last chainstate reindex didn't finish")
 	}
-	dbpath = filepath.Join(config.DataDir, DB_CHAINSTATE)
-	chainstatedb, err = badger.Open(badger.DefaultOptions(dbpath))
-	if err != nil {
-		log.Fatal().Err(err).Str("path", dbpath).Msg("failed to open database")
+	if *reindex || phase != "" {
+		if err := reindexChainState(); err != nil {
+			log.Fatal().Err(err).Msg("failed to reindex chainstate")
+		}
 	}
 
 	// load chainstate to memory because why not
@@ -61,19 +66,48 @@ func main() {
 		log.Fatal().Err(err).Msg("failed to load chainstate")
 	}
 
-	// initiate bitcoind connection
-	bitcoin = common.OpenBitcoinRPC(config.BitcoinRPC)
-	_, err = bitcoin.GetBlockChainInfo()
-	if err != nil {
-		log.Fatal().Err(err).Interface("params", config.BitcoinRPC).
-			Msg("failed to connect to bitcoind RPC")
+	// a cheap check of the last blocks, a full one is the verifychain rpc
+	if _, err := verifyChain(6); err != nil {
+		log.Fatal().Err(err).Msg("chainstate is corrupted, restart with -reindex-chainstate")
 	}
 
+	// the keystore is optional, it's only used for signing through rpc
+	openWallet()
+
+	// initiate bitcoind connection
+	connectBitcoin()
+
+	// blocks are published and fetched as torrents
+	openBlockSource()
+
+	// the pre-signed transactions we use to find spacechain blocks and to mine
+	loadBMMChain()
+
 	// monitor the bitcoin chain
 	// this will also give us all the spacechain blocks
 	go watchBitcoinBlocks()
 
+	// raise the fee of our bmm bid if it doesn't confirm
+	go watchBMMBid()
+
+	// keep an eye on the other miners
+	go watchBMMAuction()
+
+	// relay pending transactions with other named instances
+	go listenGossip()
+	connectGossipPeers()
+
 	// listen for rpc commands
+	// local clients will authenticate using the cookie file
+	writeRPCCookie()
 	// this will also block here
 	listenRPC()
 }
+
+func connectBitcoin() {
+	bitcoin = openBitcoin()
+	if _, err := bitcoin.GetBlockChainInfo(); err != nil {
+		log.Fatal().Err(err).Interface("params", config.BitcoinRPC).
+			Msg("failed to connect to bitcoind RPC")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/fiatjaf/namechain/common"
+)
+
+// the whole path a name takes: sent to the mempool, put in a block that is
+// mined through a bmm bid, committed to in bitcoin, downloaded and applied.
+func TestEndToEnd(t *testing.T) {
+	newTestChain(t)
+	chain := newTestBitcoin(t, 3)
+	chain.Fund(1000000) // for the bmm children
+	t.Cleanup(func() { miner.bid = nil })
+	aliceKey, alice := testKey("alice")
+	_, bob := testKey("bob")
+
+	// genesis: we start following the bmm chain from where it was created
+	syncBitcoin(t)
+	if lastSpotted(t) != currentBMMChain().Genesis.TxHash() {
+		t.Fatal("we aren't following the bmm chain from its genesis")
+	}
+	if height, _ := chainstate.Current(); height != 0 {
+		t.Fatal("there are blocks before anything was mined")
+	}
+
+	mine := func(tx common.Transaction) common.Block {
+		t.Helper()
+		if _, err := RPCSendTransaction(map[string]interface{}{
+			"tx": hex.EncodeToString(tx.Serialize()),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		created, err := RPCCreateBlock(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawBlock := created.(map[string]interface{})["block"].(string)
+		if _, err := RPCMine(map[string]interface{}{"block": rawBlock}); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := hex.DecodeString(rawBlock)
+		block, _ := common.ParseBlock(b)
+
+		// bmm commitment: the link and our child get mined together
+		if _, err := chain.Mine(); err != nil {
+			t.Fatal(err)
+		}
+		syncBitcoin(t)
+		if err := checkBMMBid(); err != nil {
+			t.Fatal(err)
+		}
+		if miner.bid != nil {
+			t.Fatal("our bid is still pending after being mined")
+		}
+		return block
+	}
+
+	first := mine(acquireTx("alice", alice))
+	if height, tip := chainstate.Current(); height != 1 || tip != first.ID {
+		t.Fatal("mined block wasn't downloaded and added")
+	}
+	if nd, ok := chainstate.Name(sha256.Sum256([]byte("alice"))); !ok || nd.Key != alice {
+		t.Fatal("name wasn't acquired")
+	}
+	if _, _, err := loadAnchor(first.ID); err != nil {
+		t.Fatalf("anchor wasn't saved: %s", err)
+	}
+	if lastSpotted(t) != currentBMMChain().Links[0].TxHash() {
+		t.Fatal("we aren't following the first link")
+	}
+
+	second := mine(transferTx(t, "alice", bob, aliceKey))
+	if height, tip := chainstate.Current(); height != 2 || tip != second.ID {
+		t.Fatal("second mined block wasn't added")
+	}
+	if nd, _ := chainstate.Name(sha256.Sum256([]byte("alice"))); nd.Key != bob {
+		t.Fatal("name wasn't transferred")
+	}
+	if len(mempool.Transactions()) != 0 {
+		t.Fatal("mined transactions are still in the mempool")
+	}
+	if err := checkChainState(); err != nil {
+		t.Fatal(err)
+	}
+}
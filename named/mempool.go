@@ -0,0 +1,151 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/store"
+)
+
+// how many bytes of transactions the mempool holds, five full blocks. when it's
+// full the oldest transactions are dropped to make room.
+const MEMPOOL_MAX_SIZE = 5 * common.MAX_BLOCK_SIZE
+
+// Mempool holds the namechain transactions we've seen but that aren't in a block
+// yet. These are the ones a miner will put in the next block it tries to mine.
+type Mempool struct {
+	sync.RWMutex
+	txs  map[[32]byte]common.Transaction
+	size int // serialized bytes of all txs
+
+	// hashes in the order they arrived, transactions may depend on earlier ones
+	arrival  *list.List
+	elements map[[32]byte]*list.Element
+}
+
+func newMempool() *Mempool {
+	return &Mempool{
+		txs:      make(map[[32]byte]common.Transaction),
+		arrival:  list.New(),
+		elements: make(map[[32]byte]*list.Element),
+	}
+}
+
+var mempool = newMempool()
+
+// Add returns true if the transaction was new to us.
+func (m *Mempool) Add(tx common.Transaction) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	hash := tx.Hash()
+	if _, ok := m.txs[hash]; ok {
+		return false
+	}
+
+	size := len(tx.Serialize())
+	for m.size+size > MEMPOOL_MAX_SIZE && len(m.txs) > 0 {
+		m.evictOldest()
+	}
+
+	m.txs[hash] = tx
+	m.size += size
+	m.elements[hash] = m.arrival.PushBack(hash)
+	return true
+}
+
+// evictOldest must be called with the lock held.
+func (m *Mempool) evictOldest() {
+	oldest := m.arrival.Front().Value.([32]byte)
+	log.Debug().Hex("tx", oldest[:]).Msg("mempool is full, dropping its oldest transaction")
+	m.remove(oldest)
+}
+
+// remove must be called with the lock held.
+func (m *Mempool) remove(hash [32]byte) {
+	if tx, ok := m.txs[hash]; ok {
+		m.size -= len(tx.Serialize())
+		delete(m.txs, hash)
+		m.arrival.Remove(m.elements[hash])
+		delete(m.elements, hash)
+	}
+}
+
+func (m *Mempool) Get(hash [32]byte) (tx common.Transaction, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	tx, ok = m.txs[hash]
+	return
+}
+
+func (m *Mempool) Has(hash [32]byte) bool {
+	_, ok := m.Get(hash)
+	return ok
+}
+
+func (m *Mempool) Hashes() [][32]byte {
+	m.RLock()
+	defer m.RUnlock()
+
+	hashes := make([][32]byte, 0, len(m.txs))
+	for hash := range m.txs {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// Transactions returns all the transactions in the order they arrived.
+func (m *Mempool) Transactions() []common.Transaction {
+	m.RLock()
+	defer m.RUnlock()
+
+	txs := make([]common.Transaction, 0, len(m.txs))
+	for e := m.arrival.Front(); e != nil; e = e.Next() {
+		txs = append(txs, m.txs[e.Value.([32]byte)])
+	}
+	return txs
+}
+
+// RemoveBlockTransactions is called when a block is added so we don't try to
+// include its transactions again.
+func (m *Mempool) RemoveBlockTransactions(block common.Block) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, itx := range block.Transactions {
+		m.remove(itx.(common.Transaction).Hash())
+	}
+}
+
+// Revalidate drops the transactions that aren't valid on top of the tip anymore.
+// they are applied in the order they arrived, like newBlock does, so the ones
+// that depend on earlier ones stay.
+func (m *Mempool) Revalidate() {
+	txs := m.Transactions()
+
+	// hold the chainstate so the height is the one of the state we read
+	var invalid [][32]byte
+	chainstate.RLock()
+	err := db.View(func(txn store.Txn) error {
+		bs := newBlockState(txn, chainstate.BlockHeight, nil)
+		for _, tx := range txs {
+			if err := bs.apply(tx); err != nil {
+				invalid = append(invalid, tx.Hash())
+			}
+		}
+		return nil
+	})
+	chainstate.RUnlock()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to revalidate mempool")
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	for _, hash := range invalid {
+		m.remove(hash)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMempoolEvictsOldestWhenFull(t *testing.T) {
+	newTestChain(t)
+	_, alice := testKey("alice")
+
+	first := acquireTx("name0", alice)
+	size := len(first.Serialize())
+	n := MEMPOOL_MAX_SIZE / size
+	for i := 0; i < n; i++ {
+		if !mempool.Add(acquireTx(fmt.Sprintf("name%d", i), alice)) {
+			t.Fatalf("tx %d wasn't added", i)
+		}
+	}
+	if !mempool.Has(first.Hash()) {
+		t.Fatal("oldest was evicted before the mempool was full")
+	}
+
+	if !mempool.Add(acquireTx("one more", alice)) {
+		t.Fatal("tx wasn't added to a full mempool")
+	}
+	if mempool.Has(first.Hash()) {
+		t.Fatal("oldest wasn't evicted")
+	}
+	if len(mempool.Hashes()) != n || mempool.size > MEMPOOL_MAX_SIZE {
+		t.Fatalf("mempool has %d txs and %d bytes", len(mempool.Hashes()), mempool.size)
+	}
+}
+
+func TestMempoolIsRevalidatedOnEachBlock(t *testing.T) {
+	newTestChain(t)
+	aliceKey, alice := testKey("alice")
+	_, bob := testKey("bob")
+	addTestBlock(t, acquireTx("filler", alice))
+
+	// bob's acquire will lose to the one in the block, alice's transfer
+	// depends on her acquire, which is still pending
+	lost := acquireTx("taken", bob)
+	pending := acquireTx("pending", alice)
+	transfer := transferTx(t, "pending", bob, aliceKey)
+	mempool.Add(lost)
+	mempool.Add(pending)
+	mempool.Add(transfer)
+
+	addTestBlock(t, acquireTx("taken", alice))
+
+	if mempool.Has(lost.Hash()) {
+		t.Fatal("transaction made invalid by the block is still in the mempool")
+	}
+	if !mempool.Has(pending.Hash()) || !mempool.Has(transfer.Hash()) {
+		t.Fatal("valid transactions were dropped")
+	}
+}
+
+func TestGossipRequestsExpire(t *testing.T) {
+	now := time.Now()
+	gossip.Lock()
+	defer gossip.Unlock()
+	gossip.requested[[32]byte{1}] = now.Add(-2 * GOSSIP_REQUEST_TIMEOUT)
+	gossip.requested[[32]byte{2}] = now
+	gossip.expired = time.Time{}
+
+	expireGossipRequests(now)
+	if _, ok := gossip.requested[[32]byte{1}]; ok {
+		t.Fatal("unanswered request wasn't forgotten")
+	}
+	if _, ok := gossip.requested[[32]byte{2}]; !ok {
+		t.Fatal("recent request was forgotten")
+	}
+	delete(gossip.requested, [32]byte{2})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/fiatjaf/namechain/common"
+)
+
+// how often we look at bitcoind to see what happened to our bid.
+const BMM_BID_CHECK_INTERVAL = 30 * time.Second
+
+// bmmBid is a spacechain block we are trying to get into the bitcoin chain with
+// the CPFP child of a BMM link. only one can be pending at a time since they
+// all compete for the same link.
+type bmmBid struct {
+	chain    *common.BMMChain
+	n        int // the BMM link we are paying for
+	link     *wire.MsgTx
+	child    *wire.MsgTx
+	prevouts []common.PrevOut
+	fee      int64
+
+	block common.Block
+
+	height int64 // bitcoin height when the current child was broadcast
+	bumps  int
+}
+
+var miner = struct {
+	sync.Mutex
+	bid *bmmBid
+}{}
+
+// startBMMBid broadcasts a child for the next link of chain committing to block and
+// starts tracking it. the block transactions leave the mempool while we bid
+// and come back if the bid is lost.
+func startBMMBid(chain *common.BMMChain, serializedBlock []byte, block common.Block) (*bmmBid, error) {
+	miner.Lock()
+	defer miner.Unlock()
+
+	if miner.bid != nil {
+		return nil, fmt.Errorf("already bidding with block %s for BMM %d",
+			miner.bid.block.ID.HexString(), miner.bid.n)
+	}
+
+	n, err := nextBMMLink(chain)
+	if err != nil {
+		return nil, err
+	}
+	link := chain.Links[n-1]
+
+	child, prevouts, fee, err := common.BuildBMMChild(bitcoin, chain, n, block.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build child: %w", err)
+	}
+	child, err = common.SignBMMChildWithWallet(bitcoin, child, prevouts)
+	if err != nil {
+		return nil, err
+	}
+
+	// others must be able to download the block as soon as the bid confirms
+	if err := seedBlock(serializedBlock); err != nil {
+		return nil, fmt.Errorf("failed to seed block: %w", err)
+	}
+
+	if _, err := common.SubmitBMMPackage(bitcoin, link, child); err != nil {
+		return nil, fmt.Errorf("submitpackage: %w", err)
+	}
+	height, _ := bitcoin.GetBlockCount()
+
+	mempool.RemoveBlockTransactions(block)
+
+	miner.bid = &bmmBid{
+		chain:    chain,
+		n:        n,
+		link:     link,
+		child:    child,
+		prevouts: prevouts,
+		fee:      fee,
+		block:    block,
+		height:   height,
+	}
+	log.Info().Int("bmm", n).Str("child", child.TxHash().String()).
+		Int64("fee", fee).Str("block", block.ID.HexString()).
+		Msg("broadcasted bmm bid")
+
+	return miner.bid, nil
+}
+
+// watchBMMBid follows our pending bid until it confirms or a competing one does,
+// raising its fee if it stays unconfirmed for too long.
+func watchBMMBid() {
+	for {
+		time.Sleep(BMM_BID_CHECK_INTERVAL)
+
+		if err := checkBMMBid(); err != nil {
+			log.Warn().Err(err).Msg("failed to check our bmm bid")
+		}
+	}
+}
+
+func checkBMMBid() error {
+	miner.Lock()
+	defer miner.Unlock()
+
+	bid := miner.bid
+	if bid == nil {
+		return nil
+	}
+
+	parent := bid.link.TxIn[0].PreviousOutPoint
+	out, err := bitcoin.GetTxOut(&parent.Hash, parent.Index, false)
+	if err != nil {
+		return fmt.Errorf("gettxout %s: %w", parent, err)
+	}
+
+	if out == nil {
+		// the link was confirmed, let's see with which child
+		confirmations, err := common.WalletTxConfirmations(bitcoin, bid.child.TxHash())
+		if err != nil {
+			return err
+		}
+		if confirmations > 0 {
+			log.Info().Int("bmm", bid.n).Str("block", bid.block.ID.HexString()).
+				Int("bumps", bid.bumps).Msg("our bmm bid was confirmed")
+		} else {
+			log.Info().Int("bmm", bid.n).Str("block", bid.block.ID.HexString()).
+				Msg("a competing bmm bid was confirmed, giving up")
+			restoreBidTransactions(bid)
+		}
+		miner.bid = nil
+		return nil
+	}
+
+	tip, err := bitcoin.GetBlockCount()
+	if err != nil {
+		return err
+	}
+	if tip-bid.height < int64(config.BMMBumpBlocks) {
+		return nil
+	}
+
+	return bumpBMMBid(bid, tip)
+}
+
+// bumpBMMBid replaces our child with one that pays more, spending the same
+// inputs so only one of them can ever confirm.
+func bumpBMMBid(bid *bmmBid, tip int64) error {
+	// replacements must pay at least the incremental relay fee (1 sat/vbyte) over
+	// the original, we go a little higher so we don't have to bump every block
+	fee := bid.fee * 5 / 4
+	if min := bid.fee + common.VSize(bid.child); fee < min {
+		fee = min
+	}
+	if feerate, err := common.EstimateFeeRate(bitcoin, common.BMM_CONF_TARGET); err == nil {
+		vsize := common.VSize(bid.link) + common.VSize(bid.child)
+		estimate := int64(math.Ceil(feerate*float64(vsize))) - bid.chain.LinkFee(bid.n)
+		if estimate > fee {
+			fee = estimate
+		}
+	}
+
+	child, err := common.BumpBMMChild(bid.child, bid.prevouts, fee)
+	if err != nil {
+		return err
+	}
+	child, err = common.SignBMMChildWithWallet(bitcoin, child, bid.prevouts)
+	if err != nil {
+		return err
+	}
+	if _, err := common.SubmitBMMPackage(bitcoin, bid.link, child); err != nil {
+		return fmt.Errorf("submitpackage: %w", err)
+	}
+
+	log.Info().Int("bmm", bid.n).Str("replaced", bid.child.TxHash().String()).
+		Str("child", child.TxHash().String()).Int64("fee", fee).
+		Msg("bumped bmm bid")
+
+	bid.child = child
+	bid.fee = fee
+	bid.height = tip
+	bid.bumps++
+	return nil
+}
+
+// restoreBidTransactions puts the transactions of a block that didn't make it
+// back in the mempool, except the ones that aren't valid anymore.
+func restoreBidTransactions(bid *bmmBid) {
+	for _, itx := range bid.block.Transactions {
+		tx := itx.(common.Transaction)
+		if err := acceptTransaction(tx); err != nil {
+			hash := tx.Hash()
+			log.Debug().Err(err).Hex("tx", hash[:]).
+				Msg("transaction from our lost block is no longer valid")
+		}
+	}
+}
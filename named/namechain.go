@@ -1,20 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"strconv"
 
-	"github.com/dgraph-io/badger"
+	"github.com/anacrolix/torrent/metainfo"
 	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/store"
 )
 
-type ChainState struct {
-	BlockHeight int
-	KnownNames  map[[32]byte]NameData // name hash: data
-}
-
 type NameData struct {
 	Key              [32]byte
 	Name             string
@@ -22,119 +20,571 @@ type NameData struct {
 }
 
 func loadName(name string) (*NameData, error) {
-	nameHash := sha256.Sum256(name)
-
-	var nd NameData
-	err := chainstatedb.View(func(txn *badger.Txn) error {
-		item := txn.Get(nameHash[:])
-		return item.Value(func(v []byte) error {
-			var nd NameData
-			copy(nd.Key[:], v[0:32])
-			copy(nd.DataBlobInfoHash[:], v[33:53])
-			nd.Name = string(v[54:])
-		})
+	nameHash := sha256.Sum256([]byte(name))
+
+	nd, ok := chainstate.Name(nameHash)
+	if !ok {
+		return nil, nil
+	}
+	return &nd, nil
+}
+
+// loadNameHash returns nil if nothing is known about this name hash.
+func loadNameHash(txn store.Txn, nameHash [32]byte) (*NameData, error) {
+	v, err := txn.Get(nameKey(nameHash))
+	if err == store.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	nd := decodeNameData(v)
+	return &nd, nil
+}
+
+func encodeNameData(nd NameData) []byte {
+	v := make([]byte, 52+len(nd.Name))
+	copy(v[0:32], nd.Key[:])
+	copy(v[32:52], nd.DataBlobInfoHash[:])
+	copy(v[52:], nd.Name)
+	return v
+}
+
+func decodeNameData(v []byte) (nd NameData) {
+	copy(nd.Key[:], v[0:32])
+	copy(nd.DataBlobInfoHash[:], v[32:52])
+	nd.Name = string(v[52:])
+	return nd
+}
+
+// blocks are stored both by their id and by a height index.
+func heightKey(height int) []byte {
+	buf := make([]byte, 64)
+	binary.PutVarint(buf, int64(height))
+	return bucketKey(BUCKET_HEIGHTS, buf)
+}
+
+func loadBlockIdAtHeight(height int) (id metainfo.Hash, err error) {
+	err = db.View(func(txn store.Txn) error {
+		v, err := txn.Get(heightKey(height))
+		if err != nil {
+			return err
+		}
+		copy(id[:], v)
+		return nil
+	})
+	return id, err
+}
+
+func loadSerializedBlock(id metainfo.Hash) (serializedBlock []byte, err error) {
+	err = db.View(func(txn store.Txn) (err error) {
+		serializedBlock, err = txn.Get(blockKey(id))
+		return err
 	})
-	return &nd, err
+	return serializedBlock, err
 }
 
 func validateTransaction(tx common.Transaction) error {
+	return db.View(func(txn store.Txn) error {
+		height, _ := chainstate.Current()
+		return newBlockState(txn, height, nil).apply(tx)
+	})
+}
+
+// checkTransaction validates a transaction against the current data of its name
+// (nil if it has none) as it would be included in the block after height.
+func checkTransaction(txn store.Txn, tx common.Transaction, nd *NameData, height int) error {
 	// check if operation matches ownership
-	switch tx.Type {
-	case common.TYPE_ACQUIRE:
+	if tx.Type == common.TYPE_ACQUIRE {
 		// this name must not have an owner
-	case common.TYPE_TRANSFER:
-		// signature must be from current owner
-	case common.TYPE_RENEW:
-		// signature must be from current owner
-	// block hash must be from one of the latest 10 blocks
-	case common.TYPE_PUBLISH:
-		// signature must be from current owner
-		// ownership may be of a known name
-		//   or of an acquired unknown hash
+		if nd != nil {
+			return errors.New("name already has an owner")
+		}
+		return nil
+	}
+
+	// block hash must be from one of the latest 10 blocks, so a signed
+	// transaction can't be replayed once those are buried
+	if !isRecentBlock(txn, tx.RecentBlock, height) {
+		return errors.New("transaction must reference one of the latest 10 blocks")
 	}
 
-	// check signature
-	// TODO
+	// signature must be from current owner
+	// ownership may be of a known name or of an acquired unknown hash,
+	// in both cases the record is keyed by sha256(name)
+	if nd == nil {
+		return errors.New("name has no owner")
+	}
+	if !tx.CheckSignature(nd.Key) {
+		return errors.New("signature is not from the current owner")
+	}
 
 	return nil
 }
 
-func validateBlock(block common.Block) error {
+// transactionNameHash is the key of the name record a transaction affects.
+func transactionNameHash(tx common.Transaction) [32]byte {
+	if tx.Type == common.TYPE_PUBLISH {
+		return sha256.Sum256([]byte(tx.Name))
+	}
+	return tx.NameHash
+}
+
+// isRecentBlock tells if id is one of the latest 10 blocks. before the first
+// block there is only the zero id, which is what the first block builds on.
+func isRecentBlock(txn store.Txn, id [20]byte, tip int) bool {
+	for height := tip; height >= 0 && height > tip-10; height-- {
+		if height == 0 {
+			return id == [20]byte{}
+		}
+		if recent, err := txn.Get(heightKey(height)); err == nil && bytes.Equal(recent, id[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// recentTransactions are the hashes of the transactions in the latest 10
+// blocks. a signed transaction can only be included while its recent block is
+// one of these, so not repeating any of them is enough to stop replays.
+func recentTransactions(txn store.Txn, tip int) (map[[32]byte]bool, error) {
+	hashes := make(map[[32]byte]bool)
+	for height := tip; height > 0 && height > tip-10; height-- {
+		id, err := txn.Get(heightKey(height))
+		if err != nil {
+			return nil, err
+		}
+		serializedBlock, err := txn.Get(bucketKey(BUCKET_BLOCKS, id))
+		if err != nil {
+			return nil, err
+		}
+		block, err := common.ParseBlock(serializedBlock)
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range block.Transactions {
+			hashes[tx.(common.Transaction).Hash()] = true
+		}
+	}
+	return hashes, nil
+}
+
+// blockState is the name data as the transactions of a block are applied one
+// after the other, so each one is checked against the ones before it. base is
+// where names not touched yet in this block are read from.
+type blockState struct {
+	txn    store.Txn
+	height int // of the block before this one
+	base   func(nameHash [32]byte) (*NameData, error)
+
+	changed map[[32]byte]NameData
+	order   [][32]byte // of the changed names, as they were first changed
+
+	// transactions in the latest blocks and in this one so far, read on first use
+	seen map[[32]byte]bool
+
+	// the data each changed name had before the block, nil if it had none
+	undo map[[32]byte][]byte
+
+	// a copy of the state tree before the block, only needed for the root
+	tree *common.StateTree
+}
+
+func newBlockState(txn store.Txn, height int, tree *common.StateTree) *blockState {
+	return &blockState{
+		txn:     txn,
+		height:  height,
+		tree:    tree,
+		base:    func(nameHash [32]byte) (*NameData, error) { return loadNameHash(txn, nameHash) },
+		changed: make(map[[32]byte]NameData),
+		undo:    make(map[[32]byte][]byte),
+	}
+}
+
+func (bs *blockState) name(nameHash [32]byte) (*NameData, error) {
+	if nd, ok := bs.changed[nameHash]; ok {
+		return &nd, nil
+	}
+	return bs.base(nameHash)
+}
+
+// apply checks a transaction against the state so far and then applies it.
+func (bs *blockState) apply(tx common.Transaction) error {
+	nameHash := transactionNameHash(tx)
+	nd, err := bs.name(nameHash)
+	if err != nil {
+		return err
+	}
+	if err := checkTransaction(bs.txn, tx, nd, bs.height); err != nil {
+		return err
+	}
+
+	if tx.Type != common.TYPE_ACQUIRE {
+		if bs.seen == nil {
+			if bs.seen, err = recentTransactions(bs.txn, bs.height); err != nil {
+				return err
+			}
+		}
+		if bs.seen[tx.Hash()] {
+			return errors.New("transaction was already included in a recent block")
+		}
+		bs.seen[tx.Hash()] = true
+	}
+
+	if tx.Type == common.TYPE_RENEW {
+		// names don't expire yet, so there is nothing to change
+		return nil
+	}
+
+	if _, ok := bs.changed[nameHash]; !ok {
+		if nd == nil {
+			bs.undo[nameHash] = nil
+		} else {
+			bs.undo[nameHash] = encodeNameData(*nd)
+		}
+		bs.order = append(bs.order, nameHash)
+	}
+	if nd == nil {
+		nd = &NameData{}
+	}
+
+	switch tx.Type {
+	case common.TYPE_ACQUIRE, common.TYPE_TRANSFER:
+		nd.Key = tx.Key
+	case common.TYPE_PUBLISH:
+		nd.Name = tx.Name
+		nd.DataBlobInfoHash = tx.PublishHash
+	}
+	bs.changed[nameHash] = *nd
+	return nil
+}
+
+// root is the state root after the transactions applied so far.
+func (bs *blockState) root() [32]byte {
+	for _, nameHash := range bs.order {
+		bs.tree.Set(nameHash, nameDataHash(bs.changed[nameHash]))
+	}
+	return bs.tree.Root()
+}
+
+// applyBlock applies all the transactions of a block and checks that they
+// lead to the state root it commits to.
+func (bs *blockState) applyBlock(block common.Block) error {
 	for i, tx := range block.Transactions {
-		if err := validateTransaction(tx.(common.Transaction)); err != nil {
+		if err := bs.apply(tx.(common.Transaction)); err != nil {
 			return fmt.Errorf("error validating transaction %d: %w", i, err)
 		}
 	}
-
+	if root := bs.root(); root != block.StateRoot {
+		return fmt.Errorf("block has state root %x, but its transactions lead to %x",
+			block.StateRoot, root)
+	}
 	return nil
 }
 
-func addBlock(serializedBlock []byte) error {
+// validateBlock checks a block on top of the current tip without changing
+// anything.
+func validateBlock(block common.Block) error {
+	chainstate.RLock()
+	defer chainstate.RUnlock()
+
+	if block.PreviousBlock != chainstate.Tip {
+		return fmt.Errorf("block builds on %s, not on the tip %s",
+			block.PreviousBlock.HexString(), chainstate.Tip.HexString())
+	}
+	return db.View(func(txn store.Txn) error {
+		return newBlockState(txn, chainstate.BlockHeight, chainstate.Tree.Copy()).applyBlock(block)
+	})
+}
+
+// newBlock makes a block on top of the tip with as many of txs as are valid
+// together, in order, and the state root they lead to.
+func newBlock(txs []common.Transaction) (block common.Block, err error) {
+	chainstate.RLock()
+	defer chainstate.RUnlock()
+
+	block.PreviousBlock = chainstate.Tip
+	err = db.View(func(txn store.Txn) error {
+		bs := newBlockState(txn, chainstate.BlockHeight, chainstate.Tree.Copy())
+		size := 84
+		for _, tx := range txs {
+			if size += 1 + len(tx.Serialize()); size > common.MAX_BLOCK_SIZE {
+				break
+			}
+			if err := bs.apply(tx); err != nil {
+				size -= 1 + len(tx.Serialize())
+				continue
+			}
+			block.Transactions = append(block.Transactions, tx)
+		}
+		block.StateRoot = bs.root()
+		return nil
+	})
+	if err == nil && len(block.Transactions) == 0 {
+		err = errors.New("no valid transactions to make a block")
+	}
+	return block, err
+}
+
+// addBlock applies a block to the chainstate and saves it. checkpoint, if given,
+// is called inside the same transaction so whatever it saves is committed
+// together with the block.
+func addBlock(serializedBlock []byte, checkpoint func(txn store.Txn) error) error {
 	// parse block
 	block, err := common.ParseBlock(serializedBlock)
 	if err != nil {
 		return fmt.Errorf("error parsing block: %w", err)
 	}
 
-	// validate block
-	err = validateBlock(block)
-	if err != nil {
-		return fmt.Errorf("error validating block: %w", err)
-	}
+	// nothing else can touch the chainstate until both disk and memory are updated
+	chainstate.Lock()
+	height := chainstate.BlockHeight + 1
+	var bs *blockState
+	var invalid error
+
+	// validate the block, update chainstate and save it, all at once
+	if err := db.Update(func(txn store.Txn) error {
+		if block.PreviousBlock != chainstate.Tip {
+			invalid = fmt.Errorf("block builds on %s, not on the tip %s",
+				block.PreviousBlock.HexString(), chainstate.Tip.HexString())
+			return invalid
+		}
+
+		bs = newBlockState(txn, height-1, chainstate.Tree.Copy())
+		if invalid = bs.applyBlock(block); invalid != nil {
+			return invalid
+		}
 
-	// update and save chainstate
-	if err := chainstatedb.Update(func(txn *badger.Txn) error {
 		if err := txn.Set(
-			[]byte("blockheight"),
-			[]byte(strconv.Itoa(chainstate.BlockHeight+1)),
+			checkpointKey(BLOCK_HEIGHT),
+			[]byte(strconv.Itoa(height)),
 		); err != nil {
 			return err
 		}
 
-		for _, itx := range block.Transactions {
-			tx := itx.(common.Transaction)
-			switch tx.Type {
-			case TYPE_ACQUIRE:
-			case TYPE_TRANSFER:
-			case TYPE_RENEW:
-			case TYPE_PUBLISH:
+		for _, nameHash := range bs.order {
+			if err := txn.Set(nameKey(nameHash), encodeNameData(bs.changed[nameHash])); err != nil {
+				return err
 			}
 		}
 
-		if err := txn.Set(
-			[]byte(),
-			[]byte(),
-		); err != nil {
+		// we keep the previous value of every name we touch so this block can be undone
+		if err := txn.Set(undoKey(block.ID), encodeUndo(bs.undo)); err != nil {
+			return err
+		}
+
+		if err := txn.Set(rootKey(block.ID), block.StateRoot[:]); err != nil {
+			return err
+		}
+
+		if err := txn.Set(blockKey(block.ID), block.Serialize()); err != nil {
+			return err
+		}
+		if err := txn.Set(heightKey(height), block.ID[:]); err != nil {
 			return err
 		}
 
+		if checkpoint != nil {
+			return checkpoint(txn)
+		}
 		return nil
 	}); err != nil {
+		if invalid != nil {
+			chainstate.Unlock()
+			return fmt.Errorf("error validating block: %w", invalid)
+		}
 		log.Fatal().Err(err).Msg("failed to add block")
 	}
 
-	// save block
-	if err := blocksdb.Update(func(txn *badger.Txn) error {
-		if err := txn.Set(
-			block.ID[:],
-			block.Serialize(),
-		); err != nil {
-			return err
+	for nameHash, nd := range bs.changed {
+		chainstate.KnownNames[nameHash] = nd
+	}
+	chainstate.Tree = bs.tree
+	chainstate.BlockHeight = height
+	chainstate.Tip = block.ID
+	chainstate.Unlock()
+
+	// these are not pending anymore, and others may have become invalid
+	mempool.RemoveBlockTransactions(block)
+	mempool.Revalidate()
+
+	// notify subscribers
+	emitNewBlock(block, height)
+	for _, nameHash := range bs.order {
+		emitNameChanged(nameHash, bs.changed[nameHash], block.ID)
+	}
+
+	return nil
+}
+
+// undoBlocks reverts the chainstate changes made by all blocks above height,
+// from the tip down. they stay stored, only the index, undo data and roots go.
+// checkpoint, if given, is called inside the same transaction.
+func undoBlocks(height int, checkpoint func(txn store.Txn) error) error {
+	chainstate.Lock()
+
+	tip := chainstate.BlockHeight
+	if height < 0 || height > tip {
+		chainstate.Unlock()
+		return fmt.Errorf("can't undo down to height %d from %d", height, tip)
+	}
+
+	type undone struct {
+		id      metainfo.Hash
+		changed map[[32]byte]*NameData // nil where the name didn't exist before
+	}
+	var blocks []undone
+	var newTip metainfo.Hash
+
+	if err := db.Update(func(txn store.Txn) error {
+		blocks = nil
+		for h := tip; h > height; h-- {
+			v, err := txn.Get(heightKey(h))
+			if err != nil {
+				return fmt.Errorf("failed to load block id at %d: %w", h, err)
+			}
+			block := undone{changed: make(map[[32]byte]*NameData)}
+			copy(block.id[:], v)
+
+			value, err := txn.Get(undoKey(block.id))
+			if err != nil {
+				return fmt.Errorf("failed to load undo data: %w", err)
+			}
+			undo, err := decodeUndo(value)
+			if err != nil {
+				return err
+			}
+
+			for nameHash, previous := range undo {
+				if previous == nil {
+					if err := txn.Delete(nameKey(nameHash)); err != nil {
+						return err
+					}
+					block.changed[nameHash] = nil
+				} else {
+					if err := txn.Set(nameKey(nameHash), previous); err != nil {
+						return err
+					}
+					nd := decodeNameData(previous)
+					block.changed[nameHash] = &nd
+				}
+			}
+
+			for _, key := range [][]byte{
+				undoKey(block.id), rootKey(block.id), anchorKey(block.id), heightKey(h),
+			} {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			blocks = append(blocks, block)
 		}
 
-		buf := make([]byte, 64)
-		binary.PutVarint(buf, int64(chainstate.BlockHeight+1))
+		if height > 0 {
+			id, err := txn.Get(heightKey(height))
+			if err != nil {
+				return err
+			}
+			copy(newTip[:], id)
+		}
 		if err := txn.Set(
-			buf,
-			block.ID[:],
+			checkpointKey(BLOCK_HEIGHT),
+			[]byte(strconv.Itoa(height)),
 		); err != nil {
 			return err
 		}
 
+		if checkpoint != nil {
+			return checkpoint(txn)
+		}
 		return nil
 	}); err != nil {
-		log.Fatal().Err(err).Msg("failed to add block")
+		chainstate.Unlock()
+		return err
 	}
+
+	// the tree isn't changed in place, so readers holding the old one are fine
+	tree := chainstate.Tree.Copy()
+	for _, block := range blocks {
+		for nameHash, nd := range block.changed {
+			if nd == nil {
+				delete(chainstate.KnownNames, nameHash)
+				tree.Delete(nameHash)
+			} else {
+				chainstate.KnownNames[nameHash] = *nd
+				tree.Set(nameHash, nameDataHash(*nd))
+			}
+		}
+	}
+	chainstate.Tree = tree
+	chainstate.BlockHeight = height
+	chainstate.Tip = newTip
+	chainstate.Unlock()
+
+	// notify subscribers
+	for i, block := range blocks {
+		emitReorg(block.id, tip-i)
+		for nameHash, nd := range block.changed {
+			if nd == nil {
+				emitNameChanged(nameHash, NameData{}, block.id)
+			} else {
+				emitNameChanged(nameHash, *nd, block.id)
+			}
+		}
+	}
+
+	// their transactions may still be valid, or become valid again later
+	for i := len(blocks) - 1; i >= 0; i-- {
+		serializedBlock, err := loadSerializedBlock(blocks[i].id)
+		if err != nil {
+			continue
+		}
+		parsed, err := common.ParseBlock(serializedBlock)
+		if err != nil {
+			continue
+		}
+		for _, itx := range parsed.Transactions {
+			mempool.Add(itx.(common.Transaction))
+		}
+	}
+	mempool.Revalidate()
+
+	return nil
+}
+
+// undo data is a list of <name hash><2-byte length><previous name data>, with
+// zero length meaning the name didn't exist before.
+func encodeUndo(undo map[[32]byte][]byte) []byte {
+	var buf []byte
+	for nameHash, previous := range undo {
+		buf = append(buf, nameHash[:]...)
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(len(previous)))
+		buf = append(buf, size[:]...)
+		buf = append(buf, previous...)
+	}
+	return buf
 }
 
-func undoBlock() {}
+func decodeUndo(buf []byte) (map[[32]byte][]byte, error) {
+	undo := make(map[[32]byte][]byte)
+	for len(buf) > 0 {
+		if len(buf) < 34 {
+			return nil, errors.New("corrupted undo data")
+		}
+		var nameHash [32]byte
+		copy(nameHash[:], buf[0:32])
+		size := int(binary.BigEndian.Uint16(buf[32:34]))
+		buf = buf[34:]
+		if len(buf) < size {
+			return nil, errors.New("corrupted undo data")
+		}
+		if size == 0 {
+			undo[nameHash] = nil
+		} else {
+			undo[nameHash] = buf[0:size]
+		}
+		buf = buf[size:]
+	}
+	return undo, nil
+}
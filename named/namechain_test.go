@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/fiatjaf/namechain/common"
+)
+
+func TestBlockAppliesTransactionsInOrder(t *testing.T) {
+	newTestChain(t)
+	aliceSK, alice := testKey("alice")
+	bobSK, bob := testKey("bob")
+
+	// acquired and published in the same block
+	addTestBlock(t,
+		acquireTx("alice.name", alice),
+		publishTx(t, "alice.name", [20]byte{1}, aliceSK),
+	)
+	nd, err := loadName("alice.name")
+	if err != nil || nd == nil || nd.Key != alice || nd.DataBlobInfoHash != [20]byte{1} {
+		t.Fatalf("wrong data after acquire and publish: %v %v", nd, err)
+	}
+
+	// transferred and then published by the new owner in the same block
+	addTestBlock(t,
+		transferTx(t, "alice.name", bob, aliceSK),
+		publishTx(t, "alice.name", [20]byte{2}, bobSK),
+	)
+	nd, _ = loadName("alice.name")
+	if nd.Key != bob || nd.DataBlobInfoHash != [20]byte{2} {
+		t.Fatalf("wrong data after transfer and publish: %v", nd)
+	}
+
+	// the old owner can't publish after the transfer in the same block
+	block := testBlock(
+		transferTx(t, "alice.name", alice, bobSK),
+		publishTx(t, "alice.name", [20]byte{3}, bobSK),
+	)
+	if err := addBlock(block.Serialize(), nil); err == nil {
+		t.Fatal("a publish by the previous owner was accepted")
+	}
+
+	if checked, err := verifyChain(10); err != nil || checked != 2 {
+		t.Fatalf("verifychain: %d %v", checked, err)
+	}
+	if err := checkChainState(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockRejectsDoubleAcquire(t *testing.T) {
+	newTestChain(t)
+	_, alice := testKey("alice")
+	_, bob := testKey("bob")
+
+	block := testBlock(acquireTx("taken", alice), acquireTx("taken", bob))
+	if err := validateBlock(block); err == nil {
+		t.Fatal("two acquires of the same name validated")
+	}
+	if err := addBlock(block.Serialize(), nil); err == nil {
+		t.Fatal("two acquires of the same name were added")
+	}
+
+	if height, _ := chainstate.Current(); height != 0 {
+		t.Fatalf("height is %d after an invalid block", height)
+	}
+	if _, ok := chainstate.Name(sha256.Sum256([]byte("taken"))); ok {
+		t.Fatal("invalid block changed the chainstate")
+	}
+	if err := checkChainState(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignedTransactionsCantBeReplayed(t *testing.T) {
+	newTestChain(t)
+	aliceSK, alice := testKey("alice")
+	bobSK, bob := testKey("bob")
+
+	addTestBlock(t, acquireTx("ping.pong", alice))
+	toBob := transferTx(t, "ping.pong", bob, aliceSK)
+	addTestBlock(t, toBob)
+	addTestBlock(t, transferTx(t, "ping.pong", alice, bobSK))
+
+	// alice owns it again and her old transfer is still within the window
+	if err := validateTransaction(toBob); err == nil {
+		t.Fatal("a transfer from a recent block was accepted again")
+	}
+	if err := addBlock(testBlock(toBob).Serialize(), nil); err == nil {
+		t.Fatal("a block replaying a recent transfer was added")
+	}
+
+	// and once its recent block is buried it isn't valid anymore
+	for i := 0; i < 10; i++ {
+		addTestBlock(t, acquireTx(fmt.Sprintf("filler%d", i), alice))
+	}
+	if err := validateTransaction(toBob); err == nil {
+		t.Fatal("a transfer with an old recent block was accepted")
+	}
+
+	// the same transaction can't go twice in a block either
+	publish := publishTx(t, "ping.pong", [20]byte{7}, aliceSK)
+	if err := validateBlock(testBlock(publish, publish)); err == nil {
+		t.Fatal("a block with the same publish twice validated")
+	}
+	addTestBlock(t, publish)
+
+	if _, err := verifyChain(20); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockMustCommitToItsStateRoot(t *testing.T) {
+	newTestChain(t)
+	_, alice := testKey("alice")
+
+	block := testBlock(acquireTx("rooted", alice))
+	good := block.StateRoot
+	block.StateRoot[0]++
+	if err := addBlock(block.Serialize(), nil); err == nil {
+		t.Fatal("a block with the wrong state root was added")
+	}
+
+	block.StateRoot = good
+	if err := addBlock(block.Serialize(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if chainstate.Root() != good {
+		t.Fatal("chainstate root isn't the one in the block")
+	}
+	if err := checkChainState(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateBlockFromMempool(t *testing.T) {
+	newTestChain(t)
+	aliceSK, alice := testKey("alice")
+	_, bob := testKey("bob")
+
+	// the publish depends on the acquire that arrived before it
+	for _, tx := range []common.Transaction{
+		acquireTx("fresh", alice),
+		publishTx(t, "fresh", [20]byte{5}, aliceSK),
+		acquireTx("fresh", bob),
+	} {
+		mempool.Add(tx)
+	}
+
+	result, err := RPCCreateBlock(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := result.(map[string]interface{})
+	if info["transactions"] != 2 {
+		t.Fatalf("block has %v transactions, the second acquire should be left out", info["transactions"])
+	}
+	serializedBlock, _ := hex.DecodeString(info["block"].(string))
+	if err := addBlock(serializedBlock, nil); err != nil {
+		t.Fatal(err)
+	}
+	// and the one left out can't be mined anymore
+	if len(mempool.Hashes()) != 0 {
+		t.Fatalf("mempool has %d transactions after the block", len(mempool.Hashes()))
+	}
+}
+
+func TestBlockMustBuildOnTheTip(t *testing.T) {
+	newTestChain(t)
+	_, alice := testKey("alice")
+
+	first := addTestBlock(t, acquireTx("first", alice))
+	addTestBlock(t, acquireTx("second", alice))
+
+	// a sibling of the second block
+	block := testBlock(acquireTx("third", alice))
+	block.PreviousBlock = first.ID
+	if err := validateBlock(block); err == nil {
+		t.Fatal("a block that doesn't build on the tip validated")
+	}
+	if err := addBlock(block.Serialize(), nil); err == nil {
+		t.Fatal("a block that doesn't build on the tip was added")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/store"
+)
+
+const (
+	REINDEX_WIPING   = "wiping"   // the old name records are being deleted
+	REINDEX_APPLYING = "applying" // the blocks are being applied again
+)
+
+// reindexChainState throws away all name records and rebuilds them by applying
+// again, in order, every block in the height index. if a block isn't valid
+// anymore it and all the ones after it are removed from the index, they stay
+// stored and the bitcoin blocks that committed to them are scanned again. if
+// those are older than the scan log we can't go back to them, and the blocks
+// that came after are lost until the chain is synced from scratch.
+//
+// the phase it is in is saved so it can be finished if it is interrupted:
+// blocks are applied one transaction at a time, so a reindex stopped while
+// applying them is resumed from the height it got to, one stopped while
+// wiping is started again.
+func reindexChainState() error {
+	// read the index before addBlock starts rewriting it. it is only ever
+	// truncated at the end, so it is still complete if we were interrupted
+	var ids []metainfo.Hash
+	for height := 1; ; height++ {
+		id, err := loadBlockIdAtHeight(height)
+		if err == store.ErrNotFound {
+			break
+		} else if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	phase, err := loadReindexPhase()
+	if err != nil {
+		return err
+	}
+	if phase != REINDEX_APPLYING {
+		if err := db.Update(func(txn store.Txn) error {
+			return txn.Set(checkpointKey(REINDEXING), []byte(REINDEX_WIPING))
+		}); err != nil {
+			return err
+		}
+		for _, bucket := range [][]byte{BUCKET_NAMES, BUCKET_UNDO, BUCKET_ROOTS} {
+			if _, err := deleteBucket(bucket); err != nil {
+				return err
+			}
+		}
+		if err := db.Update(func(txn store.Txn) error {
+			if err := txn.Set(checkpointKey(BLOCK_HEIGHT), []byte("0")); err != nil {
+				return err
+			}
+			return txn.Set(checkpointKey(REINDEXING), []byte(REINDEX_APPLYING))
+		}); err != nil {
+			return err
+		}
+	}
+	if err := loadChainState(); err != nil {
+		return err
+	}
+
+	start, _ := chainstate.Current()
+	if start > 0 {
+		log.Info().Int("height", start).Int("blocks", len(ids)).Msg("resuming chainstate reindex")
+	} else {
+		log.Info().Int("blocks", len(ids)).Msg("reindexing chainstate")
+	}
+	for i := start; i < len(ids); i++ {
+		serializedBlock, err := loadSerializedBlock(ids[i])
+		if err == nil {
+			err = addBlock(serializedBlock, nil)
+		}
+		if err != nil {
+			log.Warn().Err(err).Int("height", i+1).Str("block", ids[i].HexString()).
+				Msg("block can't be applied, dropping it and the ones after it from the index")
+			if err := truncateIndex(i, ids[i:]); err != nil {
+				return err
+			}
+			break
+		}
+
+		if (i+1)%1000 == 0 {
+			log.Info().Int("height", i+1).Msg("reindexing chainstate")
+		}
+	}
+
+	if err := db.Update(func(txn store.Txn) error {
+		return txn.Delete(checkpointKey(REINDEXING))
+	}); err != nil {
+		return err
+	}
+
+	height, tip := chainstate.Current()
+	log.Info().Int("height", height).Str("tip", tip.HexString()).
+		Msg("chainstate reindexed")
+	return nil
+}
+
+// loadReindexPhase returns "" if no reindex was interrupted.
+func loadReindexPhase() (phase string, err error) {
+	err = db.View(func(txn store.Txn) error {
+		v, err := txn.Get(checkpointKey(REINDEXING))
+		if err == store.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		phase = string(v)
+		return nil
+	})
+	return phase, err
+}
+
+// truncateIndex removes the blocks above height from the index and moves the
+// bitcoin checkpoints back to before the first of them.
+func truncateIndex(height int, dropped []metainfo.Hash) error {
+	lastScannedBlock, _, err := loadCheckpoints()
+	if err != nil {
+		return err
+	}
+
+	restore := func() {}
+	if err := db.Update(func(txn store.Txn) error {
+		for i, id := range dropped {
+			if err := txn.Delete(heightKey(height + 1 + i)); err != nil {
+				return err
+			}
+			if err := txn.Delete(anchorKey(id)); err != nil {
+				return err
+			}
+		}
+
+		fork, e, ok, err := findScanBefore(txn, lastScannedBlock, height)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Warn().Int("height", height).
+				Msg("blocks were committed to before the scan log, they won't be scanned again")
+			return nil
+		}
+		log.Info().Int("from", lastScannedBlock).Int("to", fork).
+			Msg("going back to scan the blocks that were dropped again")
+		restore, err = rewindScanLog(txn, lastScannedBlock, fork, e)
+		return err
+	}); err != nil {
+		return err
+	}
+	restore()
+	return nil
+}
+
+// verifyChain checks the last n blocks: that the height index points to blocks
+// we have, that each one builds on the one below it and that its transactions
+// were valid given the name data kept in its undo record. it returns how many
+// blocks were checked.
+func verifyChain(n int) (checked int, err error) {
+	chainstate.RLock()
+	defer chainstate.RUnlock()
+	tip := chainstate.BlockHeight
+
+	err = db.View(func(txn store.Txn) error {
+		v, err := txn.Get(checkpointKey(BLOCK_HEIGHT))
+		if err == store.ErrNotFound {
+			v = []byte("0")
+		} else if err != nil {
+			return err
+		}
+		if string(v) != strconv.Itoa(tip) {
+			return fmt.Errorf("height is %d in memory but %s on disk", tip, v)
+		}
+
+		if _, err := txn.Get(heightKey(tip + 1)); err == nil {
+			return fmt.Errorf("there is a block at height %d, above the tip", tip+1)
+		} else if err != store.ErrNotFound {
+			return err
+		}
+
+		for height := tip; height > 0 && height > tip-n; height-- {
+			if err := verifyBlockAtHeight(txn, height); err != nil {
+				return fmt.Errorf("block at height %d: %w", height, err)
+			}
+			checked++
+		}
+		return nil
+	})
+	return checked, err
+}
+
+var errNotInUndo = errors.New("name is not in the undo data")
+
+func verifyBlockAtHeight(txn store.Txn, height int) error {
+	v, err := txn.Get(heightKey(height))
+	if err != nil {
+		return fmt.Errorf("failed to load id: %w", err)
+	}
+	var id metainfo.Hash
+	copy(id[:], v)
+
+	serializedBlock, err := txn.Get(blockKey(id))
+	if err != nil {
+		return fmt.Errorf("failed to load block %s: %w", id.HexString(), err)
+	}
+	block, err := common.ParseBlock(serializedBlock)
+	if err != nil {
+		return err
+	}
+	if block.ID != id {
+		return fmt.Errorf("index says %s but the stored block is %s",
+			id.HexString(), block.ID.HexString())
+	}
+
+	if height > 1 {
+		previous, err := txn.Get(heightKey(height - 1))
+		if err != nil {
+			return fmt.Errorf("failed to load the previous id: %w", err)
+		}
+		if !bytes.Equal(block.PreviousBlock[:], previous) {
+			return fmt.Errorf("builds on %s, not on %x", block.PreviousBlock.HexString(), previous)
+		}
+	}
+
+	// the root is checked against the tree when the block is added, here only
+	// against what we saved then
+	root, err := txn.Get(rootKey(block.ID))
+	if err != nil {
+		return fmt.Errorf("failed to load state root: %w", err)
+	}
+	if !bytes.Equal(root, block.StateRoot[:]) {
+		return fmt.Errorf("block has state root %x but %x was saved for it", block.StateRoot, root)
+	}
+
+	value, err := txn.Get(undoKey(block.ID))
+	if err != nil {
+		return fmt.Errorf("failed to load undo data: %w", err)
+	}
+	undo, err := decodeUndo(value)
+	if err != nil {
+		return err
+	}
+
+	// the undo data has what every name changed by the block was before it,
+	// the transactions are replayed on top of that
+	bs := newBlockState(txn, height-1, nil)
+	bs.base = func(nameHash [32]byte) (*NameData, error) {
+		previous, ok := undo[nameHash]
+		if !ok {
+			return nil, errNotInUndo
+		}
+		if previous == nil {
+			return nil, nil
+		}
+		nd := decodeNameData(previous)
+		return &nd, nil
+	}
+	for i, itx := range block.Transactions {
+		tx := itx.(common.Transaction)
+		err := bs.apply(tx)
+		if err == errNotInUndo && tx.Type == common.TYPE_RENEW {
+			// renewals don't change the name so they have no undo record and
+			// we can't know who the owner was, only the recent block is checked
+			if !isRecentBlock(txn, tx.RecentBlock, height-1) {
+				return fmt.Errorf("transaction %d: renew doesn't reference a recent block", i)
+			}
+			continue
+		} else if err == errNotInUndo {
+			return fmt.Errorf("transaction %d: name %x is missing from the undo data",
+				i, transactionNameHash(tx))
+		} else if err != nil {
+			return fmt.Errorf("transaction %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fiatjaf/namechain/store"
+)
+
+func TestReindexScansDroppedBlocksAgain(t *testing.T) {
+	newTestChain(t)
+	chain := newTestBitcoin(t, 3)
+	_, alice := testKey("alice")
+	syncBitcoin(t)
+
+	first := publishTestBlock(t, acquireTx("first", alice))
+	mineLink(t, chain, 1, &first)
+	syncBitcoin(t)
+	before, _, err := loadCheckpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := publishTestBlock(t, acquireTx("second", alice))
+	mineLink(t, chain, 2, &second)
+	syncBitcoin(t)
+
+	// the stored copy of the second block goes bad, so reindexing drops it
+	if err := db.Update(func(txn store.Txn) error {
+		return txn.Set(blockKey(second.ID), []byte("garbage"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reindexChainState(); err != nil {
+		t.Fatal(err)
+	}
+	if height, tip := chainstate.Current(); height != 1 || tip != first.ID {
+		t.Fatal("bad block wasn't dropped")
+	}
+	if lastScannedBlock, _, err := loadCheckpoints(); err != nil || lastScannedBlock != before {
+		t.Fatalf("checkpoints weren't rewound to %d: %d %v", before, lastScannedBlock, err)
+	}
+
+	// and it is downloaded again
+	syncBitcoin(t)
+	if height, tip := chainstate.Current(); height != 2 || tip != second.ID {
+		t.Fatal("dropped block wasn't scanned again")
+	}
+	if err := checkChainState(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterruptedReindexIsFinished(t *testing.T) {
+	newTestChain(t)
+	_, alice := testKey("alice")
+	var ids [][]byte
+	for _, name := range []string{"first", "second", "third"} {
+		block := addTestBlock(t, acquireTx(name, alice))
+		ids = append(ids, block.ID[:])
+	}
+	root := chainstate.Tree.Root()
+
+	finished := func() {
+		t.Helper()
+		if err := reindexChainState(); err != nil {
+			t.Fatal(err)
+		}
+		if height, _ := chainstate.Current(); height != 3 || chainstate.Tree.Root() != root {
+			t.Fatalf("reindex ended at height %d", height)
+		}
+		if phase, err := loadReindexPhase(); err != nil || phase != "" {
+			t.Fatalf("reindex checkpoint left behind: %q %v", phase, err)
+		}
+		if _, err := verifyChain(10); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkChainState(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// stopped after applying the first block again: the index above it is
+	// still there and the reindex goes on from there
+	if err := undoBlocks(1, func(txn store.Txn) error {
+		for height := 2; height <= 3; height++ {
+			if err := txn.Set(heightKey(height), ids[height-1]); err != nil {
+				return err
+			}
+		}
+		return txn.Set(checkpointKey(REINDEXING), []byte(REINDEX_APPLYING))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	finished()
+
+	// stopped while deleting the old records: it starts over
+	if err := db.Update(func(txn store.Txn) error {
+		if err := txn.Set(checkpointKey(REINDEXING), []byte(REINDEX_WIPING)); err != nil {
+			return err
+		}
+		return txn.Delete(rootKey(chainstate.Tip))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	finished()
+}
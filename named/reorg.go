@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/fiatjaf/namechain/store"
+)
+
+// how many bitcoin blocks we remember, a reorg deeper than this stops the node.
+const SCAN_LOG_DEPTH = 100
+
+// scanEntry is what we had after scanning a bitcoin block, so we can go back to
+// it when the blocks after it are reorged out.
+type scanEntry struct {
+	hash             chainhash.Hash
+	spacechainHeight int
+	lastSpottedTxid  chainhash.Hash
+	bmmGenesis       chainhash.Hash // zero if we had no bmm chain
+}
+
+func (e scanEntry) serialize() []byte {
+	v := make([]byte, 100)
+	copy(v[0:32], e.hash[:])
+	binary.BigEndian.PutUint32(v[32:36], uint32(e.spacechainHeight))
+	copy(v[36:68], e.lastSpottedTxid[:])
+	copy(v[68:100], e.bmmGenesis[:])
+	return v
+}
+
+func parseScanEntry(v []byte) (e scanEntry, err error) {
+	if len(v) != 100 {
+		return e, errors.New("invalid scan log entry")
+	}
+	copy(e.hash[:], v[0:32])
+	e.spacechainHeight = int(binary.BigEndian.Uint32(v[32:36]))
+	copy(e.lastSpottedTxid[:], v[36:68])
+	copy(e.bmmGenesis[:], v[68:100])
+	return e, nil
+}
+
+// saveScanEntry logs a scanned bitcoin block and forgets the ones too old to
+// be reorged out.
+func saveScanEntry(txn store.Txn, height int, e scanEntry) error {
+	if err := txn.Set(scanKey(height), e.serialize()); err != nil {
+		return err
+	}
+	if err := txn.Delete(scanKey(height - SCAN_LOG_DEPTH)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// currentScanEntry is what we have now, after scanning the block with hash.
+func currentScanEntry(hash chainhash.Hash, lastSpottedTxid chainhash.Hash) scanEntry {
+	e := scanEntry{hash: hash, lastSpottedTxid: lastSpottedTxid}
+	e.spacechainHeight, _ = chainstate.Current()
+	if chain := currentBMMChain(); chain != nil {
+		e.bmmGenesis = chain.Genesis.TxHash()
+	}
+	return e
+}
+
+func loadScanEntry(txn store.Txn, height int) (e scanEntry, ok bool, err error) {
+	v, err := txn.Get(scanKey(height))
+	if err == store.ErrNotFound {
+		return e, false, nil
+	} else if err != nil {
+		return e, false, err
+	}
+	e, err = parseScanEntry(v)
+	return e, err == nil, err
+}
+
+// checkBitcoinReorg compares the last block we scanned with the one bitcoin has
+// at that height now and, if they differ, goes back to where they forked. it
+// returns true if it went back.
+func checkBitcoinReorg(lastScannedBlock int) (bool, error) {
+	e, ok, err := viewScanEntry(lastScannedBlock)
+	if err != nil || !ok {
+		// scanned before we kept a log, nothing to compare with
+		return false, err
+	}
+	if lastScannedBlock == GENESIS_BLOCK || isInBitcoin(lastScannedBlock, e.hash) {
+		return false, nil
+	}
+
+	// go down until we find a block that is still there, the genesis block
+	// is where we start so it always is
+	for fork := lastScannedBlock - 1; fork >= GENESIS_BLOCK; fork-- {
+		if e, ok, err = viewScanEntry(fork); err != nil {
+			return false, err
+		} else if !ok {
+			break
+		}
+		if fork == GENESIS_BLOCK || isInBitcoin(fork, e.hash) {
+			return true, rewindBitcoinScan(lastScannedBlock, fork, e)
+		}
+	}
+	return false, fmt.Errorf("bitcoin reorg is deeper than the %d blocks we keep track of", SCAN_LOG_DEPTH)
+}
+
+func viewScanEntry(height int) (e scanEntry, ok bool, err error) {
+	err = db.View(func(txn store.Txn) (err error) {
+		e, ok, err = loadScanEntry(txn, height)
+		return err
+	})
+	return e, ok, err
+}
+
+func isInBitcoin(height int, hash chainhash.Hash) bool {
+	current, err := bitcoin.GetBlockHash(int64(height))
+	if err != nil {
+		// either the chain got shorter or bitcoind is failing, in which case
+		// the next block won't be found either and we'll be back here
+		if count, err := bitcoin.GetBlockCount(); err == nil && count < int64(height) {
+			return false
+		}
+		return true
+	}
+	return *current == hash
+}
+
+// rewindBitcoinScan undoes the spacechain blocks anchored after the fork and
+// goes back to what we had after scanning it.
+func rewindBitcoinScan(lastScannedBlock int, fork int, e scanEntry) error {
+	log.Warn().Int("from", lastScannedBlock).Int("to", fork).
+		Msg("bitcoin blocks we scanned were reorged out, going back")
+
+	var restore func()
+	if err := undoBlocks(e.spacechainHeight, func(txn store.Txn) (err error) {
+		restore, err = rewindScanLog(txn, lastScannedBlock, fork, e)
+		return err
+	}); err != nil {
+		return err
+	}
+	restore()
+	return nil
+}
+
+// rewindScanLog moves the checkpoints back to the fork within txn, so the
+// blocks after it are scanned again. the returned function must be called
+// once txn is committed.
+func rewindScanLog(txn store.Txn, lastScannedBlock int, fork int, e scanEntry) (func(), error) {
+	for height := fork + 1; height <= lastScannedBlock; height++ {
+		if err := txn.Delete(scanKey(height)); err != nil {
+			return nil, err
+		}
+	}
+	if err := saveCheckpoints(txn, fork, &e.lastSpottedTxid); err != nil {
+		return nil, err
+	}
+
+	current := currentBMMChain()
+	if current == nil && e.bmmGenesis == (chainhash.Hash{}) ||
+		current != nil && current.Genesis.TxHash() == e.bmmGenesis {
+		return func() {}, nil
+	}
+	chain, err := restoreBMMChain(txn, e.bmmGenesis)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if chain != nil {
+			switchBMMChain(chain)
+		} else {
+			setBMMChain(nil)
+		}
+	}, nil
+}
+
+// findScanBefore finds the last bitcoin block we scanned before the spacechain
+// went past height.
+func findScanBefore(txn store.Txn, lastScannedBlock int, height int) (fork int, e scanEntry, ok bool, err error) {
+	for fork = lastScannedBlock; fork >= GENESIS_BLOCK; fork-- {
+		if e, ok, err = loadScanEntry(txn, fork); err != nil || !ok {
+			return fork, e, false, err
+		}
+		if e.spacechainHeight <= height {
+			return fork, e, true, nil
+		}
+	}
+	return fork, e, false, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/store"
+)
+
+// a read-only REST interface for web frontends, served without authentication:
+//
+//	GET /names/{name}
+//	GET /blocks/{id|height}
+//	GET /blocks/{id|height}/raw
+//	GET /tip
+//
+// every response carries an ETag that changes whenever the tip changes.
+func registerREST(mux *http.ServeMux) {
+	mux.HandleFunc("/names/", restHandler(handleRESTName))
+	mux.HandleFunc("/blocks/", restHandler(handleRESTBlock))
+	mux.HandleFunc("/tip", restHandler(handleRESTTip))
+}
+
+type restError struct {
+	status  int
+	message string
+}
+
+func restHandler(
+	handler func(w http.ResponseWriter, r *http.Request) (interface{}, *restError),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		_, tip := chainstate.Current()
+		etag := `"` + tip.HexString() + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "public, no-cache")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		result, rerr := handler(w, r)
+		if rerr != nil {
+			http.Error(w, rerr.message, rerr.status)
+			return
+		}
+		if result == nil {
+			// handler has written the response itself
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// etagMatches does the weak comparison If-None-Match calls for (RFC 7232):
+// the header is either "*" or a comma-separated list of tags, weak or not.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func handleRESTName(w http.ResponseWriter, r *http.Request) (interface{}, *restError) {
+	name := strings.TrimPrefix(r.URL.Path, "/names/")
+	if name == "" {
+		return nil, &restError{http.StatusBadRequest, "missing name"}
+	}
+
+	nd, err := loadName(name)
+	if err != nil {
+		return nil, &restError{http.StatusInternalServerError, err.Error()}
+	}
+	if nd == nil {
+		return nil, &restError{http.StatusNotFound, "name not found"}
+	}
+
+	return nameJSON(*nd), nil
+}
+
+func handleRESTBlock(w http.ResponseWriter, r *http.Request) (interface{}, *restError) {
+	spl := strings.Split(strings.TrimPrefix(r.URL.Path, "/blocks/"), "/")
+	if len(spl) > 2 || (len(spl) == 2 && spl[1] != "raw") {
+		return nil, &restError{http.StatusNotFound, "not found"}
+	}
+
+	// the block may be identified by its id or by its height
+	var id metainfo.Hash
+	height := -1
+	if len(spl[0]) == 40 {
+		if err := id.FromHexString(spl[0]); err != nil {
+			return nil, &restError{http.StatusBadRequest, "invalid block id"}
+		}
+	} else if h, err := strconv.Atoi(spl[0]); err == nil && h > 0 {
+		height = h
+		id, err = loadBlockIdAtHeight(height)
+		if err == store.ErrNotFound {
+			return nil, &restError{http.StatusNotFound, "block not found"}
+		} else if err != nil {
+			return nil, &restError{http.StatusInternalServerError, err.Error()}
+		}
+	} else {
+		return nil, &restError{http.StatusBadRequest, "invalid block id or height"}
+	}
+
+	serializedBlock, err := loadSerializedBlock(id)
+	if err == store.ErrNotFound {
+		return nil, &restError{http.StatusNotFound, "block not found"}
+	} else if err != nil {
+		return nil, &restError{http.StatusInternalServerError, err.Error()}
+	}
+
+	if len(spl) == 2 {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(serializedBlock)
+		return nil, nil
+	}
+
+	block, err := common.ParseBlock(serializedBlock)
+	if err != nil {
+		return nil, &restError{http.StatusInternalServerError, err.Error()}
+	}
+
+	result := blockJSON(block)
+	if height != -1 {
+		result["height"] = height
+	}
+	return result, nil
+}
+
+func handleRESTTip(w http.ResponseWriter, r *http.Request) (interface{}, *restError) {
+	height, tip := chainstate.Current()
+	if height == 0 {
+		return nil, &restError{http.StatusNotFound, "no blocks yet"}
+	}
+
+	return map[string]interface{}{
+		"id":     tip.HexString(),
+		"height": height,
+	}, nil
+}
+
+func nameJSON(nd NameData) map[string]interface{} {
+	return map[string]interface{}{
+		"name":     nd.Name,
+		"key":      hex.EncodeToString(nd.Key[:]),
+		"infohash": hex.EncodeToString(nd.DataBlobInfoHash[:]),
+	}
+}
+
+func blockJSON(block common.Block) map[string]interface{} {
+	txs := make([]interface{}, len(block.Transactions))
+	for i, itx := range block.Transactions {
+		txs[i] = transactionJSON(itx.(common.Transaction))
+	}
+
+	return map[string]interface{}{
+		"id":           block.ID.HexString(),
+		"previous":     block.PreviousBlock.HexString(),
+		"merkleroot":   hex.EncodeToString(block.MerkleRoot),
+		"stateroot":    hex.EncodeToString(block.StateRoot[:]),
+		"blockhash":    hex.EncodeToString(block.BlockHash),
+		"transactions": txs,
+	}
+}
+
+func transactionJSON(tx common.Transaction) map[string]interface{} {
+	hash := tx.Hash()
+	result := map[string]interface{}{
+		"hash": hex.EncodeToString(hash[:]),
+		"type": tx.Type,
+	}
+
+	switch tx.Type {
+	case common.TYPE_ACQUIRE:
+		result["key"] = hex.EncodeToString(tx.Key[:])
+		result["namehash"] = hex.EncodeToString(tx.NameHash[:])
+	case common.TYPE_TRANSFER:
+		result["namehash"] = hex.EncodeToString(tx.NameHash[:])
+		result["key"] = hex.EncodeToString(tx.Key[:])
+	case common.TYPE_RENEW:
+		result["namehash"] = hex.EncodeToString(tx.NameHash[:])
+	case common.TYPE_PUBLISH:
+		result["name"] = tx.Name
+		result["infohash"] = hex.EncodeToString(tx.PublishHash[:])
+	}
+	if tx.Type != common.TYPE_ACQUIRE {
+		result["recentblock"] = hex.EncodeToString(tx.RecentBlock[:])
+		result["signature"] = hex.EncodeToString(tx.Signature[:])
+	}
+
+	return result
+}
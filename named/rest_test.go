@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func restGet(t *testing.T, path string, ifNoneMatch string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	registerREST(mux)
+
+	r := httptest.NewRequest("GET", path, nil)
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func restJSON(t *testing.T, path string) map[string]interface{} {
+	t.Helper()
+
+	w := restGet(t, path, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: %d %s", path, w.Code, w.Body.String())
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+	return result
+}
+
+func TestRESTEndpoints(t *testing.T) {
+	newTestChain(t)
+	aliceSK, alice := testKey("alice")
+
+	// nothing yet
+	for path, status := range map[string]int{
+		"/tip":              http.StatusNotFound,
+		"/names/alice.name": http.StatusNotFound,
+		"/names/":           http.StatusBadRequest,
+		"/blocks/1":         http.StatusNotFound,
+		"/blocks/0":         http.StatusBadRequest,
+		"/blocks/abc":       http.StatusBadRequest,
+		"/blocks/1/json":    http.StatusNotFound,
+		"/blocks/" + hex.EncodeToString(make([]byte, 20)): http.StatusNotFound,
+	} {
+		if w := restGet(t, path, ""); w.Code != status {
+			t.Errorf("%s: expected %d, got %d", path, status, w.Code)
+		}
+	}
+
+	first := addTestBlock(t, acquireTx("alice.name", alice))
+	infohash := [20]byte{1}
+	second := addTestBlock(t, publishTx(t, "alice.name", infohash, aliceSK))
+
+	tip := restJSON(t, "/tip")
+	if tip["id"] != second.ID.HexString() || tip["height"] != float64(2) {
+		t.Fatalf("wrong tip %v", tip)
+	}
+
+	name := restJSON(t, "/names/alice.name")
+	if name["name"] != "alice.name" || name["key"] != hex.EncodeToString(alice[:]) ||
+		name["infohash"] != hex.EncodeToString(infohash[:]) {
+		t.Fatalf("wrong name %v", name)
+	}
+
+	byHeight := restJSON(t, "/blocks/1")
+	if byHeight["id"] != first.ID.HexString() || byHeight["height"] != float64(1) ||
+		len(byHeight["transactions"].([]interface{})) != 1 {
+		t.Fatalf("wrong block at height 1 %v", byHeight)
+	}
+	byId := restJSON(t, "/blocks/"+second.ID.HexString())
+	if byId["id"] != second.ID.HexString() || byId["previous"] != first.ID.HexString() {
+		t.Fatalf("wrong block %v", byId)
+	}
+	if _, ok := byId["height"]; ok {
+		t.Fatal("height given for a block requested by id")
+	}
+
+	for _, path := range []string{
+		"/blocks/" + first.ID.HexString() + "/raw",
+		"/blocks/1/raw",
+	} {
+		w := restGet(t, path, "")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/octet-stream" ||
+			!bytes.Equal(w.Body.Bytes(), first.Serialize()) {
+			t.Fatalf("%s: %d %x", path, w.Code, w.Body.Bytes())
+		}
+	}
+
+	if w := restGet(t, "/blocks/3", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("block above the tip: %d", w.Code)
+	}
+}
+
+func TestRESTNotModified(t *testing.T) {
+	newTestChain(t)
+	_, alice := testKey("alice")
+	addTestBlock(t, acquireTx("alice.name", alice))
+
+	w := restGet(t, "/tip", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("%d, headers %v", w.Code, w.Header())
+	}
+
+	for ifNoneMatch, status := range map[string]int{
+		etag:                          http.StatusNotModified,
+		"W/" + etag:                   http.StatusNotModified,
+		`"other", ` + etag:            http.StatusNotModified,
+		`"other",W/` + etag + `, "x"`: http.StatusNotModified,
+		"*":                           http.StatusNotModified,
+		`"other"`:                     http.StatusOK,
+		`"other", W/"x"`:              http.StatusOK,
+		etag[1 : len(etag)-1]:         http.StatusOK,
+	} {
+		if w := restGet(t, "/tip", ifNoneMatch); w.Code != status {
+			t.Errorf("If-None-Match %s: expected %d, got %d", ifNoneMatch, status, w.Code)
+		} else if status == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: body in a 304", ifNoneMatch)
+		}
+	}
+
+	// the tag changes with the tip
+	addTestBlock(t, acquireTx("bob.name", alice))
+	if w := restGet(t, "/names/alice.name", etag); w.Code != http.StatusOK {
+		t.Fatalf("stale etag matched: %d", w.Code)
+	}
+}
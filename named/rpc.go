@@ -2,14 +2,91 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/fiatjaf/namechain/common"
 )
 
+type rpcMethod struct {
+	handler     func(params map[string]interface{}) (result interface{}, err error)
+	params      []string // in the order they can be given positionally
+	description string
+}
+
+var rpcMethods map[string]rpcMethod
+
+func init() {
+	// this is set here to avoid an initialization loop with RPCHelp
+	rpcMethods = map[string]rpcMethod{
+		"help": {RPCHelp, []string{"method"},
+			"lists all methods or describes one of them."},
+		"getinfo": {RPCGetInfo, nil,
+			"returns the current state of this node."},
+		"getbids": {RPCGetBids, nil,
+			"lists the bids competing for the next BMM link seen in bitcoind's mempool."},
+		"checkchainstate": {RPCCheckChainState, nil,
+			"compares the chainstate in memory with the one on disk."},
+		"getstateroot": {RPCGetStateRoot, []string{"height"},
+			"returns the root of the tree of all names after the block at 'height' (default the tip)."},
+		"verifychain": {RPCVerifyChain, []string{"blocks"},
+			"checks the height index and re-validates the last 'blocks' blocks (default 6)."},
+		"getname": {RPCGetName, []string{"name", "namehash"},
+			"returns the owner and published data of a name."},
+		"getnameproof": {RPCGetNameProof, []string{"name", "namehash", "height"},
+			"returns the data of a name, or that it has none, after the block at 'height' " +
+				"(default the tip) with proofs a client can check against that block's state root " +
+				"and the commitment to the tip in bitcoin."},
+		"gettxproof": {RPCGetTxProof, []string{"tx", "txhash", "height"},
+			"returns the merkle path of a transaction within its block, " +
+				"looking in the last 1000 blocks unless 'height' is given."},
+		"createblock": {RPCCreateBlock, nil,
+			"makes a block on top of the tip with the transactions in the mempool, " +
+				"hex-encoded and ready for 'mine'."},
+		"mine": {RPCMine, []string{"block"},
+			"tries to mine the given hex-encoded spacechain block."},
+		"sendtransaction": {RPCSendTransaction, []string{"tx"},
+			"adds a hex-encoded transaction to the mempool and relays it."},
+		"walletunlock": {RPCWalletUnlock, []string{"passphrase", "timeout"},
+			"unlocks the keystore for 'timeout' seconds (default 60, 0 for forever)."},
+		"walletlock": {RPCWalletLock, nil,
+			"locks the keystore."},
+		"listkeys": {RPCListKeys, nil,
+			"lists the public keys in the keystore."},
+		"signtransaction": {RPCSignTransaction, []string{"tx", "pubkey"},
+			"signs a hex-encoded transaction with a key from the keystore, " +
+				"by default the current owner of the name."},
+	}
+}
+
+// namedParams accepts params given either as an object or as an array, in
+// which case they're matched with the method's params in order.
+func (method rpcMethod) namedParams(params interface{}) (map[string]interface{}, error) {
+	switch p := params.(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return p, nil
+	case []interface{}:
+		if len(p) > len(method.params) {
+			return nil, fmt.Errorf("too many params, expected at most %d", len(method.params))
+		}
+		named := make(map[string]interface{}, len(p))
+		for i, value := range p {
+			named[method.params[i]] = value
+		}
+		return named, nil
+	default:
+		return nil, errors.New("params must be an object or an array")
+	}
+}
+
 func listenRPC() {
 	log.Info().Str("addr", config.RPCAddr).Msg("listening")
 	http.HandleFunc("/rpc", handleRPC)
+	http.HandleFunc("/ws", handleWebSocket)
+	registerREST(http.DefaultServeMux)
 	err := http.ListenAndServe(config.RPCAddr, nil)
 	if err != nil {
 		log.Error().Err(err).Msg("error serving http")
@@ -18,6 +95,14 @@ func listenRPC() {
 
 func handleRPC(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+
+	authorized, admin := authenticateRPC(r)
+	if !authorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="named"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	var req common.RPCRequest
 	var resp common.RPCResponse
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -25,20 +110,34 @@ func handleRPC(w http.ResponseWriter, r *http.Request) {
 		resp.Error.Code = -32700
 		resp.Error.Message = "error decoding request JSON"
 		json.NewEncoder(w).Encode(resp)
+		return
 	}
 	resp.ID = req.ID
 
-	var result interface{}
-	switch req.Method {
-	case "getinfo":
-		result, err = RPCGetInfo(req.Params)
-	case "mine":
-		result, err = RPCMine(req.Params)
-	default:
+	if !admin && !rpcReadOnlyMethods[req.Method] {
+		resp.Error.Code = -32001
+		resp.Error.Message = "method '" + req.Method + "' requires admin permissions"
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	method, ok := rpcMethods[req.Method]
+	if !ok {
 		resp.Error.Code = -32601
 		resp.Error.Message = "method not found: '" + req.Method + "'"
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	params, err := method.namedParams(req.Params)
+	if err != nil {
+		resp.Error.Code = -32602
+		resp.Error.Message = err.Error()
+		json.NewEncoder(w).Encode(resp)
+		return
 	}
 
+	result, err := method.handler(params)
 	if err == nil {
 		resp.Result = result
 	} else {
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/fiatjaf/namechain/common"
+)
+
+// methods that any authenticated user can call. everything else requires admin
+// permissions, which the cookie and rpc-auth entries without 'readonly' have.
+var rpcReadOnlyMethods = map[string]bool{
+	"help":         true,
+	"getinfo":      true,
+	"getname":      true,
+	"getnameproof": true,
+	"gettxproof":   true,
+	"getstateroot": true,
+	"getbids":      true,
+}
+
+var rpcCookiePassword string
+
+func writeRPCCookie() {
+	password, err := common.WriteCookie(config.DataDir)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to write rpc cookie file")
+	}
+	rpcCookiePassword = password
+}
+
+// authenticateRPC tells if the request has valid credentials and, if it has,
+// whether they grant admin permissions.
+func authenticateRPC(r *http.Request) (ok bool, admin bool) {
+	user, password, hasAuth := r.BasicAuth()
+	if !hasAuth {
+		return false, false
+	}
+
+	if user == common.COOKIE_USER {
+		ok = rpcCookiePassword != "" &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(rpcCookiePassword)) == 1
+		return ok, ok
+	}
+
+	for _, auth := range config.RPCAuth {
+		if auth.User == user && common.CheckRPCAuthHash(auth.Hash, password) {
+			return true, !auth.ReadOnly
+		}
+	}
+
+	return false, false
+}
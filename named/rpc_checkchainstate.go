@@ -0,0 +1,13 @@
+package main
+
+func RPCCheckChainState(params map[string]interface{}) (result interface{}, err error) {
+	if err := checkChainState(); err != nil {
+		return nil, err
+	}
+
+	height, tip := chainstate.Current()
+	return map[string]interface{}{
+		"height": height,
+		"tip":    tip.HexString(),
+	}, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/hex"
+
+	"github.com/fiatjaf/namechain/common"
+)
+
+// RPCCreateBlock makes a block on top of the tip with the transactions in the
+// mempool that are valid together and the state root they lead to, ready to be
+// given to 'mine'.
+func RPCCreateBlock(params map[string]interface{}) (result interface{}, err error) {
+	block, err := newBlock(mempool.Transactions())
+	if err != nil {
+		return nil, err
+	}
+
+	// parsing it back is what gives us its id
+	serializedBlock := block.Serialize()
+	if block, err = common.ParseBlock(serializedBlock); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"block":        hex.EncodeToString(serializedBlock),
+		"id":           block.ID.HexString(),
+		"previous":     block.PreviousBlock.HexString(),
+		"stateroot":    hex.EncodeToString(block.StateRoot[:]),
+		"transactions": len(block.Transactions),
+	}, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+)
+
+func RPCGetBids(params map[string]interface{}) (result interface{}, err error) {
+	chain := currentBMMChain()
+	if chain == nil {
+		return nil, errors.New("no bmm chain loaded, we can't tell which link is next.")
+	}
+
+	if err := refreshBMMAuction(chain); err != nil {
+		return nil, err
+	}
+	n, seen := sortedBMMBids()
+	if n < 1 || n > len(chain.Links) {
+		return nil, errors.New("bmm chain changed meanwhile, try again.")
+	}
+
+	// every child we broadcast commits to our block, replaced ones included
+	var ours [20]byte
+	miner.Lock()
+	if miner.bid != nil && miner.bid.n == n {
+		ours = miner.bid.block.ID
+	}
+	miner.Unlock()
+
+	bids := make([]map[string]interface{}, len(seen))
+	for i, bid := range seen {
+		bids[i] = map[string]interface{}{
+			"child":     bid.Child.String(),
+			"block":     hex.EncodeToString(bid.BlockId[:]),
+			"fee":       bid.Fee,
+			"feerate":   bid.FeeRate,
+			"inmempool": bid.InMempool,
+			"firstseen": bid.FirstSeen.Unix(),
+			"ours":      bid.BlockId == ours,
+		}
+	}
+
+	return map[string]interface{}{
+		"bmm":  n,
+		"link": chain.Links[n-1].TxHash().String(),
+		"bids": bids,
+	}, nil
+}
@@ -1,5 +1,46 @@
 package main
 
+import "encoding/hex"
+
 func RPCGetInfo(params map[string]interface{}) (result interface{}, err error) {
+	gossip.Lock()
+	peers := len(gossip.peers)
+	gossip.Unlock()
+
+	height, tip := chainstate.Current()
+	root := chainstate.Root()
+	info := map[string]interface{}{
+		"height":    height,
+		"stateroot": hex.EncodeToString(root[:]),
+		"mempool":   len(mempool.Hashes()),
+		"peers":     peers,
+	}
+	if height > 0 {
+		info["tip"] = tip.HexString()
+	}
+
+	if chain := currentBMMChain(); chain != nil {
+		bmm := map[string]interface{}{
+			"genesis": chain.Genesis.TxHash().String(),
+			"links":   len(chain.Links),
+		}
+		if next, err := nextBMMLink(chain); err == nil {
+			bmm["next"] = next
+		}
+
+		miner.Lock()
+		if bid := miner.bid; bid != nil {
+			bmm["bid"] = map[string]interface{}{
+				"block": bid.block.ID.HexString(),
+				"bmm":   bid.n,
+				"child": bid.child.TxHash().String(),
+				"fee":   bid.fee,
+				"bumps": bid.bumps,
+			}
+		}
+		miner.Unlock()
+		info["bmm"] = bmm
+	}
 
+	return info, nil
 }
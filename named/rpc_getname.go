@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/fiatjaf/namechain/store"
+)
+
+func RPCGetName(params map[string]interface{}) (result interface{}, err error) {
+	nameHash, err := nameHashParam(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var nd *NameData
+	if err := db.View(func(txn store.Txn) (err error) {
+		nd, err = loadNameHash(txn, nameHash)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if nd == nil {
+		return nil, errors.New("name not found")
+	}
+
+	data := nameJSON(*nd)
+	data["namehash"] = hex.EncodeToString(nameHash[:])
+	return data, nil
+}
+
+// nameHashParam reads either 'name' or 'namehash'.
+func nameHashParam(params map[string]interface{}) (nameHash [32]byte, err error) {
+	if name, ok := params["name"].(string); ok {
+		nameHash = sha256.Sum256([]byte(name))
+	} else if hexHash, ok := params["namehash"].(string); ok {
+		b, err := hex.DecodeString(hexHash)
+		if err != nil || len(b) != 32 {
+			return nameHash, errors.New("'namehash' param is invalid.")
+		}
+		copy(nameHash[:], b)
+	} else {
+		return nameHash, errors.New("Missing 'name' or 'namehash' param.")
+	}
+	return nameHash, nil
+}
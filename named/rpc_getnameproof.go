@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/store"
+)
+
+// how far back from the tip a name can be proven, the blocks above it are
+// undone in memory to get the names at that height.
+const NAME_PROOF_DEPTH = 1000
+
+// RPCGetNameProof returns the data of a name, or that it has none, after the
+// block at 'height' (by default the tip) in a bundle that clients can check
+// with common.VerifyNameProof. it is anchored by the commitment to the tip.
+func RPCGetNameProof(params map[string]interface{}) (result interface{}, err error) {
+	nameHash, err := nameHashParam(params)
+	if err != nil {
+		return nil, err
+	}
+
+	chainstate.RLock()
+	tip := chainstate.BlockHeight
+	tree := chainstate.Tree.Copy()
+	nd, exists := chainstate.KnownNames[nameHash]
+	height := tip
+	if h, ok := params["height"].(float64); ok {
+		lowest := tip - NAME_PROOF_DEPTH + 1
+		if lowest < 1 {
+			lowest = 1
+		}
+		if int(h) < lowest || int(h) > tip {
+			chainstate.RUnlock()
+			return nil, fmt.Errorf("'height' param must be between %d and %d.", lowest, tip)
+		}
+		height = int(h)
+	}
+
+	// the blocks from height to the tip, undoing the ones above height
+	ids := make([]metainfo.Hash, tip-height+1)
+	err = db.View(func(txn store.Txn) error {
+		for h := tip; h >= height; h-- {
+			v, err := txn.Get(heightKey(h))
+			if err != nil {
+				return fmt.Errorf("failed to load block id at %d: %w", h, err)
+			}
+			id := &ids[h-height]
+			copy(id[:], v)
+			if h == height {
+				break
+			}
+
+			value, err := txn.Get(undoKey(*id))
+			if err != nil {
+				return fmt.Errorf("failed to load undo data: %w", err)
+			}
+			undo, err := decodeUndo(value)
+			if err != nil {
+				return err
+			}
+			for changed, previous := range undo {
+				var previousData NameData
+				if previous == nil {
+					tree.Delete(changed)
+				} else {
+					previousData = decodeNameData(previous)
+					tree.Set(changed, nameDataHash(previousData))
+				}
+				if changed == nameHash {
+					nd, exists = previousData, previous != nil
+				}
+			}
+		}
+		return nil
+	})
+	chainstate.RUnlock()
+	if tip == 0 {
+		return nil, errors.New("there are no blocks yet.")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([][]byte, len(ids))
+	for i, id := range ids {
+		if blocks[i], err = loadSerializedBlock(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := common.ParseBlock(blocks[0])
+	if err != nil {
+		return nil, err
+	}
+	root := tree.Root()
+	if root != block.StateRoot {
+		return nil, errors.New("our names don't match the state root of the block, " +
+			"run checkchainstate.")
+	}
+
+	anchored := ids[len(ids)-1]
+	bitcoinBlock, childTxid, err := loadAnchor(anchored)
+	if err == store.ErrNotFound {
+		return nil, errors.New("we don't know where the tip was committed in bitcoin, " +
+			"it was added by an older version.")
+	} else if err != nil {
+		return nil, err
+	}
+
+	bblock, err := bitcoin.GetBlock(&bitcoinBlock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bitcoin block %s: %w", bitcoinBlock, err)
+	}
+	var child *wire.MsgTx
+	for _, tx := range bblock.Transactions {
+		if tx.TxHash() == childTxid {
+			child = tx
+			break
+		}
+	}
+	if child == nil {
+		return nil, fmt.Errorf("bmm child %s isn't in bitcoin block %s anymore", childTxid, bitcoinBlock)
+	}
+	txOutProof, err := common.GetTxOutProof(bitcoin, childTxid, bitcoinBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	var key *[32]byte
+	if exists {
+		key = &nd.Key
+	}
+	return common.NewNameProof(nameHash, key, nd.Name, nd.DataBlobInfoHash,
+		height, root, tree.Prove(nameHash), blocks, child, txOutProof), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fiatjaf/namechain/common"
+)
+
+func TestNameProofs(t *testing.T) {
+	newTestChain(t)
+	chain := newTestBitcoin(t, 3)
+	_, alice := testKey("alice")
+	syncBitcoin(t)
+
+	for n := 1; n <= 3; n++ {
+		block := publishTestBlock(t, acquireTx(fmt.Sprintf("name%d", n), alice))
+		mineLink(t, chain, n, &block)
+		syncBitcoin(t)
+	}
+	_, tip := chainstate.Current()
+	anchor, _, err := loadAnchor(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getProof := func(params map[string]interface{}) common.NameProof {
+		t.Helper()
+		result, err := RPCGetNameProof(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.(common.NameProof)
+	}
+
+	// at the tip and at an earlier height, where the name didn't exist yet
+	for _, c := range []struct {
+		height float64
+		exists bool
+		blocks int
+	}{{3, true, 1}, {2, true, 2}, {1, false, 3}} {
+		p := getProof(map[string]interface{}{"name": "name2", "height": c.height})
+		if p.Exists != c.exists || len(p.Blocks) != c.blocks {
+			t.Fatalf("height %v: exists %v with %d blocks", c.height, p.Exists, len(p.Blocks))
+		}
+		bitcoinBlock, err := common.VerifyNameProof(p, currentBMMChain())
+		if err != nil {
+			t.Fatalf("height %v: %s", c.height, err)
+		}
+		if bitcoinBlock != anchor {
+			t.Fatalf("height %v: anchored in the wrong bitcoin block", c.height)
+		}
+	}
+
+	p := getProof(map[string]interface{}{"name": "name2", "height": float64(1)})
+
+	// a root that isn't the one in the block, even if the name checks out
+	// against it, isn't enough
+	other := common.NewStateTree()
+	forged := p
+	root := other.Root()
+	forged.StateRoot = fmt.Sprintf("%x", root)
+	forged.Siblings = nil
+	if _, err := common.VerifyNameProof(forged, currentBMMChain()); err == nil {
+		t.Fatal("proof against a root not in the block was accepted")
+	}
+
+	// the blocks must link up to the anchored one
+	forged = p
+	forged.Blocks = []string{p.Blocks[0], p.Blocks[2]}
+	if _, err := common.VerifyNameProof(forged, currentBMMChain()); err == nil {
+		t.Fatal("proof with a gap in its blocks was accepted")
+	}
+
+	// the child must spend the anchor of a link of the chain we follow
+	if _, err := common.VerifyNameProof(p, nil); err == nil {
+		t.Fatal("proof was accepted without a bmm chain")
+	}
+	otherChain := *currentBMMChain()
+	otherChain.Links = otherChain.Links[:2]
+	if _, err := common.VerifyNameProof(p, &otherChain); err == nil {
+		t.Fatal("proof anchored by a link that isn't in the chain was accepted")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/fiatjaf/namechain/store"
+)
+
+// RPCGetStateRoot returns the root of the tree of all names after the block at
+// 'height', by default the tip.
+func RPCGetStateRoot(params map[string]interface{}) (result interface{}, err error) {
+	chainstate.RLock()
+	height, tip := chainstate.BlockHeight, chainstate.Tip
+	root := chainstate.Tree.Root()
+	names := chainstate.Tree.Len()
+	chainstate.RUnlock()
+
+	if h, ok := params["height"].(float64); ok && int(h) != height {
+		if h < 1 || int(h) > height {
+			return nil, fmt.Errorf("'height' param must be between 1 and %d.", height)
+		}
+		return stateRootAtHeight(int(h))
+	}
+
+	info := map[string]interface{}{
+		"height": height,
+		"root":   hex.EncodeToString(root[:]),
+		"names":  names,
+	}
+	if height > 0 {
+		info["block"] = tip.HexString()
+	}
+	return info, nil
+}
+
+func stateRootAtHeight(height int) (result interface{}, err error) {
+	id, err := loadBlockIdAtHeight(height)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := loadStateRoot(id)
+	if err == store.ErrNotFound {
+		return nil, errors.New("no state root was saved for this block, " +
+			"it was added by an older version, run with -reindex-chainstate.")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"height": height,
+		"block":  id.HexString(),
+		"root":   hex.EncodeToString(root[:]),
+	}, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/fiatjaf/namechain/common"
+)
+
+// how far back from the tip we look for a transaction when no 'height' is given.
+const TX_PROOF_SEARCH_DEPTH = 1000
+
+// RPCGetTxProof returns the merkle path of a transaction, given by 'tx' or by
+// 'txhash', within the block that has it, which can be given by 'height'.
+func RPCGetTxProof(params map[string]interface{}) (result interface{}, err error) {
+	var txHash [32]byte
+	if rawTxParam, ok := params["tx"].(string); ok {
+		rawTx, err := hex.DecodeString(rawTxParam)
+		if err != nil {
+			return nil, errors.New("'tx' param is invalid hex.")
+		}
+		tx, err := common.ParseTransaction(rawTx)
+		if err != nil {
+			return nil, err
+		}
+		txHash = tx.Hash()
+	} else if hexHash, ok := params["txhash"].(string); ok {
+		b, err := hex.DecodeString(hexHash)
+		if err != nil || len(b) != 32 {
+			return nil, errors.New("'txhash' param is invalid.")
+		}
+		copy(txHash[:], b)
+	} else {
+		return nil, errors.New("Missing 'tx' or 'txhash' param.")
+	}
+
+	tip, _ := chainstate.Current()
+	if h, ok := params["height"].(float64); ok {
+		if h < 1 || int(h) > tip {
+			return nil, fmt.Errorf("'height' param must be between 1 and %d.", tip)
+		}
+		return txProofAtHeight(int(h), txHash)
+	}
+
+	for height := tip; height > 0 && height > tip-TX_PROOF_SEARCH_DEPTH; height-- {
+		proof, err := txProofAtHeight(height, txHash)
+		if err == errTxNotInBlock {
+			continue
+		}
+		return proof, err
+	}
+	return nil, fmt.Errorf("transaction not found in the last %d blocks, "+
+		"give the 'height' param to look further.", TX_PROOF_SEARCH_DEPTH)
+}
+
+var errTxNotInBlock = errors.New("transaction isn't in this block")
+
+func txProofAtHeight(height int, txHash [32]byte) (proof common.TxProof, err error) {
+	id, err := loadBlockIdAtHeight(height)
+	if err != nil {
+		return proof, err
+	}
+	serializedBlock, err := loadSerializedBlock(id)
+	if err != nil {
+		return proof, err
+	}
+	block, err := common.ParseBlock(serializedBlock)
+	if err != nil {
+		return proof, err
+	}
+
+	for _, itx := range block.Transactions {
+		if tx := itx.(common.Transaction); tx.Hash() == txHash {
+			return common.NewTxProof(block, height, tx)
+		}
+	}
+	return proof, errTxNotInBlock
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+func RPCHelp(params map[string]interface{}) (result interface{}, err error) {
+	if name, ok := params["method"].(string); ok {
+		method, ok := rpcMethods[name]
+		if !ok {
+			return nil, errors.New("method not found: '" + name + "'")
+		}
+		return methodHelp(name, method), nil
+	}
+
+	names := make([]string, 0, len(rpcMethods))
+	for name := range rpcMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	methods := make([]interface{}, len(names))
+	for i, name := range names {
+		methods[i] = methodHelp(name, rpcMethods[name])
+	}
+	return methods, nil
+}
+
+func methodHelp(name string, method rpcMethod) map[string]interface{} {
+	params := method.params
+	if params == nil {
+		params = []string{}
+	}
+	return map[string]interface{}{
+		"method":      name,
+		"params":      params,
+		"description": method.description,
+		"admin":       !rpcReadOnlyMethods[name],
+	}
+}
@@ -3,21 +3,43 @@ package main
 import (
 	"encoding/hex"
 	"errors"
+
+	"github.com/fiatjaf/namechain/common"
 )
 
 func RPCMine(params map[string]interface{}) (result interface{}, err error) {
-	nextBMMTransaction := 1 // TODO
-	rawBlockParam, ok := params["block"]
+	rawBlockParam, ok := params["block"].(string)
 	if !ok {
 		return nil, errors.New("Missing 'block' param.")
 	}
 
-	rawBlock, err := hex.DecodeString(rawBlockParam.(string))
+	rawBlock, err := hex.DecodeString(rawBlockParam)
 	if err != nil {
 		return nil, errors.New("'block' param is invalid hex.")
 	}
 
+	block, err := common.ParseBlock(rawBlock)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateBlock(block); err != nil {
+		return nil, err
+	}
+
+	chain := currentBMMChain()
+	if chain == nil {
+		return nil, errors.New("no bmm chain loaded, create one with bmm/generate.")
+	}
+
+	bid, err := startBMMBid(chain, rawBlock, block)
+	if err != nil {
+		return nil, err
+	}
+
 	return map[string]interface{}{
-		"": "",
+		"block": block.ID.HexString(),
+		"bmm":   bid.n,
+		"child": bid.child.TxHash().String(),
+		"fee":   bid.fee,
 	}, nil
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/fiatjaf/namechain/common"
+)
+
+func RPCSendTransaction(params map[string]interface{}) (result interface{}, err error) {
+	rawTxParam, ok := params["tx"].(string)
+	if !ok {
+		return nil, errors.New("Missing 'tx' param.")
+	}
+
+	rawTx, err := hex.DecodeString(rawTxParam)
+	if err != nil {
+		return nil, errors.New("'tx' param is invalid hex.")
+	}
+
+	tx, err := common.ParseTransaction(rawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := acceptTransaction(tx); err != nil {
+		return nil, err
+	}
+
+	hash := tx.Hash()
+	return map[string]interface{}{
+		"hash": hex.EncodeToString(hash[:]),
+	}, nil
+}
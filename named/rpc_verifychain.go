@@ -0,0 +1,25 @@
+package main
+
+import "errors"
+
+func RPCVerifyChain(params map[string]interface{}) (result interface{}, err error) {
+	blocks := 6.0
+	if b, ok := params["blocks"].(float64); ok {
+		if b < 1 {
+			return nil, errors.New("'blocks' param must be at least 1.")
+		}
+		blocks = b
+	}
+
+	checked, err := verifyChain(int(blocks))
+	if err != nil {
+		return nil, err
+	}
+
+	height, tip := chainstate.Current()
+	return map[string]interface{}{
+		"checked": checked,
+		"height":  height,
+		"tip":     tip.HexString(),
+	}, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/namechain/common"
+	"github.com/fiatjaf/namechain/keystore"
+	"github.com/fiatjaf/namechain/store"
+)
+
+// wallet is the same keystore namecli uses, it's optional and stays nil while
+// the datadir doesn't have one.
+var (
+	wallet   *keystore.Keystore
+	walletMu sync.Mutex
+)
+
+func openWallet() {
+	if _, err := currentWallet(); err != nil && err != keystore.ErrNotInitialized {
+		log.Fatal().Err(err).Msg("failed to open keystore")
+	}
+}
+
+// currentWallet picks up the changes namecli made to the keystore file since we
+// last read it, like new keys or the keystore itself if it was just created.
+func currentWallet() (*keystore.Keystore, error) {
+	walletMu.Lock()
+	defer walletMu.Unlock()
+
+	if wallet != nil {
+		return wallet, wallet.Reload()
+	}
+	ks, err := keystore.Open(filepath.Join(config.DataDir, keystore.FILENAME))
+	if err != nil {
+		return nil, err
+	}
+	wallet = ks
+	return wallet, nil
+}
+
+func RPCWalletUnlock(params map[string]interface{}) (result interface{}, err error) {
+	wallet, err := currentWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase, ok := params["passphrase"].(string)
+	if !ok {
+		return nil, errors.New("Missing 'passphrase' param.")
+	}
+	timeout := 60.0
+	if t, ok := params["timeout"].(float64); ok {
+		timeout = t
+	}
+
+	// only an explicit 0 unlocks it until walletlock
+	duration := time.Duration(timeout * float64(time.Second))
+	if timeout < 0 || timeout > 0 && duration <= 0 {
+		return nil, errors.New("'timeout' param must be a positive number of seconds, or 0 for forever.")
+	}
+
+	if err := wallet.Unlock(passphrase, duration); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func RPCWalletLock(params map[string]interface{}) (result interface{}, err error) {
+	wallet, err := currentWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	wallet.Lock()
+	return true, nil
+}
+
+func RPCListKeys(params map[string]interface{}) (result interface{}, err error) {
+	wallet, err := currentWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	return wallet.Keys(), nil
+}
+
+// RPCSignTransaction signs with a key from the keystore, by default the one
+// that currently owns the name the transaction refers to.
+func RPCSignTransaction(params map[string]interface{}) (result interface{}, err error) {
+	wallet, err := currentWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	rawTxParam, ok := params["tx"].(string)
+	if !ok {
+		return nil, errors.New("Missing 'tx' param.")
+	}
+	rawTx, err := hex.DecodeString(rawTxParam)
+	if err != nil {
+		return nil, errors.New("'tx' param is invalid hex.")
+	}
+	tx, err := common.ParseTransaction(rawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey, ok := params["pubkey"].(string)
+	if !ok {
+		var nd *NameData
+		if err := db.View(func(txn store.Txn) (err error) {
+			nd, err = loadNameHash(txn, transactionNameHash(tx))
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if nd == nil {
+			return nil, errors.New("name has no owner, 'pubkey' param is required.")
+		}
+		pubkey = hex.EncodeToString(nd.Key[:])
+	}
+
+	if err := wallet.SignTransaction(&tx, pubkey); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"tx": hex.EncodeToString(tx.Serialize()),
+	}, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/fiatjaf/namechain/store"
+)
+
+// everything is kept in a single database so a block, the chainstate
+// changes it causes and our bitcoin checkpoints can be committed together. the
+// keys are prefixed by the bucket they belong to.
+var (
+	BUCKET_BLOCKS      = []byte("b/") // block id: serialized block
+	BUCKET_HEIGHTS     = []byte("h/") // height: block id
+	BUCKET_NAMES       = []byte("n/") // name hash: name data
+	BUCKET_UNDO        = []byte("u/") // block id: undo data
+	BUCKET_ROOTS       = []byte("r/") // block id: state root after it
+	BUCKET_ANCHORS     = []byte("a/") // block id: bitcoin block hash, bmm child txid
+	BUCKET_CHECKPOINTS = []byte("c/") // LAST_SCANNED_BLOCK, LAST_SEEN_TXID, BLOCK_HEIGHT, BMM_CHAIN, REINDEXING
+	BUCKET_SCANS       = []byte("s/") // bitcoin height: what we had after scanning it
+	BUCKET_BMMCHAINS   = []byte("m/") // genesis txid: bmm chain we switched to
+)
+
+// the chainstate height, in the checkpoints bucket.
+const BLOCK_HEIGHT = "blockheight"
+
+// the phase of a reindex that hasn't finished, in the checkpoints bucket.
+const REINDEXING = "reindexing"
+
+func bucketKey(bucket []byte, key []byte) []byte {
+	return append(append(make([]byte, 0, len(bucket)+len(key)), bucket...), key...)
+}
+
+func blockKey(id metainfo.Hash) []byte {
+	return bucketKey(BUCKET_BLOCKS, id[:])
+}
+
+func nameKey(nameHash [32]byte) []byte {
+	return bucketKey(BUCKET_NAMES, nameHash[:])
+}
+
+func undoKey(id metainfo.Hash) []byte {
+	return bucketKey(BUCKET_UNDO, id[:])
+}
+
+func rootKey(id metainfo.Hash) []byte {
+	return bucketKey(BUCKET_ROOTS, id[:])
+}
+
+func anchorKey(id metainfo.Hash) []byte {
+	return bucketKey(BUCKET_ANCHORS, id[:])
+}
+
+func scanKey(height int) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(height))
+	return bucketKey(BUCKET_SCANS, buf[:])
+}
+
+func bmmChainKey(genesis chainhash.Hash) []byte {
+	return bucketKey(BUCKET_BMMCHAINS, genesis[:])
+}
+
+func checkpointKey(name string) []byte {
+	return bucketKey(BUCKET_CHECKPOINTS, []byte(name))
+}
+
+func openStore() {
+	path := filepath.Join(config.DataDir, DB_NAMED)
+	if config.Storage == store.BACKEND_BBOLT {
+		path = filepath.Join(config.DataDir, DB_NAMED_BOLT)
+	}
+
+	var err error
+	db, err = store.Open(config.Storage, path)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("failed to open database")
+	}
+
+	if err := migrateOldDatabases(); err != nil {
+		log.Fatal().Err(err).Msg("failed to migrate the old databases")
+	}
+}
+
+// migrateOldDatabases copies everything from the kv.db, blocks.db and
+// chainstate.db of older versions into their buckets. the old databases are
+// renamed, not deleted, once they're copied. if we crash before that they are
+// just copied again.
+func migrateOldDatabases() error {
+	for _, old := range []struct {
+		name   string
+		bucket func(key []byte) []byte
+	}{
+		{DB_KV, func(key []byte) []byte {
+			return bucketKey(BUCKET_CHECKPOINTS, key)
+		}},
+		{DB_BLOCKS, func(key []byte) []byte {
+			// block ids have 20 bytes, height keys had 64
+			if len(key) == 20 {
+				return bucketKey(BUCKET_BLOCKS, key)
+			}
+			return bucketKey(BUCKET_HEIGHTS, key)
+		}},
+		{DB_CHAINSTATE, func(key []byte) []byte {
+			switch {
+			case string(key) == BLOCK_HEIGHT:
+				return bucketKey(BUCKET_CHECKPOINTS, key)
+			case len(key) == 25 && string(key[0:5]) == "undo:":
+				return bucketKey(BUCKET_UNDO, key[5:])
+			default:
+				return bucketKey(BUCKET_NAMES, key)
+			}
+		}},
+	} {
+		path := filepath.Join(config.DataDir, old.name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		n, err := migrateOldDatabase(path, old.bucket)
+		if err != nil {
+			return fmt.Errorf("%s: %w", old.name, err)
+		}
+		if err := os.Rename(path, path+".migrated"); err != nil {
+			return err
+		}
+		log.Info().Str("path", path).Int("keys", n).Msg("migrated old database")
+	}
+
+	return nil
+}
+
+// how many keys we copy per transaction, so they don't get too big.
+const MIGRATION_BATCH = 1000
+
+func migrateOldDatabase(path string, bucket func(key []byte) []byte) (n int, err error) {
+	// the old databases were always badger
+	old, err := store.Open(store.BACKEND_BADGER, path)
+	if err != nil {
+		return 0, err
+	}
+	defer old.Close()
+
+	var keys, values [][]byte
+	if err := old.View(func(txn store.Txn) error {
+		return txn.ForEach(nil, func(key, value []byte) error {
+			keys = append(keys, bucket(key))
+			values = append(values, value)
+			return nil
+		})
+	}); err != nil {
+		return 0, err
+	}
+
+	for start := 0; start < len(keys); start += MIGRATION_BATCH {
+		end := start + MIGRATION_BATCH
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := db.Update(func(txn store.Txn) error {
+			for i := start; i < end; i++ {
+				if err := txn.Set(keys[i], values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+// deleteBucket removes every key in a bucket, MIGRATION_BATCH keys per
+// transaction.
+func deleteBucket(bucket []byte) (n int, err error) {
+	var keys [][]byte
+	if err := db.View(func(txn store.Txn) error {
+		return txn.ForEach(bucket, func(key, _ []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+	}); err != nil {
+		return 0, err
+	}
+
+	for start := 0; start < len(keys); start += MIGRATION_BATCH {
+		end := start + MIGRATION_BATCH
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := db.Update(func(txn store.Txn) error {
+			for i := start; i < end; i++ {
+				if err := txn.Delete(keys[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(keys), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fiatjaf/namechain/store"
+)
+
+// writeOldDatabases copies what is in the store to kv.db, blocks.db and
+// chainstate.db in dir, the way versions before the single store kept it.
+func writeOldDatabases(t *testing.T, dir string) {
+	t.Helper()
+
+	old := map[string]map[string][]byte{DB_KV: {}, DB_BLOCKS: {}, DB_CHAINSTATE: {}}
+	if err := db.View(func(txn store.Txn) error {
+		for _, c := range []struct {
+			bucket []byte
+			name   string
+			key    func(key []byte) []byte
+		}{
+			{BUCKET_BLOCKS, DB_BLOCKS, nil},
+			{BUCKET_HEIGHTS, DB_BLOCKS, nil},
+			{BUCKET_NAMES, DB_CHAINSTATE, nil},
+			{BUCKET_UNDO, DB_CHAINSTATE, func(key []byte) []byte {
+				return append([]byte("undo:"), key...)
+			}},
+		} {
+			if err := txn.ForEach(c.bucket, func(key, value []byte) error {
+				key = key[len(c.bucket):]
+				if c.key != nil {
+					key = c.key(key)
+				}
+				old[c.name][string(key)] = value
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		for name, checkpoint := range map[string]string{
+			DB_CHAINSTATE: BLOCK_HEIGHT,
+			DB_KV:         LAST_SCANNED_BLOCK,
+		} {
+			v, err := txn.Get(checkpointKey(checkpoint))
+			if err != nil {
+				return err
+			}
+			old[name][checkpoint] = v
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	old[DB_KV][LAST_SEEN_TXID] = make([]byte, 32)
+
+	for name, values := range old {
+		s, err := store.Open(store.BACKEND_BADGER, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Update(func(txn store.Txn) error {
+			for key, value := range values {
+				if err := txn.Set([]byte(key), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+}
+
+func TestMigrateOldDatabases(t *testing.T) {
+	newTestChain(t)
+	aliceSK, alice := testKey("alice")
+	_, bob := testKey("bob")
+	addTestBlock(t, acquireTx("alice.name", alice), acquireTx("bob.name", bob))
+	addTestBlock(t, publishTx(t, "alice.name", [20]byte{1}, aliceSK))
+	if err := db.Update(func(txn store.Txn) error {
+		return txn.Set(checkpointKey(LAST_SCANNED_BLOCK), []byte("700000"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	height, tip, names, err := readChainState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writeOldDatabases(t, dir)
+	db.Close()
+
+	// a fresh start from the old databases
+	config.DataDir = dir
+	chainstate = &ChainState{}
+	openStore()
+	if err := loadChainState(); err != nil {
+		t.Fatal(err)
+	}
+
+	if h, id := chainstate.Current(); h != height || id != tip {
+		t.Fatalf("migrated to height %d and tip %s, expected %d and %s",
+			h, id.HexString(), height, tip.HexString())
+	}
+	if !reflect.DeepEqual(chainstate.KnownNames, names) {
+		t.Fatalf("migrated names %v, expected %v", chainstate.KnownNames, names)
+	}
+	if lastScannedBlock, _, err := loadCheckpoints(); err != nil || lastScannedBlock != 700000 {
+		t.Fatalf("migrated checkpoint %d: %v", lastScannedBlock, err)
+	}
+
+	// blocks can still be found by height and undone
+	for h := 1; h <= height; h++ {
+		if _, err := loadBlockIdAtHeight(h); err != nil {
+			t.Fatalf("block at height %d: %s", h, err)
+		}
+	}
+	if err := undoBlocks(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if nd, _ := loadName("alice.name"); nd == nil || nd.DataBlobInfoHash != [20]byte{} {
+		t.Fatalf("undo data wasn't migrated: %v", nd)
+	}
+
+	for _, name := range []string{DB_KV, DB_BLOCKS, DB_CHAINSTATE} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s is still there: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name+".migrated")); err != nil {
+			t.Fatalf("%s wasn't renamed: %s", name, err)
+		}
+	}
+}
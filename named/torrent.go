@@ -1,68 +1,49 @@
 package main
 
 import (
-	"io/ioutil"
 	"time"
 
-	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/fiatjaf/namechain/common"
 )
 
-func downloadBlock(infohash metainfo.Hash) chan []byte {
-	// start a torrent client and try to download this block
-	log := log.With().Stringer("block-id", infohash).Logger()
+// where we get spacechain blocks from and publish ours to.
+var blockSource common.BlockSource
 
-	blockchan := make(chan []byte, 1)
-	bt, err := common.TorrentClient(config)
+// newBlockSource starts the torrent client, tests replace it with one that
+// doesn't touch the network.
+var newBlockSource = func() (common.BlockSource, error) {
+	return common.NewTorrentBlockSource(config)
+}
+
+func openBlockSource() {
+	source, err := newBlockSource()
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to start torrent client")
 	}
+	blockSource = source
+}
 
-	blocktorrent, _ := bt.AddTorrentInfoHash(infohash)
+func downloadBlock(id metainfo.Hash) []byte {
+	log := log.With().Stringer("block-id", id).Logger()
 
 	log.Info().Msg("downloading spacechain block")
-	go func() {
-		psc := blocktorrent.SubscribePieceStateChanges()
-		for {
-			sc := (<-psc.Values).(torrent.PieceStateChange)
-			log.Info().Int("index", sc.Index).Bool("partial", sc.Partial).
-				Bool("complete", sc.Complete).Bool("ok", sc.Ok).
-				Msg("piece state changed")
-		}
-	}()
-	go func() {
-		<-blocktorrent.GotInfo()
-		log.Info().Interface("info", blocktorrent.Info()).Msg("got torrent info")
-		<-blocktorrent.Closed()
-		log.Info().Msg("torrent ended")
-	}()
-
-	var downloadComplete chan struct{}
-	go func() {
-		bt.WaitAll()
-		downloadComplete <- struct{}{}
-	}()
-
-	go func() {
-		defer bt.Close()
-		select {
-		case <-downloadComplete:
-			block, err := ioutil.ReadAll(blocktorrent.NewReader())
-			if err != nil {
-				log.Fatal().Err(err).Msg("failed to read complete torrent")
-			}
+	block, err := blockSource.Fetch(id, time.Minute*10)
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't download after 10 minutes")
+	}
 
-			blockchan <- block
+	log.Info().Msg("block downloaded")
+	return block
+}
 
-			// seed it for 30 minutes more
-			log.Info().Msg("seeding")
-			time.Sleep(time.Minute * 30)
-		case <-time.After(time.Minute * 10):
-			log.Fatal().Msg("couldn't download after 10 minutes")
-		}
-	}()
+// seedBlock makes a block we are trying to mine available to everybody else.
+func seedBlock(serializedBlock []byte) error {
+	id, err := blockSource.Publish(serializedBlock)
+	if err != nil {
+		return err
+	}
 
-	log.Info().Msg("block downloaded")
-	return blockchan
+	log.Info().Stringer("block-id", id).Msg("seeding our block")
+	return nil
 }
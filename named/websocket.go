@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/fiatjaf/namechain/common"
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// handleWebSocket accepts JSON-RPC-like messages:
+//
+//	{"id": 1, "method": "subscribe", "params": {"topic": "namechanged", "name": "example"}}
+//	{"id": 2, "method": "unsubscribe", "params": {"topic": "newblock"}}
+//
+// and then pushes events as {"topic": "...", "data": {...}}.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if authorized, _ := authenticateRPC(r); !authorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="named"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to upgrade websocket")
+		return
+	}
+	defer conn.Close()
+
+	sub := subscribe()
+	defer sub.unsubscribe()
+
+	// responses to subscribe/unsubscribe go through here so we only have one writer
+	responses := make(chan common.RPCResponse)
+	done := make(chan struct{})
+	defer close(done)
+
+	// writer
+	go func() {
+		for {
+			var msg interface{}
+			select {
+			case resp := <-responses:
+				msg = resp
+			case event := <-sub.events:
+				msg = event
+			case <-sub.slow:
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation,
+						"subscriber too slow"),
+					time.Now().Add(time.Second))
+				conn.Close()
+				return
+			case <-done:
+				return
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(msg); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	// reader
+	for {
+		var req common.RPCRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+
+		var resp common.RPCResponse
+		resp.ID = req.ID
+		if err := sub.handle(req); err != nil {
+			resp.Error.Code = 5000
+			resp.Error.Message = err.Error()
+		} else {
+			resp.Result = true
+		}
+
+		select {
+		case responses <- resp:
+		case <-sub.slow:
+			return
+		}
+	}
+}
+
+func (sub *subscriber) handle(req common.RPCRequest) error {
+	params, err := (rpcMethod{params: []string{"topic", "name"}}).namedParams(req.Params)
+	if err != nil {
+		return err
+	}
+
+	topic, _ := params["topic"].(string)
+	switch topic {
+	case EVENT_NEWBLOCK, EVENT_NAMECHANGED, EVENT_REORG, EVENT_SYNCPROGRESS:
+	default:
+		return errors.New("unknown topic '" + topic + "'")
+	}
+
+	// namechanged can be filtered by name or name hash
+	var nameHash *[32]byte
+	if name, ok := params["name"].(string); ok {
+		hash := sha256.Sum256([]byte(name))
+		nameHash = &hash
+	} else if hexHash, ok := params["namehash"].(string); ok {
+		b, err := hex.DecodeString(hexHash)
+		if err != nil || len(b) != 32 {
+			return errors.New("'namehash' param is invalid.")
+		}
+		var hash [32]byte
+		copy(hash[:], b)
+		nameHash = &hash
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	switch req.Method {
+	case "subscribe":
+		sub.topics[topic] = true
+		if nameHash != nil && topic == EVENT_NAMECHANGED {
+			sub.names[*nameHash] = true
+		}
+	case "unsubscribe":
+		if nameHash != nil && topic == EVENT_NAMECHANGED {
+			delete(sub.names, *nameHash)
+			if len(sub.names) > 0 {
+				// still subscribed to other names
+				return nil
+			}
+		}
+		delete(sub.topics, topic)
+	default:
+		return errors.New("method not found: '" + req.Method + "'")
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/namechain/common"
+	"github.com/gorilla/websocket"
+)
+
+// newTestWebSocket serves handleWebSocket with a known cookie password.
+func newTestWebSocket(t *testing.T) (url string) {
+	t.Helper()
+
+	rpcCookiePassword = "cookiepassword"
+	t.Cleanup(func() { rpcCookiePassword = "" })
+
+	server := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+	t.Cleanup(server.Close)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func basicAuth(user, password string) http.Header {
+	req := http.Request{Header: http.Header{}}
+	req.SetBasicAuth(user, password)
+	return req.Header
+}
+
+func dialWebSocket(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, basicAuth(common.COOKIE_USER, rpcCookiePassword))
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func wsSubscribe(t *testing.T, conn *websocket.Conn, params map[string]interface{}) {
+	t.Helper()
+
+	if err := conn.WriteJSON(map[string]interface{}{
+		"id": 1, "method": "subscribe", "params": params,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Result bool `json:"result"`
+		Error  struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&resp); err != nil || !resp.Result {
+		t.Fatalf("subscribe to %v: %v %s", params, err, resp.Error.Message)
+	}
+}
+
+func wsEvent(t *testing.T, conn *websocket.Conn) (topic string, data map[string]interface{}) {
+	t.Helper()
+
+	var event struct {
+		Topic string                 `json:"topic"`
+		Data  map[string]interface{} `json:"data"`
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("failed to read event: %s", err)
+	}
+	return event.Topic, event.Data
+}
+
+// wsNothing checks that no other event arrives. the connection can't be read
+// from afterwards.
+func wsNothing(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	var event interface{}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err := conn.ReadJSON(&event); err == nil {
+		t.Fatalf("unexpected event %v", event)
+	}
+}
+
+func TestWebSocketRequiresAuth(t *testing.T) {
+	newTestChain(t)
+	url := newTestWebSocket(t)
+
+	for _, header := range []http.Header{nil, basicAuth(common.COOKIE_USER, "wrong")} {
+		_, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("dialed without valid credentials: %v %v", resp, err)
+		}
+	}
+}
+
+func TestWebSocketEvents(t *testing.T) {
+	newTestChain(t)
+	url := newTestWebSocket(t)
+	_, alice := testKey("alice")
+	_, bob := testKey("bob")
+	aliceHash := sha256.Sum256([]byte("alice.name"))
+	bobHash := sha256.Sum256([]byte("bob.name"))
+
+	all := dialWebSocket(t, url)
+	for _, topic := range []string{EVENT_NEWBLOCK, EVENT_NAMECHANGED, EVENT_REORG} {
+		wsSubscribe(t, all, map[string]interface{}{"topic": topic})
+	}
+	byName := dialWebSocket(t, url)
+	wsSubscribe(t, byName, map[string]interface{}{
+		"topic": EVENT_NAMECHANGED, "name": "alice.name",
+	})
+	byHash := dialWebSocket(t, url)
+	wsSubscribe(t, byHash, map[string]interface{}{
+		"topic": EVENT_NAMECHANGED, "namehash": hex.EncodeToString(bobHash[:]),
+	})
+
+	block := addTestBlock(t, acquireTx("alice.name", alice), acquireTx("bob.name", bob))
+
+	topic, data := wsEvent(t, all)
+	if topic != EVENT_NEWBLOCK || data["id"] != block.ID.HexString() ||
+		data["height"] != float64(1) || data["transactions"] != float64(2) {
+		t.Fatalf("expected the new block, got %s %v", topic, data)
+	}
+	changed := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		topic, data := wsEvent(t, all)
+		if topic != EVENT_NAMECHANGED || data["block"] != block.ID.HexString() {
+			t.Fatalf("expected a name change, got %s %v", topic, data)
+		}
+		changed[data["namehash"].(string)] = data["key"].(string)
+	}
+	if changed[hex.EncodeToString(aliceHash[:])] != hex.EncodeToString(alice[:]) ||
+		changed[hex.EncodeToString(bobHash[:])] != hex.EncodeToString(bob[:]) {
+		t.Fatalf("wrong name changes %v", changed)
+	}
+
+	if err := undoBlocks(0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	topic, data = wsEvent(t, all)
+	if topic != EVENT_REORG || data["disconnected"] != block.ID.HexString() ||
+		data["height"] != float64(1) {
+		t.Fatalf("expected the reorg, got %s %v", topic, data)
+	}
+	for i := 0; i < 2; i++ {
+		topic, data := wsEvent(t, all)
+		if topic != EVENT_NAMECHANGED || data["key"] != hex.EncodeToString(make([]byte, 32)) {
+			t.Fatalf("expected a name to be removed, got %s %v", topic, data)
+		}
+	}
+	wsNothing(t, all)
+
+	// the filtered subscribers only see their name, acquired and then removed
+	for _, c := range []struct {
+		conn     *websocket.Conn
+		nameHash [32]byte
+		key      [32]byte
+	}{{byName, aliceHash, alice}, {byHash, bobHash, bob}} {
+		conn, nameHash := c.conn, c.nameHash
+		for _, key := range [][32]byte{c.key, {}} {
+			topic, data := wsEvent(t, conn)
+			if topic != EVENT_NAMECHANGED || data["namehash"] != hex.EncodeToString(nameHash[:]) ||
+				data["key"] != hex.EncodeToString(key[:]) {
+				t.Fatalf("expected %x to change to %x, got %s %v", nameHash, key, topic, data)
+			}
+		}
+		wsNothing(t, conn)
+	}
+}
+
+func TestWebSocketDropsSlowSubscribers(t *testing.T) {
+	newTestChain(t)
+	url := newTestWebSocket(t)
+
+	// connections from other tests may still be going away
+	subscribers.Lock()
+	others := make(map[*subscriber]struct{})
+	for sub := range subscribers.m {
+		others[sub] = struct{}{}
+	}
+	subscribers.Unlock()
+
+	conn := dialWebSocket(t, url)
+	wsSubscribe(t, conn, map[string]interface{}{"topic": EVENT_NEWBLOCK})
+	var slow *subscriber
+	subscribers.Lock()
+	for sub := range subscribers.m {
+		if _, ok := others[sub]; !ok {
+			slow = sub
+		}
+	}
+	subscribers.Unlock()
+	if slow == nil {
+		t.Fatal("the connection didn't subscribe")
+	}
+
+	// the client never reads, so once the socket buffers and the subscriber's
+	// own buffer are full it must be dropped without blocking us
+	payload := strings.Repeat("x", 16*1024)
+	start := time.Now()
+	for i := 0; ; i++ {
+		if i > 100000 {
+			t.Fatal("the slow subscriber wasn't dropped")
+		}
+		emitEvent(EVENT_NEWBLOCK, payload, nil)
+
+		subscribers.Lock()
+		_, connected := subscribers.m[slow]
+		subscribers.Unlock()
+		if !connected {
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("publishing to a slow subscriber took %s", elapsed)
+	}
+
+	// and its connection is closed once it catches up with what was sent
+	for {
+		conn.SetReadDeadline(time.Now().Add(15 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Fatalf("expected to be closed for being too slow, got %s", err)
+			}
+			break
+		}
+	}
+}
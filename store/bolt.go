@@ -0,0 +1,78 @@
+package store
+
+import (
+	"bytes"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// everything goes in a single bucket, callers separate their data with key
+// prefixes like they do with badger.
+var boltBucket = []byte("namechain")
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+type boltTxn struct {
+	bucket *bolt.Bucket
+}
+
+func openBolt(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db}, nil
+}
+
+func (s *boltStore) View(fn func(txn Txn) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTxn{tx.Bucket(boltBucket)})
+	})
+}
+
+func (s *boltStore) Update(fn func(txn Txn) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTxn{tx.Bucket(boltBucket)})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (t boltTxn) Get(key []byte) ([]byte, error) {
+	// a cursor, because Get can't tell a missing key from an empty value
+	k, value := t.bucket.Cursor().Seek(key)
+	if k == nil || !bytes.Equal(k, key) {
+		return nil, ErrNotFound
+	}
+	// bolt values are only valid during the transaction
+	return append([]byte(nil), value...), nil
+}
+
+func (t boltTxn) Set(key, value []byte) error {
+	return t.bucket.Put(key, value)
+}
+
+func (t boltTxn) Delete(key []byte) error {
+	return t.bucket.Delete(key)
+}
+
+func (t boltTxn) ForEach(prefix []byte, fn func(key, value []byte) error) error {
+	c := t.bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(append([]byte(nil), k...), append([]byte(nil), v...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
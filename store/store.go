@@ -0,0 +1,48 @@
+// Package store is the key-value storage named keeps its blocks, chainstate and
+// checkpoints in. It can be backed by badger or by bbolt, which has a much
+// smaller footprint for embedded users.
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	BACKEND_BADGER = "badger"
+	BACKEND_BBOLT  = "bbolt"
+)
+
+var ErrNotFound = errors.New("key not found")
+
+// Store runs transactions. changes made in an Update are committed together or
+// not at all.
+type Store interface {
+	View(fn func(txn Txn) error) error
+	Update(fn func(txn Txn) error) error
+	Close() error
+}
+
+type Txn interface {
+	// Get returns ErrNotFound if the key doesn't exist. the value can be kept
+	// after the transaction ends.
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+
+	// ForEach calls fn for every key with the given prefix, in order.
+	ForEach(prefix []byte, fn func(key, value []byte) error) error
+}
+
+// Open opens the store at path with the given backend, creating it if needed.
+// badger stores are directories and bbolt stores are single files.
+func Open(backend string, path string) (Store, error) {
+	switch backend {
+	case BACKEND_BADGER, "":
+		return openBadger(path)
+	case BACKEND_BBOLT:
+		return openBolt(path)
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s'", backend)
+	}
+}
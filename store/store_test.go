@@ -0,0 +1,231 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// every backend must behave the same, named doesn't know which one it has.
+var backends = []string{BACKEND_BADGER, BACKEND_BBOLT}
+
+var conformance = []struct {
+	name string
+	run  func(t *testing.T, s Store)
+}{
+	{"missing key", func(t *testing.T, s Store) {
+		s.View(func(txn Txn) error {
+			if _, err := txn.Get([]byte("missing")); err != ErrNotFound {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+			return nil
+		})
+	}},
+	{"set and get", func(t *testing.T, s Store) {
+		mustUpdate(t, s, func(txn Txn) error {
+			if err := txn.Set([]byte("a"), []byte("1")); err != nil {
+				return err
+			}
+			// writes are seen within the same transaction
+			if v, err := txn.Get([]byte("a")); err != nil || string(v) != "1" {
+				t.Fatalf("own write not seen: %q %v", v, err)
+			}
+			return nil
+		})
+
+		var v []byte
+		s.View(func(txn Txn) (err error) {
+			v, err = txn.Get([]byte("a"))
+			return err
+		})
+		// the value is still good after the transaction ended
+		if string(v) != "1" {
+			t.Fatalf("got %q", v)
+		}
+	}},
+	{"empty value", func(t *testing.T, s Store) {
+		mustUpdate(t, s, func(txn Txn) error {
+			return txn.Set([]byte("empty"), []byte{})
+		})
+		s.View(func(txn Txn) error {
+			if v, err := txn.Get([]byte("empty")); err != nil || len(v) != 0 {
+				t.Fatalf("empty value: %q %v", v, err)
+			}
+			return nil
+		})
+	}},
+	{"overwrite and delete", func(t *testing.T, s Store) {
+		mustUpdate(t, s, func(txn Txn) error {
+			txn.Set([]byte("a"), []byte("1"))
+			return txn.Set([]byte("a"), []byte("2"))
+		})
+		s.View(func(txn Txn) error {
+			if v, _ := txn.Get([]byte("a")); string(v) != "2" {
+				t.Fatalf("overwrite: got %q", v)
+			}
+			return nil
+		})
+
+		mustUpdate(t, s, func(txn Txn) error {
+			if err := txn.Delete([]byte("a")); err != nil {
+				return err
+			}
+			// deleting what isn't there is fine
+			return txn.Delete([]byte("never-there"))
+		})
+		s.View(func(txn Txn) error {
+			if _, err := txn.Get([]byte("a")); err != ErrNotFound {
+				t.Fatalf("deleted key still there: %v", err)
+			}
+			return nil
+		})
+	}},
+	{"failed update is rolled back", func(t *testing.T, s Store) {
+		failure := errors.New("failure")
+		err := s.Update(func(txn Txn) error {
+			txn.Set([]byte("a"), []byte("1"))
+			return failure
+		})
+		if err != failure {
+			t.Fatalf("update returned %v", err)
+		}
+		s.View(func(txn Txn) error {
+			if _, err := txn.Get([]byte("a")); err != ErrNotFound {
+				t.Fatalf("write of a failed update was kept: %v", err)
+			}
+			return nil
+		})
+	}},
+	{"view is read-only", func(t *testing.T, s Store) {
+		s.View(func(txn Txn) error {
+			if err := txn.Set([]byte("a"), []byte("1")); err == nil {
+				t.Fatal("set in a view didn't fail")
+			}
+			return nil
+		})
+	}},
+	{"foreach prefix in order", func(t *testing.T, s Store) {
+		mustUpdate(t, s, func(txn Txn) error {
+			for _, k := range []string{"p/c", "p/a", "q/a", "o/z", "p/b", "p"} {
+				if err := txn.Set([]byte(k), []byte("v"+k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		var keys []string
+		s.View(func(txn Txn) error {
+			return txn.ForEach([]byte("p/"), func(key, value []byte) error {
+				if !bytes.Equal(value, append([]byte("v"), key...)) {
+					t.Fatalf("wrong value %q for %q", value, key)
+				}
+				keys = append(keys, string(key))
+				return nil
+			})
+		})
+		if len(keys) != 3 || keys[0] != "p/a" || keys[1] != "p/b" || keys[2] != "p/c" {
+			t.Fatalf("got %v", keys)
+		}
+
+		// an error stops it and is returned
+		stop := errors.New("stop")
+		calls := 0
+		err := s.View(func(txn Txn) error {
+			return txn.ForEach([]byte("p/"), func(key, value []byte) error {
+				calls++
+				return stop
+			})
+		})
+		if err != stop || calls != 1 {
+			t.Fatalf("foreach didn't stop: %v after %d calls", err, calls)
+		}
+	}},
+	{"foreach can delete what it visits", func(t *testing.T, s Store) {
+		mustUpdate(t, s, func(txn Txn) error {
+			for _, k := range []string{"d/1", "d/2", "d/3"} {
+				txn.Set([]byte(k), []byte("v"))
+			}
+			return nil
+		})
+		mustUpdate(t, s, func(txn Txn) error {
+			var keys [][]byte
+			if err := txn.ForEach([]byte("d/"), func(key, value []byte) error {
+				keys = append(keys, key)
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		s.View(func(txn Txn) error {
+			return txn.ForEach([]byte("d/"), func(key, value []byte) error {
+				t.Fatalf("%q wasn't deleted", key)
+				return nil
+			})
+		})
+	}},
+}
+
+func TestConformance(t *testing.T) {
+	for _, backend := range backends {
+		for _, c := range conformance {
+			t.Run(backend+"/"+c.name, func(t *testing.T) {
+				s, err := Open(backend, filepath.Join(t.TempDir(), "db"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+				c.run(t, s)
+			})
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			s, err := Open(backend, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustUpdate(t, s, func(txn Txn) error {
+				return txn.Set([]byte("a"), []byte("1"))
+			})
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if s, err = Open(backend, path); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			s.View(func(txn Txn) error {
+				if v, err := txn.Get([]byte("a")); err != nil || string(v) != "1" {
+					t.Fatalf("not kept after reopening: %q %v", v, err)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	if _, err := Open("leveldb", filepath.Join(t.TempDir(), "db")); err == nil {
+		t.Fatal("unknown backend was opened")
+	}
+}
+
+func mustUpdate(t *testing.T, s Store, fn func(txn Txn) error) {
+	t.Helper()
+	if err := s.Update(fn); err != nil {
+		t.Fatal(err)
+	}
+}